@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/patrickhaller/slog"
+)
+
+// apiPrefix is where the -http-addr api serves; /xattr/PATH returns the
+// xattrs of PATH as a json object of base64 values, /xattr/PATH/ATTR
+// the raw value of one
+const apiPrefix = "/xattr/"
+
+// serveAPI serves the read-only xattr api on addr, from the mounted db.
+// Anyone who can connect can read every stored xattr, so addr should be
+// a loopback one.
+func serveAPI(x *xattrFs, addr string) *http.Server {
+	if host, _, err := net.SplitHostPort(addr); err == nil && !loopback(host) {
+		slog.P("http api on `%s' is open to the network, with no access control", addr)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiPrefix, x.serveXattr)
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.P("http api on `%s' failed: `%v'", addr, err)
+		}
+	}()
+	return srv
+}
+
+// loopback reports whether host names only the local machine
+func loopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// apiStatus maps a fuse.Status to the http status to answer with
+func apiStatus(code fuse.Status) int {
+	switch code {
+	case fuse.ENOENT, fuse.ENOATTR:
+		return http.StatusNotFound
+	case fuse.EBUSY, shutdown:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func (x *xattrFs) serveXattr(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "read-only", http.StatusMethodNotAllowed)
+		return
+	}
+	if !holdDb() {
+		http.Error(w, "unmounting", http.StatusServiceUnavailable)
+		return
+	}
+	defer releaseDb()
+	name := mountPath(strings.TrimPrefix(r.URL.Path, apiPrefix))
+	// a last element naming a stored attr of its parent is that attr,
+	// otherwise the whole path is the file
+	if dir, attr := path.Split(name); persisted(attr) {
+		if v, code := x.apiGet(mountPath(dir), attr); code == fuse.OK {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(v)
+			return
+		} else if code != fuse.ENOATTR && code != fuse.ENOENT {
+			http.Error(w, code.String(), apiStatus(code))
+			return
+		}
+	}
+	attrs, code := x.apiList(name)
+	if code != fuse.OK {
+		http.Error(w, code.String(), apiStatus(code))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(attrs)
+}
+
+// apiGet returns the stored value of attr on name
+func (x *xattrFs) apiGet(name string, attr string) ([]byte, fuse.Status) {
+	bucket, code := x.lookupBucket(name)
+	if code != fuse.OK {
+		return nil, code
+	}
+	v, _, code := x.store.Get(bucket, attrKey(attr))
+	return v, code
+}
+
+// apiList returns all stored xattrs of name, ENOENT if there are none
+func (x *xattrFs) apiList(name string) (map[string][]byte, fuse.Status) {
+	bucket, code := x.lookupBucket(name)
+	if code != fuse.OK {
+		return nil, code
+	}
+	attrs := map[string][]byte{}
+	for _, ns := range namespaceList {
+		names, code := x.store.List(bucket, ns+".")
+		if code != fuse.OK {
+			return nil, code
+		}
+		for _, attr := range names {
+			v, _, code := x.store.Get(bucket, attrKey(attr))
+			if code == fuse.ENOATTR {
+				continue
+			}
+			if code != fuse.OK {
+				return nil, code
+			}
+			attrs[attr] = v
+		}
+	}
+	if len(attrs) == 0 {
+		return nil, fuse.ENOENT
+	}
+	return attrs, fuse.OK
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// apiGetPath answers a GET of path from the api of x
+func apiGetPath(x *xattrFs, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	x.serveXattr(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w
+}
+
+func TestAPI(t *testing.T) {
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	x.SetXAttr("f", "user.a", []byte("1"), 0, nil)
+	x.SetXAttr("f", "user.b", []byte("2"), 0, nil)
+	if w := apiGetPath(x, "/xattr/f/user.a"); w.Code != http.StatusOK || w.Body.String() != "1" {
+		t.Fatalf("get one = %d `%s', want 200 `1'", w.Code, w.Body)
+	}
+	w := apiGetPath(x, "/xattr/f")
+	var attrs map[string][]byte
+	if err := json.Unmarshal(w.Body.Bytes(), &attrs); w.Code != http.StatusOK || err != nil || len(attrs) != 2 || string(attrs["user.b"]) != "2" {
+		t.Fatalf("get all = %d `%s', want both", w.Code, w.Body)
+	}
+	for _, p := range []string{"/xattr/f/user.c", "/xattr/g"} {
+		if w := apiGetPath(x, p); w.Code != http.StatusNotFound {
+			t.Fatalf("get %s = %d, want 404", p, w.Code)
+		}
+	}
+	w = httptest.NewRecorder()
+	x.serveXattr(w, httptest.NewRequest(http.MethodPut, "/xattr/f/user.a", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("put = %d, want 405", w.Code)
+	}
+}
+
+func TestAPIKeepsReusedInode(t *testing.T) {
+	setFlag(t, "inode-keys", "true")
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	x.SetXAttr("f", "user.a", []byte("1"), 0, nil)
+	bucket, _ := x.lookupBucket("f")
+	// renamed behind the mount's back, f looks like a reused inode
+	if err := os.Rename(filepath.Join(dir, "f"), filepath.Join(dir, "g")); err != nil {
+		t.Fatal(err)
+	}
+	if w := apiGetPath(x, "/xattr/g"); w.Code != http.StatusNotFound {
+		t.Fatalf("get of a reused inode = %d, want 404", w.Code)
+	}
+	if v, _, code := x.store.Get(bucket, "user.a"); code != fuse.OK || string(v) != "1" {
+		t.Fatalf("after an api get, the reused inode's attr = `%s', %v, want kept", v, code)
+	}
+}
+
+func TestLoopback(t *testing.T) {
+	for host, want := range map[string]bool{"localhost": true, "127.0.0.1": true, "::1": true, "": false, "0.0.0.0": false, "example.com": false} {
+		if loopback(host) != want {
+			t.Errorf("loopback(%q) = %v", host, !want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/patrickhaller/slog"
+)
+
+// change is a successful change to the stored xattrs, and as json, one
+// line of the -audit-log; values are base64 encoded, and for the copy
+// and rename actions hold the other path
+type change struct {
+	Time   time.Time `json:"time"`
+	Uid    uint32    `json:"uid"`
+	Gid    uint32    `json:"gid"`
+	Action string    `json:"action"`
+	Path   string    `json:"path"`
+	Attr   string    `json:"attr,omitempty"`
+	Value  []byte    `json:"value,omitempty"`
+}
+
+var (
+	auditCh   chan *change
+	auditDone chan struct{}
+)
+
+// openAudit starts appending audit entries to filename, from a goroutine
+// so that FUSE requests only wait on the channel
+func openAudit(filename string) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	auditCh = make(chan *change, 4096)
+	auditDone = make(chan struct{})
+	go func() {
+		defer close(auditDone)
+		defer f.Close()
+		w := bufio.NewWriter(f)
+		enc := json.NewEncoder(w)
+		for e := range auditCh {
+			if err := enc.Encode(e); err != nil {
+				slog.P("failed to write audit log: `%v'", err)
+			}
+			if len(auditCh) == 0 {
+				if err := w.Flush(); err != nil {
+					slog.P("failed to write audit log: `%v'", err)
+				}
+			}
+		}
+		w.Flush()
+	}()
+	return nil
+}
+
+// writeAudit queues e for the -audit-log, if one is open
+func writeAudit(e *change) {
+	if auditCh != nil {
+		auditCh <- e
+	}
+}
+
+// closeAudit writes out any queued entries
+func closeAudit() {
+	if auditCh == nil {
+		return
+	}
+	close(auditCh)
+	<-auditDone
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// readAudit returns the entries of the audit log filename
+func readAudit(t *testing.T, filename string) []change {
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []change
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var e change
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			t.Fatalf("malformed audit entry `%s': %v", s.Text(), err)
+		}
+		entries = append(entries, e)
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestAudit(t *testing.T) {
+	audit := testAudit(t)
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	start := time.Now()
+	ctx := &fuse.Context{Owner: fuse.Owner{Uid: 0, Gid: 7}}
+	if code := x.SetXAttr("f", "user.a", []byte("1"), 0, ctx); code != fuse.OK {
+		t.Fatalf("set: %v", code)
+	}
+	// failures are not changes
+	if code := x.RemoveXAttr("f", "user.missing", ctx); code != fuse.ENOATTR {
+		t.Fatalf("remove of an unset attr: %v", code)
+	}
+	if code := x.RemoveXAttr("f", "user.a", ctx); code != fuse.OK {
+		t.Fatalf("remove: %v", code)
+	}
+	stopAudit()
+
+	// reopened, the log is appended to
+	if err := openAudit(audit); err != nil {
+		t.Fatal(err)
+	}
+	setX(t, x, "f", "user.b", "2")
+	stopAudit()
+
+	want := []change{
+		{Gid: 7, Action: actionSet, Path: "f", Attr: "user.a", Value: []byte("1")},
+		{Gid: 7, Action: actionRemove, Path: "f", Attr: "user.a"},
+		{Action: actionSet, Path: "f", Attr: "user.b", Value: []byte("2")},
+	}
+	got := readAudit(t, audit)
+	if len(got) != len(want) {
+		t.Fatalf("%d audit entries, want %d: %+v", len(got), len(want), got)
+	}
+	for i, e := range got {
+		if e.Time.Before(start.Add(-time.Second)) || e.Time.After(time.Now()) {
+			t.Errorf("entry %d at %v, not during the test", i, e.Time)
+		}
+		if e.Uid != want[i].Uid || e.Gid != want[i].Gid || e.Action != want[i].Action ||
+			e.Path != want[i].Path || e.Attr != want[i].Attr || string(e.Value) != string(want[i].Value) {
+			t.Errorf("entry %d = %+v, want %+v", i, e, want[i])
+		}
+	}
+}
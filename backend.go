@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"github.com/hanwen/go-fuse/unionfs"
+)
+
+// A backend makes the filesystem that xattrs are overlaid on, from
+// DIRECTORY, returning it and the directory it really keeps files in
+type backend func(dir string) (pathfs.FileSystem, string, error)
+
+// backends are the choices for -backend
+var backends = map[string]backend{
+	"loopback": loopbackBackend,
+	"tmpfs":    tmpfsBackend,
+}
+
+// loopbackBackend passes through to the files in dir, or given several
+// comma-separated dirs, to their union
+func loopbackBackend(dir string) (pathfs.FileSystem, string, error) {
+	dirs := strings.Split(dir, ",")
+	for _, d := range dirs {
+		if fi, err := os.Stat(d); err != nil {
+			return nil, "", err
+		} else if !fi.IsDir() {
+			return nil, "", fmt.Errorf("`%s' is not a directory", d)
+		}
+	}
+	if len(dirs) == 1 {
+		return pathfs.NewLoopbackFileSystem(dir), dir, nil
+	}
+	return unionBackend(dirs)
+}
+
+// unionDeletions is where, in the first of several dirs, the union
+// records files deleted from the others
+const unionDeletions = ".xattrfs-deletions"
+
+// unionBackend lays dirs over each other: a file is read from the first
+// that has it, and all changes go to the first, the others being only
+// read.  A changed file from a later dir is first copied up to the
+// first; one deleted is hidden by a note in unionDeletions.
+func unionBackend(dirs []string) (pathfs.FileSystem, string, error) {
+	layers := []pathfs.FileSystem{pathfs.NewLoopbackFileSystem(dirs[0])}
+	for _, d := range dirs[1:] {
+		layers = append(layers, pathfs.NewReadonlyFileSystem(pathfs.NewLoopbackFileSystem(d)))
+	}
+	fs, err := unionfs.NewUnionFs(layers, unionfs.UnionFsOptions{
+		BranchCacheTTL:   time.Second,
+		DeletionCacheTTL: time.Second,
+		DeletionDirName:  unionDeletions,
+	})
+	return fs, dirs[0], err
+}
+
+// scratchBase is where tmpfsBackend makes its scratch directories
+var scratchBase = "/dev/shm"
+
+// tmpfsMagic is the statfs f_type of a tmpfs
+const tmpfsMagic = 0x01021994
+
+// tmpfsBackend ignores dir, and keeps files in a new scratch directory on
+// the scratchBase tmpfs, for trying things out without touching the disk;
+// it fails rather than fall back to a disk, and the caller removes the
+// directory after unmounting
+func tmpfsBackend(string) (pathfs.FileSystem, string, error) {
+	s := syscall.Statfs_t{}
+	if err := syscall.Statfs(scratchBase, &s); err != nil {
+		return nil, "", fmt.Errorf("no tmpfs for -backend tmpfs: %v", err)
+	}
+	if s.Type != tmpfsMagic {
+		return nil, "", fmt.Errorf("`%s' is not a tmpfs, for -backend tmpfs", scratchBase)
+	}
+	dir, err := ioutil.TempDir(scratchBase, "xattrfs-")
+	if err != nil {
+		return nil, "", err
+	}
+	return pathfs.NewLoopbackFileSystem(dir), dir, nil
+}
+
+// overlaps reports whether dir and mountpoint are the same directory, or
+// one is beneath the other, which would loop the mount back on itself
+func overlaps(dir string, mountpoint string) bool {
+	abs := func(p string) string {
+		if a, err := filepath.Abs(p); err == nil {
+			p = a
+		}
+		if r, err := filepath.EvalSymlinks(p); err == nil {
+			p = r
+		}
+		return filepath.Clean(p)
+	}
+	a, b := abs(dir), abs(mountpoint)
+	within := func(p string, parent string) bool {
+		return p == parent || strings.HasPrefix(p, strings.TrimSuffix(parent, "/")+"/")
+	}
+	return within(a, b) || within(b, a)
+}
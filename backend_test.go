@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestUnionLowerLayer(t *testing.T) {
+	testDb(t)
+	keepNamespaces(t, "user")
+	upper, lower := t.TempDir(), t.TempDir()
+	touch(t, lower, "f")
+	if err := os.Symlink("f", filepath.Join(lower, "l")); err != nil {
+		t.Fatal(err)
+	}
+	fs, root, err := unionBackend([]string{upper, lower})
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := &xattrFs{FileSystem: fs, root: root, store: boltStore{}}
+	if !x.symlink("l") {
+		t.Fatalf("symlink in the lower layer not seen as one")
+	}
+	if x.symlink("f") {
+		t.Fatalf("file in the lower layer seen as a symlink")
+	}
+	other := &fuse.Context{Owner: fuse.Owner{Uid: uint32(os.Getuid()) + 1}}
+	if code := x.SetXAttr("f", "user.a", []byte("1"), 0, other); code != fuse.EPERM {
+		t.Fatalf("set by another user: %v, want EPERM", code)
+	}
+	if uid := uint32(os.Getuid()); uid != 0 {
+		owner := &fuse.Context{Owner: fuse.Owner{Uid: uid}}
+		if code := x.SetXAttr("f", "user.a", []byte("1"), 0, owner); code != fuse.OK {
+			t.Fatalf("set by the owner: %v", code)
+		}
+	} else if code := x.SetXAttr("f", "user.a", []byte("1"), 0, nil); code != fuse.OK {
+		t.Fatalf("set: %v", code)
+	}
+	if v, code := x.GetXAttr("f", "user.a", nil); code != fuse.OK || string(v) != "1" {
+		t.Fatalf("get = `%s', %v, want `1'", v, code)
+	}
+}
+
+// needTmpfs skips a test where scratchBase is not a tmpfs
+func needTmpfs(t *testing.T) {
+	s := syscall.Statfs_t{}
+	if err := syscall.Statfs(scratchBase, &s); err != nil || s.Type != tmpfsMagic {
+		t.Skipf("no tmpfs on `%s'", scratchBase)
+	}
+}
+
+func TestTmpfsBackend(t *testing.T) {
+	needTmpfs(t)
+	testDb(t)
+	keepNamespaces(t, "user")
+	fs, dir, err := tmpfsBackend("ignored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if filepath.Base(dir) == "ignored" || !filepath.IsAbs(dir) {
+		t.Fatalf("tmpfs keeps files in `%s', want a new temporary directory", dir)
+	}
+	x := &xattrFs{FileSystem: fs, root: dir, store: boltStore{}}
+	if code := x.Mknod("f", syscall.S_IFREG|0644, 0, nil); code != fuse.OK {
+		t.Fatalf("mknod: %v", code)
+	}
+	setX(t, x, "f", "user.a", "1")
+	wantX(t, x, "f", "user.a", "1")
+	if code := x.Unlink("f", nil); code != fuse.OK {
+		t.Fatalf("unlink: %v", code)
+	}
+	wantNoX(t, x, "f", "user.a")
+}
+
+func TestTmpfsBackendRefusesDisk(t *testing.T) {
+	defer func(b string) { scratchBase = b }(scratchBase)
+	scratchBase = t.TempDir()
+	s := syscall.Statfs_t{}
+	if err := syscall.Statfs(scratchBase, &s); err != nil || s.Type == tmpfsMagic {
+		t.Skipf("`%s' is a tmpfs too", scratchBase)
+	}
+	if _, dir, err := tmpfsBackend(""); err == nil {
+		t.Fatalf("tmpfs backend made `%s' on a disk, want an error", dir)
+	}
+	if entries, _ := ioutil.ReadDir(scratchBase); len(entries) != 0 {
+		t.Fatalf("tmpfs backend left %d entries on the disk", len(entries))
+	}
+	scratchBase = filepath.Join(scratchBase, "missing")
+	if _, _, err := tmpfsBackend(""); err == nil {
+		t.Fatal("tmpfs backend without a scratchBase, want an error")
+	}
+}
+
+func TestOverlaps(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"a", "a/b", "ab", "c"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("a", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		dir, mountpoint string
+		want            bool
+	}{
+		{"a", "a", true},
+		{"a", "a/", true},
+		{"a", "c/../a", true},
+		{"a", "a/b", true},
+		{"a/b", "a", true},
+		{"link", "a/b", true},
+		{"a", "ab", false},
+		{"a/b", "c", false},
+	} {
+		if got := overlaps(filepath.Join(dir, tt.dir), filepath.Join(dir, tt.mountpoint)); got != tt.want {
+			t.Errorf("overlaps(%s, %s) = %v, want %v", tt.dir, tt.mountpoint, got, tt.want)
+		}
+	}
+}
+
+// TestMountOverlapping checks that the built binary refuses to mount a
+// directory on itself or within itself
+func TestMountOverlapping(t *testing.T) {
+	bin := buildMain(t)
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	dbFile := filepath.Join(t.TempDir(), "xattrs.db")
+	for _, dirs := range [][2]string{{dir, dir}, {dir, sub}, {sub, dir}} {
+		out, err := exec.Command(bin, dbFile, dirs[0], dirs[1]).CombinedOutput()
+		if err == nil {
+			t.Fatalf("mount of `%s' on `%s' exited zero", dirs[0], dirs[1])
+		}
+		if !strings.Contains(string(out), "one is the other") {
+			t.Errorf("mount of `%s' on `%s' printed `%s', want it refused", dirs[0], dirs[1], out)
+		}
+	}
+}
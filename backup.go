@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+	"github.com/patrickhaller/slog"
+)
+
+// backupFile writes a consistent copy of the mounted db to filename,
+// by way of a temporary file so a failed backup never replaces a good one
+func backupFile(filename string) error {
+	tmp := filename + ".tmp"
+	if !holdDb() {
+		return bolt.ErrDatabaseNotOpen
+	}
+	defer releaseDb()
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(tmp, 0600)
+	})
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// writeBackup writes a consistent copy of the mounted db
+func writeBackup(w http.ResponseWriter, r *http.Request) {
+	if !holdDb() {
+		http.Error(w, "unmounting", http.StatusServiceUnavailable)
+		return
+	}
+	defer releaseDb()
+	err := db.View(func(tx *bolt.Tx) error {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(tx.Size(), 10))
+		_, err := tx.WriteTo(w)
+		return err
+	})
+	if err != nil {
+		slog.P("backup to `%s' failed: `%v'", r.RemoteAddr, err)
+	}
+}
+
+// serveBackup serves a consistent copy of the mounted db at addr's /backup
+func serveBackup(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/backup", writeBackup)
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.P("backup server on `%s' failed: `%v'", addr, err)
+		}
+	}()
+	return srv
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestBackup(t *testing.T) {
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	touch(t, dir, "g")
+	setX(t, x, "f", "user.a", "1")
+	setX(t, x, "f", "user.b", "2")
+	setX(t, x, "g", "user.c", "3")
+	want := files{"f": {"user.a": "1", "user.b": "2"}, "g": {"user.c": "3"}}
+
+	filename := filepath.Join(t.TempDir(), "backup.db")
+	if err := backupFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	if got := readDb(t, filename); !reflect.DeepEqual(got, want) {
+		t.Fatalf("backup file has %v, want %v", got, want)
+	}
+
+	w := httptest.NewRecorder()
+	writeBackup(w, httptest.NewRequest(http.MethodGet, "/backup", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Length") != strconv.Itoa(w.Body.Len()) {
+		t.Fatalf("backup served %d, %s of %d bytes", w.Code, w.Header().Get("Content-Length"), w.Body.Len())
+	}
+	served := filepath.Join(t.TempDir(), "served.db")
+	if err := ioutil.WriteFile(served, w.Body.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := readDb(t, served); !reflect.DeepEqual(got, want) {
+		t.Fatalf("served backup has %v, want %v", got, want)
+	}
+}
+
+// TestBackupBesideWriters checks that backups taken while xattrs are set
+// are whole databases, each with some prefix of the sets
+func TestBackupBesideWriters(t *testing.T) {
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			x.SetXAttr("f", "user."+strconv.Itoa(i), []byte("v"), 0, nil)
+		}
+	}()
+	backups := t.TempDir()
+	for i := 0; i < 10; i++ {
+		filename := filepath.Join(backups, strconv.Itoa(i))
+		if err := backupFile(filename); err != nil {
+			t.Fatal(err)
+		}
+		got := readDb(t, filename)["f"]
+		for j := 0; j < len(got); j++ {
+			if got["user."+strconv.Itoa(j)] != "v" {
+				t.Fatalf("backup %d has %d attrs, but not user.%d", i, len(got), j)
+			}
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/boltdb/bolt"
+)
+
+// bulkEvery is how many files the bulk attr commands change per
+// transaction, so as not to hold one huge transaction
+const bulkEvery = 256
+
+// attrBuckets returns the names of the buckets of d that have key
+func attrBuckets(d *bolt.DB, key string) ([]string, error) {
+	var names []string
+	err := d.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if string(name) != pathIndex && string(name) != metaBucket && b.Get([]byte(key)) != nil {
+				names = append(names, string(name))
+			}
+			return nil
+		})
+	})
+	return names, err
+}
+
+// renameAttr renames oldAttr to newAttr on every file of the database at
+// filename that has it; a file with newAttr set already keeps it, takes
+// the renamed value, or fails the rename, as policy says.  It writes to w
+// how many files it renamed on and how many it skipped.
+func renameAttr(filename string, oldAttr string, newAttr string, policy string, w io.Writer) error {
+	switch policy {
+	case lastWins, firstWins, failOnConflict:
+	default:
+		return fmt.Errorf("unknown conflict policy `%s'", policy)
+	}
+	if !validName(oldAttr) || !validName(newAttr) || oldAttr == newAttr {
+		return fmt.Errorf("want two different attr names")
+	}
+	d, err := openFlatDb(filename, false)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	oldKey, newKey := attrKey(oldAttr), attrKey(newAttr)
+	names, err := attrBuckets(d, oldKey)
+	if err != nil {
+		return err
+	}
+	var renamed, skipped int
+	for len(names) > 0 {
+		n := bulkEvery
+		if n > len(names) {
+			n = len(names)
+		}
+		// a rerun after a failure finds done files without oldKey
+		err := d.Update(func(tx *bolt.Tx) error {
+			for _, name := range names[:n] {
+				b := tx.Bucket([]byte(name))
+				if b == nil || b.Get([]byte(oldKey)) == nil {
+					continue
+				}
+				took, err := renameKey(b, oldKey, newKey, newAttr, policy)
+				if err != nil {
+					return fmt.Errorf("`%s': %v", keyPath(name), err)
+				}
+				if took {
+					renamed++
+				} else {
+					skipped++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		names = names[n:]
+	}
+	fmt.Fprintf(w, "renamed `%s' to `%s' on %d files, skipped %d that had it\n", oldAttr, newAttr, renamed, skipped)
+	return nil
+}
+
+// renameKey moves oldKey of b to newKey, named newAttr, along with the
+// reserved keys and history that go with it, reporting whether it did
+func renameKey(b *bolt.Bucket, oldKey string, newKey string, newAttr string, policy string) (bool, error) {
+	if oldKey == newKey {
+		// only the case differs, with -case-insensitive
+		return true, putCase(b, newKey, newAttr)
+	}
+	if b.Get([]byte(newKey)) != nil {
+		if policy == firstWins {
+			return false, nil
+		}
+		if policy == failOnConflict {
+			return false, fmt.Errorf("already has `%s'", newAttr)
+		}
+		if err := deleteValue(b, newKey); err != nil {
+			return false, err
+		}
+	}
+	v, err := getValue(b, oldKey)
+	if err != nil {
+		return false, err
+	}
+	if err := putValue(b, newKey, clone(v)); err != nil {
+		return false, err
+	}
+	if err := putCase(b, newKey, newAttr); err != nil {
+		return false, err
+	}
+	// it keeps its expiry, and its place in the -preserve-order listing
+	for _, keys := range [][2][]byte{{expiryKey(oldKey), expiryKey(newKey)}, {seqKey(oldKey), seqKey(newKey)}} {
+		if e := b.Get(keys[0]); e != nil {
+			if err := b.Put(keys[1], clone(e)); err != nil {
+				return false, err
+			}
+		}
+	}
+	if h := b.Bucket(historyBucket(oldKey)); h != nil {
+		nh, err := b.CreateBucket(historyBucket(newKey))
+		if err != nil {
+			return false, err
+		}
+		if err := cloneBucket(nh, h); err != nil {
+			return false, err
+		}
+	}
+	return true, deleteValue(b, oldKey)
+}
+
+// deleteAttr removes attr from every file of the database at filename
+// that has it, writing to w how many files that was
+func deleteAttr(filename string, attr string, w io.Writer) error {
+	if !validName(attr) {
+		return fmt.Errorf("want an attr name")
+	}
+	d, err := openFlatDb(filename, false)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	key := attrKey(attr)
+	names, err := attrBuckets(d, key)
+	if err != nil {
+		return err
+	}
+	deleted := 0
+	for len(names) > 0 {
+		n := bulkEvery
+		if n > len(names) {
+			n = len(names)
+		}
+		err := d.Update(func(tx *bolt.Tx) error {
+			for _, name := range names[:n] {
+				b := tx.Bucket([]byte(name))
+				if b == nil || b.Get([]byte(key)) == nil {
+					continue
+				}
+				if err := deleteValue(b, key); err != nil {
+					return fmt.Errorf("`%s': %v", keyPath(name), err)
+				}
+				deleted++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		names = names[n:]
+	}
+	fmt.Fprintf(w, "deleted `%s' from %d files\n", attr, deleted)
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRenameAttr(t *testing.T) {
+	for _, tt := range []struct {
+		policy  string
+		wantG   string
+		skipped int
+	}{
+		{lastWins, "2", 0},
+		{firstWins, "kept", 1},
+	} {
+		t.Run(tt.policy, func(t *testing.T) {
+			fs := files{
+				"f":   {"user.old": "1", "user.other": "o"},
+				"d/g": {"user.old": "2", "user.new": "kept"},
+				"h":   {"user.other": "h"},
+			}
+			// more than one transaction's worth
+			for i := 0; i < bulkEvery+10; i++ {
+				fs[fmt.Sprintf("many/%d", i)] = map[string]string{"user.old": "m"}
+			}
+			filename := writeDb(t, true, fs)
+			var out bytes.Buffer
+			if err := renameAttr(filename, "user.old", "user.new", tt.policy, &out); err != nil {
+				t.Fatalf("rename: %v", err)
+			}
+			renamed := bulkEvery + 12 - tt.skipped
+			if want := fmt.Sprintf("on %d files, skipped %d", renamed, tt.skipped); !strings.Contains(out.String(), want) {
+				t.Errorf("rename reported `%s', want `%s'", strings.TrimSpace(out.String()), want)
+			}
+			got := readDb(t, filename)
+			if want := map[string]string{"user.new": "1", "user.other": "o"}; !reflect.DeepEqual(got["f"], want) {
+				t.Errorf("f = %v, want %v", got["f"], want)
+			}
+			if got["d/g"]["user.new"] != tt.wantG {
+				t.Errorf("d/g = %v, want user.new %s", got["d/g"], tt.wantG)
+			}
+			if want := map[string]string{"user.other": "h"}; !reflect.DeepEqual(got["h"], want) {
+				t.Errorf("h = %v, want %v", got["h"], want)
+			}
+			for i := 0; i < bulkEvery+10; i++ {
+				name := fmt.Sprintf("many/%d", i)
+				if want := map[string]string{"user.new": "m"}; !reflect.DeepEqual(got[name], want) {
+					t.Fatalf("%s = %v, want %v", name, got[name], want)
+				}
+			}
+		})
+	}
+	filename := writeDb(t, true, files{"f": {"user.old": "1", "user.new": "2"}})
+	if err := renameAttr(filename, "user.old", "user.new", failOnConflict, &bytes.Buffer{}); err == nil {
+		t.Fatalf("rename onto a set attr with %s succeeded", failOnConflict)
+	}
+	if got := readDb(t, filename); got["f"]["user.old"] != "1" || got["f"]["user.new"] != "2" {
+		t.Fatalf("failed rename left f = %v", got["f"])
+	}
+	for _, names := range [][2]string{{"user.a", "user.a"}, {"", "user.a"}, {"user.a", "\x00x"}} {
+		if err := renameAttr(filename, names[0], names[1], lastWins, &bytes.Buffer{}); err == nil {
+			t.Errorf("rename of `%q' to `%q' succeeded", names[0], names[1])
+		}
+	}
+}
+
+func TestDeleteAttr(t *testing.T) {
+	fs := files{
+		"f":   {"user.tag": "1", "user.other": "o"},
+		"d/g": {"user.tag": "2"},
+		"h":   {"user.other": "h"},
+	}
+	for i := 0; i < bulkEvery+10; i++ {
+		fs[fmt.Sprintf("many/%d", i)] = map[string]string{"user.tag": "m", "user.keep": "k"}
+	}
+	filename := writeDb(t, true, fs)
+	// run again, it finds none to delete
+	for _, want := range []int{bulkEvery + 12, 0} {
+		var out bytes.Buffer
+		if err := deleteAttr(filename, "user.tag", &out); err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+		if w := fmt.Sprintf("from %d files", want); !strings.Contains(out.String(), w) {
+			t.Errorf("delete reported `%s', want `%s'", strings.TrimSpace(out.String()), w)
+		}
+	}
+	got := readDb(t, filename)
+	for name, attrs := range fs {
+		delete(attrs, "user.tag")
+		if !reflect.DeepEqual(got[name], attrs) {
+			t.Fatalf("%s = %v, want %v", name, got[name], attrs)
+		}
+	}
+	if err := deleteAttr(filename, "\x00x", &bytes.Buffer{}); err == nil {
+		t.Fatalf("delete of a reserved name succeeded")
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+// xattrCache is an LRU of stored values by bucket and attr, for
+// -cache-entries; a nil value records that the attr is not stored, and
+// is only believed for -negative-cache-ttl
+type xattrCache struct {
+	sync.Mutex
+	max     int
+	ttl     time.Duration
+	lru     *list.List
+	entries map[string]map[string]*list.Element
+	// gen counts invalidations, so that a value read from the database
+	// before a concurrent change is not cached after it
+	gen uint64
+}
+
+type cacheEntry struct {
+	bucket string
+	attr   string
+	value  []byte
+	expiry time.Time
+}
+
+var cache = &xattrCache{
+	lru:     list.New(),
+	entries: map[string]map[string]*list.Element{},
+}
+
+// get returns the cached value, if any, and the generation to pass to put
+func (c *xattrCache) get(bucket string, attr string) ([]byte, bool, uint64) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[bucket][attr]
+	if !ok {
+		return nil, false, c.gen
+	}
+	if ce := e.Value.(*cacheEntry); ce.value == nil && time.Now().After(ce.expiry) {
+		c.remove(e)
+		return nil, false, c.gen
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).value, true, c.gen
+}
+
+func (c *xattrCache) put(bucket string, attr string, value []byte, gen uint64) {
+	c.Lock()
+	defer c.Unlock()
+	if c.max <= 0 || gen != c.gen || value == nil && c.ttl <= 0 {
+		return
+	}
+	expiry := time.Now().Add(c.ttl)
+	if e, ok := c.entries[bucket][attr]; ok {
+		e.Value.(*cacheEntry).value = value
+		e.Value.(*cacheEntry).expiry = expiry
+		c.lru.MoveToFront(e)
+		return
+	}
+	if c.entries[bucket] == nil {
+		c.entries[bucket] = map[string]*list.Element{}
+	}
+	c.entries[bucket][attr] = c.lru.PushFront(&cacheEntry{bucket, attr, value, expiry})
+	for c.lru.Len() > c.max {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *xattrCache) remove(e *list.Element) {
+	ce := c.lru.Remove(e).(*cacheEntry)
+	delete(c.entries[ce.bucket], ce.attr)
+	if len(c.entries[ce.bucket]) == 0 {
+		delete(c.entries, ce.bucket)
+	}
+}
+
+func (c *xattrCache) forget(bucket string, attr string) {
+	c.Lock()
+	defer c.Unlock()
+	c.gen++
+	if e, ok := c.entries[bucket][attr]; ok {
+		c.remove(e)
+	}
+}
+
+// forgetTree drops everything cached for bucket, and for the buckets of
+// paths beneath it
+func (c *xattrCache) forgetTree(bucket string) {
+	c.Lock()
+	defer c.Unlock()
+	c.gen++
+	for b, attrs := range c.entries {
+		if b == bucket || strings.HasPrefix(b, bucket+"/") {
+			for _, e := range attrs {
+				c.remove(e)
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// countingStore counts the Gets that reach its Store
+type countingStore struct {
+	Store
+	gets int
+}
+
+func (s *countingStore) Get(bucket string, key string) ([]byte, time.Time, fuse.Status) {
+	s.gets++
+	return s.Store.Get(bucket, key)
+}
+
+// cachedFs is testFs with a cache of max entries, remembering misses for
+// ttl, and a countingStore
+func cachedFs(t *testing.T, max int, ttl time.Duration) (*xattrFs, *countingStore, string) {
+	x, dir := testFs(t)
+	cache.max, cache.ttl = max, ttl
+	s := &countingStore{Store: x.store}
+	x.store = s
+	return x, s, dir
+}
+
+func TestCache(t *testing.T) {
+	x, s, dir := cachedFs(t, 2, 0)
+	touch(t, dir, "f")
+	touch(t, dir, "g")
+	setX(t, x, "f", "user.a", "1")
+	wantX(t, x, "f", "user.a", "1")
+	wantX(t, x, "f", "user.a", "1")
+	if s.gets != 1 {
+		t.Fatalf("%d gets reached the store, want the second served from the cache", s.gets)
+	}
+	setX(t, x, "f", "user.a", "2")
+	wantX(t, x, "f", "user.a", "2")
+	if code := x.RemoveXAttr("f", "user.a", nil); code != fuse.OK {
+		t.Fatalf("remove: %v", code)
+	}
+	wantNoX(t, x, "f", "user.a")
+
+	setX(t, x, "f", "user.b", "b")
+	wantX(t, x, "f", "user.b", "b")
+	if code := x.Rename("f", "h", nil); code != fuse.OK {
+		t.Fatalf("rename: %v", code)
+	}
+	wantNoX(t, x, "f", "user.b")
+	wantX(t, x, "h", "user.b", "b")
+	if code := x.Unlink("h", nil); code != fuse.OK {
+		t.Fatalf("unlink: %v", code)
+	}
+	touch(t, dir, "h")
+	wantNoX(t, x, "h", "user.b")
+
+	// the least recently used is dropped past max
+	setX(t, x, "g", "user.1", "1")
+	setX(t, x, "g", "user.2", "2")
+	setX(t, x, "g", "user.3", "3")
+	for _, attr := range []string{"user.1", "user.2", "user.3"} {
+		wantX(t, x, "g", attr, attr[5:])
+	}
+	s.gets = 0
+	wantX(t, x, "g", "user.3", "3")
+	wantX(t, x, "g", "user.2", "2")
+	wantX(t, x, "g", "user.1", "1")
+	if s.gets != 1 {
+		t.Fatalf("%d gets reached the store, want only that of the evicted user.1", s.gets)
+	}
+}
+
+func TestCacheDisabled(t *testing.T) {
+	x, s, dir := cachedFs(t, 0, time.Minute)
+	touch(t, dir, "f")
+	setX(t, x, "f", "user.a", "1")
+	wantX(t, x, "f", "user.a", "1")
+	wantX(t, x, "f", "user.a", "1")
+	wantNoX(t, x, "f", "user.b")
+	wantNoX(t, x, "f", "user.b")
+	if s.gets != 4 {
+		t.Fatalf("%d gets reached the store, want all 4 with -cache-entries 0", s.gets)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	x, s, dir := cachedFs(t, 10, 50*time.Millisecond)
+	touch(t, dir, "f")
+	wantNoX(t, x, "f", "user.a")
+	gets := s.gets
+	wantNoX(t, x, "f", "user.a")
+	wantNoX(t, x, "f", "user.a")
+	if s.gets != gets {
+		t.Fatalf("%d misses reached the store, want them served from the cache", s.gets-gets)
+	}
+	setX(t, x, "f", "user.a", "1")
+	wantX(t, x, "f", "user.a", "1")
+
+	// past the ttl the store is asked again
+	wantNoX(t, x, "f", "user.b")
+	time.Sleep(60 * time.Millisecond)
+	gets = s.gets
+	wantNoX(t, x, "f", "user.b")
+	if s.gets != gets+1 {
+		t.Fatalf("%d misses reached the store after the ttl, want 1", s.gets-gets)
+	}
+}
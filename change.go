@@ -0,0 +1,36 @@
+package main
+
+import (
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// change actions
+const (
+	actionSet    = "set"
+	actionRemove = "remove"
+	actionClear  = "clear"
+	actionCopy   = "copy"
+	actionRename = "rename"
+	actionDelete = "delete"
+	actionTTL    = "ttl"
+)
+
+// changed records a successful change to the stored xattrs
+func changed(context *fuse.Context, action string, path string, attr string, value []byte) {
+	e := &change{Time: time.Now(), Action: action, Path: path, Attr: attr, Value: value}
+	if context != nil {
+		e.Uid, e.Gid = context.Uid, context.Gid
+	}
+	writeAudit(e)
+	notify(e)
+	runHook(e)
+}
+
+// changedOK calls changed if code is fuse.OK, for deferring
+func changedOK(code fuse.Status, context *fuse.Context, action string, path string, attr string, value []byte) {
+	if code == fuse.OK {
+		changed(context, action, path, attr, value)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/boltdb/bolt"
+)
+
+// boltMagic marks a bolt meta page, of which the first two pages are a
+// pair, the one with the higher txid current.  After a 16-byte page
+// header each holds, in host order, taken here as little-endian, the
+// magic, version, page size and flags as uint32s, then the root bucket's
+// page and sequence, the freelist page, the high water page, and the
+// txid as uint64s.
+const boltMagic = 0xED0CDAED
+
+// boltMeta reads the meta page at off of f, reporting false if there is
+// none there
+func boltMeta(f *os.File, off int64) (pageSize uint32, pages uint64, txid uint64, ok bool) {
+	buf := make([]byte, 16+56)
+	if _, err := f.ReadAt(buf, off); err != nil {
+		return 0, 0, 0, false
+	}
+	m := buf[16:]
+	if binary.LittleEndian.Uint32(m) != boltMagic {
+		return 0, 0, 0, false
+	}
+	return binary.LittleEndian.Uint32(m[8:]), binary.LittleEndian.Uint64(m[40:]), binary.LittleEndian.Uint64(m[48:]), true
+}
+
+// checkSize fails if the database at filename is shorter than its meta
+// pages say, as when truncated; bolt would fault reading past the end
+// of its mmap, which no recover catches
+func checkSize(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	pageSize, pages, txid, ok := boltMeta(f, 0)
+	if !ok {
+		// left to bolt to report
+		return nil
+	}
+	if _, pages1, txid1, ok := boltMeta(f, int64(pageSize)); ok && txid1 > txid {
+		pages = pages1
+	}
+	if need := int64(pages) * int64(pageSize); fi.Size() < need {
+		return fmt.Errorf("damaged: truncated to %d bytes, of the %d its pages take", fi.Size(), need)
+	}
+	return nil
+}
+
+// checkDb reads every bucket and key of the database at filename, and
+// runs bolt's own consistency check over its pages, writing to w what it
+// found; an error means the database is damaged or unreadable
+func checkDb(filename string, w io.Writer) (err error) {
+	if err := checkSize(filename); err != nil {
+		return err
+	}
+	src, err := openDb(filename, true)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// bolt panics on some kinds of damaged page, rather than erring
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("damaged: %v", r)
+		}
+	}()
+	var buckets, keys int
+	var walk func(b *bolt.Bucket) error
+	walk = func(b *bolt.Bucket) error {
+		buckets++
+		return b.ForEach(func(k, v []byte) error {
+			if v != nil {
+				keys++
+				return nil
+			}
+			sub := b.Bucket(k)
+			if sub == nil {
+				return fmt.Errorf("bad nested bucket `%s'", k)
+			}
+			return walk(sub)
+		})
+	}
+	var problems int
+	err = src.View(func(tx *bolt.Tx) error {
+		err := tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if err := walk(b); err != nil {
+				return fmt.Errorf("bucket `%s': %v", dumpKey(name), err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for err := range tx.Check() {
+			fmt.Fprintln(w, err)
+			problems++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if problems > 0 {
+		return fmt.Errorf("%d consistency problems", problems)
+	}
+	fmt.Fprintf(w, "ok: %d buckets, %d keys\n", buckets, keys)
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+// damagedDb returns a database of many files with damage done to it by
+// damage, given its open file and its size
+func damagedDb(t *testing.T, damage func(f *os.File, size int64) error) string {
+	fs := files{}
+	for i := 0; i < 200; i++ {
+		fs["f"+strconv.Itoa(i)] = map[string]string{"user.a": "value " + strconv.Itoa(i)}
+	}
+	filename := writeDb(t, true, fs)
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := damage(f, fi.Size()); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestCheck(t *testing.T) {
+	filename := writeDb(t, true, files{"f": {"user.a": "1", "user.b": "2"}, "g": {"user.c": "3"}})
+	var out bytes.Buffer
+	if err := checkDb(filename, &out); err != nil {
+		t.Fatalf("check of a healthy database: %v\n%s", err, out.String())
+	}
+	if !regexp.MustCompile(`^ok: \d+ buckets, \d+ keys\n$`).Match(out.Bytes()) {
+		t.Fatalf("check printed `%s', want ok and counts", out.String())
+	}
+
+	for name, damage := range map[string]func(f *os.File, size int64) error{
+		"truncated": func(f *os.File, size int64) error {
+			return f.Truncate(size / 2)
+		},
+		"overwritten": func(f *os.File, size int64) error {
+			_, err := f.WriteAt(bytes.Repeat([]byte{0xa5}, int(size/2)), size/4)
+			return err
+		},
+	} {
+		out.Reset()
+		if err := checkDb(damagedDb(t, damage), &out); err == nil {
+			t.Errorf("check of a %s database passed: %s", name, out.String())
+		}
+	}
+}
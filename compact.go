@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+
+	"github.com/boltdb/bolt"
+)
+
+// copyNested copies every key and nested bucket of src into dst
+func copyNested(dst *bolt.Bucket, src *bolt.Bucket) error {
+	dst.FillPercent = 1.0
+	if err := dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+		sub, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return copyNested(sub, src.Bucket(k))
+	})
+}
+
+// compactFile rewrites the closed database at filename into a fresh
+// file, dropping the free pages that churn leaves behind, and keeping
+// the mode and ownership of the old
+func compactFile(filename string) error {
+	tmp := filename + ".compact"
+	os.Remove(tmp)
+	perms, err := filePerms(filename)
+	if err != nil {
+		return err
+	}
+	src, err := openDb(filename, true)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := openDb(tmp, false)
+	if err != nil {
+		return err
+	}
+	err = src.View(func(stx *bolt.Tx) error {
+		return dst.Update(func(dtx *bolt.Tx) error {
+			return stx.ForEach(func(name []byte, b *bolt.Bucket) error {
+				nb, err := dtx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyNested(nb, b)
+			})
+		})
+	})
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = perms.apply(tmp)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	before, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	after, err := os.Stat(tmp)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return err
+	}
+	infof("compacted `%s' from %d to %d bytes", filename, before.Size(), after.Size())
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// TestCompactShrinks inflates a database with values it then deletes,
+// and checks that compacting gives back the space and keeps the rest
+func TestCompactShrinks(t *testing.T) {
+	filename := writeDb(t, true, files{"f": {"user.a": "1"}})
+	d, err := openDb(filename, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := bytes.Repeat([]byte("v"), 4096)
+	for _, del := range []bool{false, true} {
+		err = d.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte(pathKey("g")))
+			if err != nil {
+				return err
+			}
+			for i := 0; i < 1000; i++ {
+				k := []byte("user." + strconv.Itoa(i))
+				if del {
+					err = b.Delete(k)
+				} else {
+					err = b.Put(k, big)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.Close()
+	before, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := compactFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() >= before.Size()/4 {
+		t.Fatalf("compacted from %d to %d bytes, want under a quarter", before.Size(), after.Size())
+	}
+	if got := readDb(t, filename); got["f"]["user.a"] != "1" || len(got["g"]) != 0 {
+		t.Fatalf("compacted %v, want only f's user.a", got)
+	}
+}
+
+func TestCompactKeepsPerms(t *testing.T) {
+	filename := writeDb(t, true, files{"f": {"user.a": "1"}, "g": {"user.b": "2"}})
+	if err := os.Chmod(filename, 0640); err != nil {
+		t.Fatal(err)
+	}
+	root := os.Getuid() == 0
+	if root {
+		if err := os.Chown(filename, 1, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := compactFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Fatalf("compacted mode %o, want 0640", fi.Mode().Perm())
+	}
+	if st := fi.Sys().(*syscall.Stat_t); root && (st.Uid != 1 || st.Gid != 1) {
+		t.Fatalf("compacted owner %d:%d, want 1:1", st.Uid, st.Gid)
+	}
+	if got := readDb(t, filename); got["f"]["user.a"] != "1" || got["g"]["user.b"] != "2" {
+		t.Fatalf("compacted %v, want f and g as they were", got)
+	}
+}
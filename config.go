@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// configArgs reads the -config file at filename, lines of NAME = VALUE
+// with # comments, NAME being a flag without its dash or one of
+// database, directory, and mountpoint.  It returns the flags as
+// arguments, to be parsed ahead of the command line's so that those
+// override them, and the positional arguments as far as they are given,
+// for a command line giving none.
+func configArgs(filename string) (flags []string, positional []string, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	var database, directory, mountpoint string
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, nil, fmt.Errorf("line %d: want NAME = VALUE", n)
+		}
+		name, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if v, err := strconv.Unquote(value); err == nil {
+			value = v
+		}
+		switch name {
+		case "database":
+			database = value
+		case "directory":
+			directory = value
+		case "mountpoint":
+			mountpoint = value
+		case "config":
+			return nil, nil, fmt.Errorf("line %d: config cannot name another", n)
+		default:
+			if flag.Lookup(name) == nil {
+				return nil, nil, fmt.Errorf("line %d: unknown option `%s'", n, name)
+			}
+			flags = append(flags, "-"+name+"="+value)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, nil, err
+	}
+	for _, arg := range []string{database, directory, mountpoint} {
+		if arg == "" {
+			break
+		}
+		positional = append(positional, arg)
+	}
+	return flags, positional, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a -config file of lines, returning its filename
+func writeConfig(t *testing.T, lines ...string) string {
+	filename := filepath.Join(t.TempDir(), "xattrfs.conf")
+	if err := ioutil.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestConfig(t *testing.T) {
+	filename := writeConfig(t,
+		"# options for the data mount",
+		"",
+		"database = /var/lib/xattrfs/xattrs.db",
+		`directory = "/srv/data"`,
+		"max-attrs-per-file = 10",
+		`fs-name = "data fs"`,
+		"  compress=true  ",
+	)
+	flags, positional, err := configArgs(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantFlags := []string{"-max-attrs-per-file=10", "-fs-name=data fs", "-compress=true"}
+	if !reflect.DeepEqual(flags, wantFlags) {
+		t.Fatalf("flags = %q, want %q", flags, wantFlags)
+	}
+	// without a mountpoint, only those before it
+	if want := []string{"/var/lib/xattrfs/xattrs.db", "/srv/data"}; !reflect.DeepEqual(positional, want) {
+		t.Fatalf("positional = %q, want %q", positional, want)
+	}
+
+	// parsed ahead of the command line, the command line wins
+	setFlag(t, "max-attrs-per-file", "0")
+	setFlag(t, "fs-name", *fsName)
+	setFlag(t, "compress", "false")
+	if err := flag.CommandLine.Parse(append(flags, "-max-attrs-per-file=7")); err != nil {
+		t.Fatal(err)
+	}
+	if *maxAttrs != 7 || *fsName != "data fs" || !*compress {
+		t.Fatalf("parsed max-attrs-per-file %d, fs-name `%s', compress %v, want 7, `data fs', true", *maxAttrs, *fsName, *compress)
+	}
+
+	for _, bad := range []string{"no-such-flag = 1", "just words", "config = other.conf"} {
+		if _, _, err := configArgs(writeConfig(t, "# bad", bad)); err == nil || !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("config of `%s': %v, want an error on line 2", bad, err)
+		}
+	}
+}
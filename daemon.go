@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// daemonEnv is set for the background copy of the program run by -daemon
+const daemonEnv = "XATTRFS_DAEMON"
+
+// daemonize runs this program again in a new session, for -daemon, and
+// exits with success once that reports the mount is up, or with failure
+// if it dies first; its errors go to our stderr until then.  In the
+// background copy daemonize just returns.
+func daemonize() error {
+	if os.Getenv(daemonEnv) != "" {
+		return nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	w.Close()
+	ok, _ := ioutil.ReadAll(r)
+	if string(ok) != "ok" {
+		os.Exit(1)
+	}
+	os.Exit(0)
+	return nil
+}
+
+// daemonReady tells the -daemon parent, if any, that the mount is up
+func daemonReady() {
+	if os.Getenv(daemonEnv) == "" {
+		return
+	}
+	f := os.NewFile(3, "daemon")
+	f.Write([]byte("ok"))
+	f.Close()
+}
+
+// writePidfile records our pid in filename, replacing a stale pidfile
+// but refusing if the pid in it is still running
+func writePidfile(filename string) error {
+	if b, err := ioutil.ReadFile(filename); err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err == nil && pid > 0 && syscall.Kill(pid, 0) != syscall.ESRCH {
+			return fmt.Errorf("already running as pid %d", pid)
+		}
+		infof("replacing stale pidfile `%s'", filename)
+	}
+	return ioutil.WriteFile(filename, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
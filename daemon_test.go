@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestPidfile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "pid")
+	want := strconv.Itoa(os.Getpid()) + "\n"
+	// a process that is gone leaves a stale pid behind
+	dead := exec.Command("true")
+	if err := dead.Run(); err != nil {
+		t.Skipf("cannot run true: %v", err)
+	}
+	for _, old := range []string{"", "garbage\n", strconv.Itoa(dead.Process.Pid) + "\n"} {
+		os.Remove(filename)
+		if old != "" {
+			if err := ioutil.WriteFile(filename, []byte(old), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writePidfile(filename); err != nil {
+			t.Fatalf("write over `%q': %v", old, err)
+		}
+		if b, err := ioutil.ReadFile(filename); err != nil || string(b) != want {
+			t.Fatalf("pidfile written over `%q' = `%q', %v, want `%q'", old, b, err, want)
+		}
+	}
+	// this process is running, so the pidfile it wrote is live
+	if err := writePidfile(filename); err == nil {
+		t.Fatal("replaced the pidfile of a running process")
+	}
+}
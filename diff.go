@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/boltdb/bolt"
+)
+
+// loadAttrs reads the database at filename into path -> attr -> value,
+// following the -inode-keys index where there is one
+func loadAttrs(filename string) (map[string]map[string][]byte, error) {
+	src, err := openFlatDb(filename, true)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	files := map[string]map[string][]byte{}
+	load := func(name string, b *bolt.Bucket) error {
+		attrs := map[string][]byte{}
+		err := b.ForEach(func(k, v []byte) error {
+			if v == nil || reserved(string(k)) {
+				return nil
+			}
+			v, err := getValue(b, string(k))
+			if err == nil {
+				v, err = decodeValue(v)
+			}
+			if err != nil {
+				return fmt.Errorf("`%s' attr `%s': %v", name, k, err)
+			}
+			attrs[listName(b, k)] = clone(v)
+			return nil
+		})
+		files[name] = attrs
+		return err
+	}
+	err = src.View(func(tx *bolt.Tx) error {
+		err := tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if reserved(string(name)) {
+				return nil
+			}
+			return load(keyPath(string(name)), b)
+		})
+		if err != nil {
+			return err
+		}
+		idx := tx.Bucket([]byte(pathIndex))
+		if idx == nil {
+			return nil
+		}
+		return idx.ForEach(func(k, v []byte) error {
+			if b := tx.Bucket(v); b != nil {
+				return load(keyPath(string(k)), b)
+			}
+			return nil
+		})
+	})
+	return files, err
+}
+
+// summarize returns v as printed by -diff: quoted if short text, else
+// its length and a hash
+func summarize(v []byte) string {
+	if len(v) <= 64 && utf8.Valid(v) && bytes.IndexFunc(v, func(r rune) bool { return r < ' ' }) < 0 {
+		return strconv.Quote(string(v))
+	}
+	return fmt.Sprintf("<%d bytes, sha256 %x>", len(v), sha256.Sum256(v))
+}
+
+// sortedKeys returns the keys of the maps, merged and sorted
+func sortedKeys(maps ...map[string][]byte) []string {
+	seen := map[string]bool{}
+	var keys []string
+	for _, m := range maps {
+		for k := range m {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// diffDb writes to w the xattrs added (+), removed (-), and changed (~)
+// going from database a to b, by path then attr, reporting whether
+// there were any
+func diffDb(a string, b string, w io.Writer) (bool, error) {
+	before, err := loadAttrs(a)
+	if err != nil {
+		return false, err
+	}
+	after, err := loadAttrs(b)
+	if err != nil {
+		return false, err
+	}
+	var paths []string
+	for p := range before {
+		paths = append(paths, p)
+	}
+	for p := range after {
+		if _, ok := before[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	differ := false
+	for _, p := range paths {
+		for _, attr := range sortedKeys(before[p], after[p]) {
+			old, wasSet := before[p][attr]
+			cur, isSet := after[p][attr]
+			switch {
+			case !wasSet:
+				fmt.Fprintf(w, "+ %s %s %s\n", strconv.Quote(p), attr, summarize(cur))
+			case !isSet:
+				fmt.Fprintf(w, "- %s %s %s\n", strconv.Quote(p), attr, summarize(old))
+			case !bytes.Equal(old, cur):
+				fmt.Fprintf(w, "~ %s %s %s -> %s\n", strconv.Quote(p), attr, summarize(old), summarize(cur))
+			default:
+				continue
+			}
+			differ = true
+		}
+	}
+	return differ, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	bin := strings.Repeat("\x00\xff", 40)
+	a := writeDb(t, true, files{
+		"f":    {"user.same": "1", "user.gone": "2", "user.changed": "3", "user.bin": bin},
+		"gone": {"user.a": "4"},
+	})
+	b := writeDb(t, true, files{
+		"f":       {"user.same": "1", "user.new": "5", "user.changed": "6", "user.bin": bin + "!"},
+		"new dir": {"user.a": "7"},
+	})
+	var out bytes.Buffer
+	differ, err := diffDb(a, b, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf(`~ "f" user.bin <80 bytes, sha256 %x> -> <81 bytes, sha256 %x>
+~ "f" user.changed "3" -> "6"
+- "f" user.gone "2"
++ "f" user.new "5"
+- "gone" user.a "4"
++ "new dir" user.a "7"
+`, sha256.Sum256([]byte(bin)), sha256.Sum256([]byte(bin+"!")))
+	if !differ || out.String() != want {
+		t.Fatalf("diff = %v\n%s\nwant\n%s", differ, out.String(), want)
+	}
+
+	out.Reset()
+	if differ, err := diffDb(a, a, &out); err != nil || differ || out.Len() != 0 {
+		t.Fatalf("diff of a database with itself = %v, %v, `%s'", differ, err, out.String())
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/patrickhaller/slog"
+)
+
+// opEvent describes one xattr operation, for metrics and -log-json
+type opEvent struct {
+	Op       string  `json:"op"`
+	Path     string  `json:"path"`
+	Attr     string  `json:"attr,omitempty"`
+	Status   string  `json:"status"`
+	Duration float64 `json:"duration_ms"`
+	start    time.Time
+}
+
+// eventLog is where -log-json writes events, one json object per line
+var eventLog = struct {
+	sync.Mutex
+	w io.Writer
+}{w: os.Stderr}
+
+// openEventLog points eventLog at filename, as -log-file names it, or at
+// stderr for STDERR, closing any file it had open; SIGHUP calls it again
+// to reopen the file after logrotate
+func openEventLog(filename string) error {
+	var w io.Writer = os.Stderr
+	if filename != "STDERR" {
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+	eventLog.Lock()
+	defer eventLog.Unlock()
+	if f, ok := eventLog.w.(*os.File); ok && f != os.Stderr {
+		f.Close()
+	}
+	eventLog.w = w
+	return nil
+}
+
+func newEvent(op string, path string, attr string) *opEvent {
+	return &opEvent{Op: op, Path: path, Attr: attr, start: time.Now()}
+}
+
+// done records the outcome of the operation; defer it
+func (e *opEvent) done(code fuse.Status) {
+	countOp(e.Op, code)
+	if !*logJSON {
+		slog.D("%s path `%s' attr `%s' status `%v'", e.Op, e.Path, e.Attr, code)
+		return
+	}
+	e.Status = code.String()
+	e.Duration = float64(time.Since(e.start)) / float64(time.Millisecond)
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	eventLog.Lock()
+	defer eventLog.Unlock()
+	eventLog.w.Write(append(line, '\n'))
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// readEvents returns the -log-json events written to filename
+func readEvents(t *testing.T, filename string) []opEvent {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []opEvent
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for dec.More() {
+		var e opEvent
+		if err := dec.Decode(&e); err != nil {
+			t.Fatalf("malformed event in %s: %v", data, err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestEventLogFile(t *testing.T) {
+	setFlag(t, "log-json", "true")
+	t.Cleanup(func() { openEventLog("STDERR") })
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "xattrfs.log")
+	if err := openEventLog(filename); err != nil {
+		t.Fatal(err)
+	}
+	newEvent("getxattr", "f", "user.a").done(fuse.ENOATTR)
+	// as logrotate does, before sending SIGHUP
+	rotated := filepath.Join(dir, "xattrfs.log.1")
+	if err := os.Rename(filename, rotated); err != nil {
+		t.Fatal(err)
+	}
+	if err := openEventLog(filename); err != nil {
+		t.Fatal(err)
+	}
+	newEvent("setxattr", "g", "user.b").done(fuse.OK)
+	if events := readEvents(t, rotated); len(events) != 1 || events[0].Op != "getxattr" || events[0].Path != "f" || events[0].Status != fuse.ENOATTR.String() {
+		t.Fatalf("rotated log has %+v, want the getxattr", events)
+	}
+	if events := readEvents(t, filename); len(events) != 1 || events[0].Op != "setxattr" || events[0].Attr != "user.b" {
+		t.Fatalf("reopened log has %+v, want the setxattr", events)
+	}
+}
+
+func TestEventOps(t *testing.T) {
+	setFlag(t, "log-json", "true")
+	t.Cleanup(func() { openEventLog("STDERR") })
+	filename := filepath.Join(t.TempDir(), "xattrfs.log")
+	if err := openEventLog(filename); err != nil {
+		t.Fatal(err)
+	}
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	x.SetXAttr("f", "user.a", []byte("1"), 0, nil)
+	x.GetXAttr("f", "user.a", nil)
+	x.ListXAttr("f", nil)
+	x.RemoveXAttr("f", "user.a", nil)
+	x.RemoveXAttr("f", "user.a", nil)
+	want := []opEvent{
+		{Op: "setxattr", Path: "f", Attr: "user.a", Status: fuse.OK.String()},
+		{Op: "getxattr", Path: "f", Attr: "user.a", Status: fuse.OK.String()},
+		{Op: "listxattr", Path: "f", Status: fuse.OK.String()},
+		{Op: "removexattr", Path: "f", Attr: "user.a", Status: fuse.OK.String()},
+		{Op: "removexattr", Path: "f", Attr: "user.a", Status: fuse.ENOATTR.String()},
+	}
+	events := readEvents(t, filename)
+	if len(events) != len(want) {
+		t.Fatalf("logged %+v, want %d events", events, len(want))
+	}
+	for i, e := range events {
+		if e.Op != want[i].Op || e.Path != want[i].Path || e.Attr != want[i].Attr || e.Status != want[i].Status {
+			t.Errorf("event %d = %+v, want %+v", i, e, want[i])
+		}
+	}
+}
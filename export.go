@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/boltdb/bolt"
+)
+
+// base64Prefix marks dump keys holding base64 encoded names, used for
+// names that are not valid UTF-8 or that happen to start with the prefix
+const base64Prefix = "base64:"
+
+func dumpKey(k []byte) string {
+	if utf8.Valid(k) && !bytes.HasPrefix(k, []byte(base64Prefix)) {
+		return string(k)
+	}
+	return base64Prefix + base64.StdEncoding.EncodeToString(k)
+}
+
+func undumpKey(k string) ([]byte, error) {
+	if strings.HasPrefix(k, base64Prefix) {
+		return base64.StdEncoding.DecodeString(k[len(base64Prefix):])
+	}
+	return []byte(k), nil
+}
+
+// dumpBucket returns the keys of b with their base64 values, and the
+// buckets nested in it, as -history buckets, as objects of the same
+func dumpBucket(b *bolt.Bucket) map[string]interface{} {
+	attrs := map[string]interface{}{}
+	b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			attrs[dumpKey(k)] = dumpBucket(b.Bucket(k))
+		} else {
+			attrs[dumpKey(k)] = v
+		}
+		return nil
+	})
+	return attrs
+}
+
+// exportDb writes the database at filename to w as a json object of
+// path -> {attr -> base64 value}, one path per line.  Values are dumped
+// raw, as stored: compressed, checksummed, or encrypted as they were,
+// beside the reserved keys of their expiry, order, case and chunks, and
+// with their history, so that a dump loads back exactly, but is only
+// readable with the -encrypt-key-file of the database.
+func exportDb(filename string, w io.Writer) error {
+	src, err := openFlatDb(filename, true)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	out := bufio.NewWriter(w)
+	sep := "{"
+	err = src.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			attrs := dumpBucket(b)
+			if string(name) == pathIndex {
+				attrs = map[string]interface{}{}
+				b.ForEach(func(k, v []byte) error {
+					attrs[dumpKey([]byte(keyPath(string(k))))] = v
+					return nil
+				})
+			}
+			if !reserved(string(name)) {
+				name = []byte(keyPath(string(name)))
+			}
+			key, err := json.Marshal(dumpKey(name))
+			if err != nil {
+				return err
+			}
+			val, err := json.Marshal(attrs)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "%s\n%s: %s", sep, key, val)
+			sep = ","
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if sep == "{" {
+		fmt.Fprint(out, sep)
+	}
+	fmt.Fprint(out, "\n}\n")
+	return out.Flush()
+}
+
+// importDb loads a dump written by exportDb into the database at
+// filename, in a single transaction; existing buckets named in the dump
+// are replaced, or when merge is set, have the dumped attrs added to them
+func importDb(filename string, r io.Reader, merge bool) error {
+	var dump map[string]map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&dump); err != nil {
+		return fmt.Errorf("malformed dump: %v", err)
+	}
+	buckets := map[string]map[string]json.RawMessage{}
+	for path, attrs := range dump {
+		name, err := undumpKey(path)
+		if err != nil {
+			return fmt.Errorf("malformed path `%s': %v", path, err)
+		}
+		bucket := map[string]json.RawMessage{}
+		for attr, v := range attrs {
+			if string(name) == pathIndex {
+				k, err := undumpKey(attr)
+				if err != nil {
+					return fmt.Errorf("malformed path `%s' in the index: %v", attr, err)
+				}
+				attr = dumpKey([]byte(pathKey(string(k))))
+			}
+			bucket[attr] = v
+		}
+		if !reserved(string(name)) {
+			name = []byte(pathKey(string(name)))
+		}
+		buckets[string(name)] = bucket
+	}
+
+	dst, err := openFlatDb(filename, false)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	return dst.Update(func(tx *bolt.Tx) error {
+		for name, attrs := range buckets {
+			if !merge {
+				if err := tx.DeleteBucket([]byte(name)); err != nil && err != bolt.ErrBucketNotFound {
+					return err
+				}
+			}
+			b, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return fmt.Errorf("bucket `%s': %v", name, err)
+			}
+			if err := loadBucket(b, attrs); err != nil {
+				return fmt.Errorf("bucket `%s' %v", name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// loadBucket puts the dumped attrs into b, replacing any nested buckets
+// of the same names
+func loadBucket(b *bolt.Bucket, attrs map[string]json.RawMessage) error {
+	for attr, raw := range attrs {
+		k, err := undumpKey(attr)
+		if err != nil {
+			return fmt.Errorf("attr `%s': %v", attr, err)
+		}
+		if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{")) {
+			var sub map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &sub); err != nil {
+				return fmt.Errorf("attr `%s': %v", attr, err)
+			}
+			if err := b.DeleteBucket(k); err != nil && err != bolt.ErrBucketNotFound {
+				return fmt.Errorf("attr `%s': %v", attr, err)
+			}
+			nb, err := b.CreateBucket(k)
+			if err != nil {
+				return fmt.Errorf("attr `%s': %v", attr, err)
+			}
+			if err := loadBucket(nb, sub); err != nil {
+				return err
+			}
+			continue
+		}
+		var v []byte
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return fmt.Errorf("attr `%s': malformed value: %v", attr, err)
+		}
+		if v == nil {
+			v = []byte{}
+		}
+		if err := b.Put(k, v); err != nil {
+			return fmt.Errorf("attr `%s': %v", attr, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestExportImport(t *testing.T) {
+	setFlag(t, "history", "2")
+	setFlag(t, "checksum", "true")
+	src := testDb(t)
+	s := boltStore{}
+	mustSet(t, s, "f", "user.a", "1")
+	mustSet(t, s, "f", "user.a", "2")
+	mustSet(t, s, "a\nb", "user.\xff", "x")
+	mustSet(t, s, "g", "user.big", string(bytes.Repeat([]byte("v"), chunkSize+1)))
+	s.SetExpiry("g", "user.big", time.Now().Add(time.Hour))
+	closeDb()
+
+	var dump bytes.Buffer
+	if err := exportDb(src, &dump); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(t.TempDir(), "imported.db")
+	if err := importDb(dst, bytes.NewReader(dump.Bytes()), false); err != nil {
+		t.Fatalf("import: %v, of\n%s", err, dump.Bytes())
+	}
+	d, err := openDb(dst, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = d
+	wantValue(t, s, "f", "user.a", "2")
+	wantValue(t, s, pathKey("a\nb"), "user.\xff", "x")
+	if values, code := s.History("f", "user.a"); code != fuse.OK || len(values) != 1 || string(values[0]) != "1" {
+		t.Fatalf("imported history = %q, %v, want [1]", values, code)
+	}
+	v, expires, code := s.Get("g", "user.big")
+	if code != fuse.OK || len(v) != chunkSize+1 || expires.IsZero() {
+		t.Fatalf("imported chunked value of %d bytes, %v, expiring at %v", len(v), code, expires)
+	}
+}
+
+func TestImportMalformed(t *testing.T) {
+	for _, dump := range []string{`[]`, `{"f": {"user.a": 1}}`, `{"f": {"user.a": "not base64!"}}`, `{"base64:!": {}}`} {
+		if err := importDb(filepath.Join(t.TempDir(), "x.db"), bytes.NewReader([]byte(dump)), false); err == nil {
+			t.Errorf("import of %s succeeded", dump)
+		}
+	}
+}
+
+func TestImportReplaceOrMerge(t *testing.T) {
+	dump := `{"f": {"user.b": "Mg=="}, "base64:Zw==": {"user.c": ""}}`
+	for _, merge := range []bool{false, true} {
+		filename := writeDb(t, true, files{"f": {"user.a": "1"}, "h": {"user.h": "h"}})
+		if err := importDb(filename, strings.NewReader(dump), merge); err != nil {
+			t.Fatal(err)
+		}
+		want := files{"f": {"user.b": "2"}, "g": {"user.c": ""}, "h": {"user.h": "h"}}
+		if merge {
+			want["f"]["user.a"] = "1"
+		}
+		if got := readDb(t, filename); !reflect.DeepEqual(got, want) {
+			t.Fatalf("import with merge %v = %q, want %q", merge, got, want)
+		}
+	}
+}
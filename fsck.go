@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// fsckDb writes to w the path of every bucket, or -inode-keys index entry,
+// in the database at filename that has no file under directory; if prune
+// is set those are deleted, along with inode buckets no path refers to
+func fsckDb(filename string, directory string, w io.Writer, prune bool) error {
+	dst, err := openFlatDb(filename, !prune)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	// bucket names are paths relative to the mount, as pathfs gives them,
+	// escaped by pathKey
+	gone := func(key string) (bool, error) {
+		_, err := os.Lstat(filepath.Join(directory, keyPath(key)))
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	var orphans, unindexed []string
+	err = dst.View(func(tx *bolt.Tx) error {
+		err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if reserved(string(name)) {
+				return nil
+			}
+			missing, err := gone(string(name))
+			if missing {
+				orphans = append(orphans, string(name))
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		idx := tx.Bucket([]byte(pathIndex))
+		if idx == nil {
+			return nil
+		}
+		return idx.ForEach(func(k, _ []byte) error {
+			missing, err := gone(string(k))
+			if missing {
+				unindexed = append(unindexed, string(k))
+			}
+			return err
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range append(orphans, unindexed...) {
+		fmt.Fprintln(w, keyPath(key))
+	}
+	if !prune || len(orphans)+len(unindexed) == 0 {
+		return nil
+	}
+	return dst.Update(func(tx *bolt.Tx) error {
+		for _, name := range orphans {
+			if err := tx.DeleteBucket([]byte(name)); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		idx := tx.Bucket([]byte(pathIndex))
+		if idx == nil {
+			return nil
+		}
+		for _, name := range unindexed {
+			if err := idx.Delete([]byte(name)); err != nil {
+				return err
+			}
+		}
+		live := map[string]bool{}
+		idx.ForEach(func(_, v []byte) error {
+			live[string(v)] = true
+			return nil
+		})
+		var dead []string
+		tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if strings.HasPrefix(string(name), inodePrefix) && !live[string(name)] {
+				dead = append(dead, string(name))
+			}
+			return nil
+		})
+		for _, name := range dead {
+			if err := tx.DeleteBucket([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFsck(t *testing.T) {
+	dir := t.TempDir()
+	touch(t, dir, "kept")
+	touch(t, dir, "a\nb")
+	filename := writeDb(t, true, files{
+		"kept": {"user.a": "1"},
+		"a\nb": {"user.a": "2"},
+		"gone": {"user.a": "3"},
+		"d/f":  {"user.a": "4"},
+	})
+	var out bytes.Buffer
+	if err := fsckDb(filename, dir, &out, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != "d/f\ngone\n" {
+		t.Fatalf("fsck listed `%s', want d/f and gone", got)
+	}
+	if got := readDb(t, filename); len(got) != 4 {
+		t.Fatalf("fsck without -prune left %q, want all four", got)
+	}
+	out.Reset()
+	if err := fsckDb(filename, dir, &out, true); err != nil {
+		t.Fatal(err)
+	}
+	want := files{"kept": {"user.a": "1"}, "a\nb": {"user.a": "2"}}
+	if got := readDb(t, filename); !reflect.DeepEqual(got, want) {
+		t.Fatalf("fsck -prune left %q, want %q", got, want)
+	}
+	if err := fsckDb(filepath.Join(dir, "none.db"), dir, &out, false); err == nil {
+		t.Fatalf("fsck of no database succeeded")
+	}
+}
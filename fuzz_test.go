@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// FuzzSetGet sets arbitrary attrs of arbitrary paths in each Store, and
+// checks that they read and list back as set, and are gone once removed
+func FuzzSetGet(f *testing.F) {
+	f.Add("f", "user.a", []byte("1"))
+	f.Add("", "user.root", []byte{})
+	f.Add("d/%41\n\x7f", "trusted.x y", []byte(valueMagic+"\x01not an envelope"))
+	f.Add("big", "user.big", bytes.Repeat([]byte("v"), chunkSize+1))
+	var ss []Store
+	for _, st := range stores {
+		ss = append(ss, st.open(f))
+	}
+	f.Fuzz(func(t *testing.T, name string, attr string, v []byte) {
+		if attr == "" || reserved(attr) || len(attr) > 255 || len(name) > 4096 || len(v) > 1<<20 {
+			t.Skip()
+		}
+		bucket := pathKey(name)
+		for _, s := range ss {
+			if err := s.Set(name, bucket, map[string][]byte{attr: v}); err != nil {
+				t.Fatalf("%T: set `%q' attr `%q': %v", s, name, attr, err)
+			}
+			got, _, code := s.Get(bucket, attr)
+			if code != fuse.OK || !bytes.Equal(got, v) {
+				t.Fatalf("%T: get `%q' attr `%q' = %d bytes, %v, want %d", s, name, attr, len(got), code, len(v))
+			}
+			names, code := s.List(bucket, attr)
+			if code != fuse.OK || len(names) == 0 || names[0] != attr {
+				t.Fatalf("%T: list `%q' from `%q' = %q, %v", s, name, attr, names, code)
+			}
+			if code := s.Remove(bucket, attr); code != fuse.OK {
+				t.Fatalf("%T: remove `%q' attr `%q': %v", s, name, attr, code)
+			}
+			if _, _, code := s.Get(bucket, attr); code != fuse.ENOATTR {
+				t.Fatalf("%T: get `%q' attr `%q' after remove: %v, want ENOATTR", s, name, attr, code)
+			}
+		}
+	})
+}
+
+// FuzzValue checks that decodeValue undoes encodeValue under every mix
+// of -compress, -checksum, and -encrypt-key-file
+func FuzzValue(f *testing.F) {
+	f.Add([]byte(""), true, true, true)
+	f.Add([]byte(valueMagic), false, false, false)
+	f.Add(bytes.Repeat([]byte("a"), compressMin), true, false, false)
+	f.Add([]byte("0123456789"), false, true, true)
+	block, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		f.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer func(s cipher.AEAD) { sealer = s }(sealer)
+	f.Fuzz(func(t *testing.T, v []byte, gz bool, sum bool, seal bool) {
+		*compress, *checksum, sealer = gz, sum, nil
+		defer func() { *compress, *checksum = false, false }()
+		if seal {
+			sealer = gcm
+		}
+		enc, err := encodeValue(v)
+		if err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		dec, err := decodeValue(enc)
+		if err != nil || !bytes.Equal(dec, v) {
+			t.Fatalf("decode(encode(%q)) = %q, %v", v, dec, err)
+		}
+	})
+}
+
+// FuzzPathKey checks that keyPath undoes pathKey, and that a directory's
+// key still prefixes those of the paths beneath it
+func FuzzPathKey(f *testing.F) {
+	f.Add("", "f")
+	f.Add("d", "%41")
+	f.Add("a\nb", "c\x7f%")
+	f.Fuzz(func(t *testing.T, dir string, name string) {
+		if strings.HasPrefix(dir, "/") || strings.HasPrefix(name, "/") {
+			t.Skip()
+		}
+		for _, p := range []string{dir, name} {
+			k := pathKey(p)
+			if k == "" || keyPath(k) != p {
+				t.Fatalf("keyPath(pathKey(%q)) = %q, by %q", p, keyPath(k), k)
+			}
+		}
+		if dir != "" && !strings.HasPrefix(pathKey(dir+"/"+name), pathKey(dir)+"/") {
+			t.Fatalf("key of %q does not start with that of %q", dir+"/"+name, dir)
+		}
+	})
+}
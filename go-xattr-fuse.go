@@ -1,10 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -16,36 +27,439 @@ import (
 
 type xattrFs struct {
 	pathfs.FileSystem
+	root  string
+	store Store
 }
 
 var db *bolt.DB
 
-func (x *xattrFs) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
-	slog.D("setxattr bucket `%s' name `%s'", name, attr)
-	tx, err := db.Begin(true)
-	if err != nil {
-		slog.P("database cannot begin transaction: `%v'", err)
-		return fuse.EBUSY
+// dbMu is held for reading by each filesystem request using db, and for
+// writing to close it, so closing waits for requests in flight, and those
+// after find db nil
+var dbMu sync.RWMutex
+
+// holdDb holds db open for the caller, who must releaseDb after, unless
+// it is closed already, when holdDb returns false
+func holdDb() bool {
+	dbMu.RLock()
+	if db == nil {
+		dbMu.RUnlock()
+		return false
 	}
-	defer tx.Rollback()
-	b, err := tx.CreateBucketIfNotExists([]byte(name))
-	if err != nil {
-		slog.P("failed to create bucket `%s'", name)
-		return fuse.EIO
+	return true
+}
+
+func releaseDb() {
+	dbMu.RUnlock()
+}
+
+// shutdown is the status of requests that find the database closed, as
+// they may while unmounting
+var shutdown = fuse.Status(syscall.ESHUTDOWN)
+
+// txStatus logs why a transaction could not begin, and returns the status
+// for that: shutdown once the database is closed, and EBUSY otherwise
+func txStatus(err error) fuse.Status {
+	if err == bolt.ErrDatabaseNotOpen {
+		slog.P("database is closed, as for unmounting")
+		return shutdown
 	}
-	b.Put([]byte(attr), data)
-	if err := tx.Commit(); err != nil {
-		slog.P("commit failed on `%s' attr `%s'", name, attr)
-		return fuse.EIO
+	slog.P("database cannot begin transaction: `%v'", err)
+	return fuse.EBUSY
+}
+
+// withOpTimeout returns the status of f, or EINTR if that takes longer
+// than -op-timeout.  A timed out f is left to finish in the background,
+// so its change may yet be made; bolt cannot abandon a transaction part
+// way, and most time is spent waiting to begin one, not in it.  f is a
+// whole op, holding the db itself, so that a change made late is still
+// recorded and mirrored like any other.
+func withOpTimeout(f func() fuse.Status) fuse.Status {
+	if *opTimeout <= 0 {
+		return f()
+	}
+	done := make(chan fuse.Status, 1)
+	go func() {
+		done <- f()
+	}()
+	t := time.NewTimer(*opTimeout)
+	defer t.Stop()
+	select {
+	case code := <-done:
+		return code
+	case <-t.C:
+		slog.P("giving up on a database change after -op-timeout %v", *opTimeout)
+		return fuse.Status(syscall.EINTR)
+	}
+}
+
+// closeDb closes db once requests in flight are done with it
+func closeDb() {
+	dbMu.Lock()
+	defer dbMu.Unlock()
+	if db != nil {
+		db.Close()
+		db = nil
+	}
+}
+
+// shutdownDb closes db, and then the -audit-log and -notify-socket; the
+// close waits out ops still holding the db, timed out ones included,
+// which may yet record their changes to those
+func shutdownDb() {
+	closeDb()
+	closeAudit()
+	closeNotify()
+}
+
+// set at build time with -ldflags "-X main.version=... -X main.commit=..."
+var (
+	version = "unknown"
+	commit  = "unknown"
+)
+
+var (
+	configFile      = flag.String("config", "", "read options from this file of NAME = VALUE lines, which the command line overrides")
+	showVersion     = flag.Bool("version", false, "print the version, and exit")
+	dbMode          = flag.String("db-mode", "0600", "permissions of the database file, in octal")
+	dbOwner         = flag.String("db-owner", "", "user, by name or id, to own the database file")
+	dbGroup         = flag.String("db-group", "", "group, by name or id, of the database file")
+	initialMmap     = flag.Int("initial-mmap", 0, "map this many bytes of the database up front, so a growing database need not be remapped")
+	mmapPopulate    = flag.Bool("mmap-populate", false, "read the whole database into memory on open")
+	opTimeout       = flag.Duration("op-timeout", 0, "fail an xattr change with EINTR if the database takes longer than this, 0 to wait for ever")
+	noSync          = flag.Bool("no-sync", false, "do not fsync the database after each change; faster, but a crash may lose or corrupt it")
+	dbTimeout       = flag.Duration("db-timeout", 5*time.Second, "how long to wait for a database locked by another process")
+	logJSON         = flag.Bool("log-json", false, "log each xattr operation as a json line, to -log-file")
+	logFile         = flag.String("log-file", "STDERR", "log to this file, reopening it on SIGHUP, or to STDERR")
+	logLevelArg     = flag.String("log-level", "info", "error, info, or debug; the DEBUG environment variable forces debug")
+	pidfile         = flag.String("pidfile", "", "write the pid to this file while mounted")
+	daemon          = flag.Bool("daemon", false, "go into the background once mounted")
+	lazyUnmount     = flag.Bool("lazy-unmount", false, "on signal, if the mountpoint stays busy, detach it lazily rather than stay mounted")
+	beginRetries    = flag.Int("begin-retries", 3, "times to retry starting a database transaction before giving up with EBUSY")
+	beginBackoff    = flag.Duration("begin-backoff", 10*time.Millisecond, "wait before the first such retry, doubling after each")
+	allowOther      = flag.Bool("allow-other", false, "let other users see the mount; needs user_allow_other in /etc/fuse.conf")
+	allowRoot       = flag.Bool("allow-root", false, "let root see the mount")
+	fsName          = flag.String("fs-name", "xattrfs", "filesystem name shown in the mount table")
+	caseless        = flag.Bool("case-insensitive", false, "treat xattr names that differ only in case after the namespace as the same")
+	maxAttrs        = flag.Int("max-attrs-per-file", 0, "most xattrs a file may have stored, 0 for no limit")
+	statfsMode      = flag.String("statfs-mode", "passthrough", "what df shows: passthrough, for the underlying filesystem, or db, for the database's use of -max-db-bytes")
+	maxDbBytes      = flag.Int64("max-db-bytes", 0, "refuse to set xattrs once the database file is this size, 0 for no limit")
+	auditLog        = flag.String("audit-log", "", "append a json line for every change to stored xattrs to this file")
+	notifySocket    = flag.String("notify-socket", "", "send a json line for every change to stored xattrs to clients of this unix socket")
+	onChange        = flag.String("on-change", "", "run this command, without a shell, after every change to stored xattrs; %p, %a, %v are path, attr, action")
+	onChangeTimeout = flag.Duration("on-change-timeout", 10*time.Second, "kill an -on-change command still running after this long")
+	preserveOrder   = flag.Bool("preserve-order", false, "list stored xattrs in the order they were first set, rather than sorted")
+	layoutName      = flag.String("layout", layoutFlat, "how to keep xattrs in the database: flat, a bucket per file, or namespaced, a bucket per namespace of buckets per file; a database is converted on mount")
+	backendName     = flag.String("backend", "loopback", "what to overlay: loopback, the files in DIRECTORY, or tmpfs, an empty scratch directory on the /dev/shm tmpfs, removed on unmount, ignoring DIRECTORY")
+	readOnly        = flag.Bool("ro", false, "mount read-only, xattrs included")
+	namespaces      = flag.String("namespaces", "user", "comma-separated xattr namespaces to keep in the database")
+	mirror          = flag.Bool("mirror", false, "also write stored xattrs to the underlying filesystem, if it supports them")
+	maxValue        = flag.Int("max-value-size", 65536, "largest xattr value accepted, in bytes")
+	compress        = flag.Bool("compress", false, "gzip large xattr values in the database")
+	checksum        = flag.Bool("checksum", false, "store values with a CRC32C, failing reads of any that no longer match with EIO")
+	metricsAddr     = flag.String("metrics-addr", "", "serve prometheus metrics at this address's /metrics")
+	healthAddr      = flag.String("health-addr", "", "serve 200 while mounted with a readable database, and 503 otherwise, at this address's /healthz")
+	backupAddr      = flag.String("backup-addr", "", "serve a consistent copy of the database at this address's /backup")
+	backupPath      = flag.String("backup-file", "", "on SIGUSR1, write a consistent copy of the database to this file")
+	httpAddr        = flag.String("http-addr", "", "serve stored xattrs read-only at this address's /xattr/PATH[/ATTR], to anyone, so best on localhost")
+	inodeKeys       = flag.Bool("inode-keys", false, "keep xattrs by inode rather than path, so they follow renames and hard links")
+	cacheSize       = flag.Int("cache-entries", 1024, "number of xattr values to cache in memory, 0 to disable")
+	negCacheTTL     = flag.Duration("negative-cache-ttl", time.Second, "how long to remember that an xattr is not set")
+	seedExisting    = flag.Bool("import-existing", false, "before mounting, store the xattrs files in DIRECTORY already have, for files with none stored")
+	inheritDefaults = flag.Bool("inherit-defaults", false, "set NS.default.ATTR of a directory as NS.ATTR on files created in it")
+	historyLen      = flag.Int("history", 0, "keep this many earlier values of each stored xattr, readable as ATTR.history")
+	ttls            = flag.Bool("ttl", false, "let setting ATTR.ttl to a number of seconds or a duration make ATTR expire that long from now")
+	ttlSweep        = flag.Duration("ttl-sweep", time.Minute, "how often to delete xattrs whose ttl has run out")
+	compactExit     = flag.Bool("compact-on-exit", false, "compact the database after unmounting")
+	keyFile         = flag.String("encrypt-key-file", "", "file holding a 32 byte key to encrypt xattr values with")
+	export          = flag.Bool("export", false, "dump DATABASE to stdout as json, and exit")
+	importDump      = flag.Bool("import", false, "load a json dump on stdin into DATABASE, and exit")
+	renameAttrs     = flag.Bool("rename-attr", false, "rename attr OLD to NEW on every file in DATABASE, and exit")
+	deleteAttrs     = flag.Bool("delete-attr", false, "remove attr NAME from every file in DATABASE, and exit")
+	replay          = flag.Bool("replay-audit", false, "apply the changes in AUDITLOG to DATABASE, and exit")
+	check           = flag.Bool("check", false, "read all of DATABASE, reporting any damage, and exit")
+	stats           = flag.Bool("stats", false, "print counts of what DATABASE holds, and exit")
+	statsJSON       = flag.Bool("json", false, "with -stats, print them as a json object")
+	diff            = flag.Bool("diff", false, "list xattrs added, removed, or changed from DATABASE to DATABASE2, and exit")
+	fsck            = flag.Bool("fsck", false, "list xattrs in DATABASE whose file is gone from DIRECTORY, and exit")
+	prune           = flag.Bool("prune", false, "with -fsck, also delete those xattrs")
+	merge           = flag.Bool("merge", false, "merge the xattrs of the INPUT databases into DATABASE, and exit; with -import, add to existing files' xattrs rather than replacing them")
+	conflict        = flag.String("conflict", lastWins, "with -merge, what to do about an xattr set differently in two inputs, and with -rename-attr about a file with NEW set: last-wins, first-wins, or error")
+)
+
+// persistedNamespaces is -namespaces as parsed by main, and
+// namespaceList the same in order
+var (
+	persistedNamespaces = map[string]bool{}
+	namespaceList       []string
+)
+
+// Setting one of these pseudo attributes on a file performs an action,
+// rather than storing a value
+const (
+	clearAttr    = "user.xattrfuse.clear"    // drop all of the file's stored xattrs
+	copyFromAttr = "user.xattrfuse.copyfrom" // replace them with a copy of those of the path in the value
+	batchAttr    = "user.xattrfuse.batch"    // set all the attrs in the value, a json object of attr -> string, or none
+)
+
+// pseudo reports whether attr is one that performs an action, or reads
+// or sets something other than a stored value
+func pseudo(attr string) bool {
+	_, ttl := ttlBase(attr)
+	_, history := historyBase(attr)
+	return attr == clearAttr || attr == copyFromAttr || attr == batchAttr || ttl || history
+}
+
+// mountPath turns a path given relative to the mountpoint into a name
+// as pathfs would give it
+func mountPath(p string) string {
+	return strings.Trim(filepath.Clean("/"+p), "/")
+}
+
+// maxNameLen is the longest xattr name linux accepts
+const maxNameLen = 255
+
+// validName reports whether attr can be an xattr name at all, which as
+// a C string must be non-empty and free of NUL
+func validName(attr string) bool {
+	return attr != "" && strings.IndexByte(attr, 0) < 0
+}
+
+// persisted reports whether attr is kept in the database; attributes in
+// other namespaces are passed through to the underlying filesystem
+func persisted(attr string) bool {
+	if kernelAttr(attr) {
+		return false
+	}
+	return persistedNamespaces[strings.SplitN(attr, ".", 2)[0]]
+}
+
+// kernelAttr reports whether attr is one the kernel acts on from the
+// underlying inode: the POSIX ACLs, file capabilities, and IMA and EVM
+// signatures.  They are always passed through, even with system or
+// security in -namespaces.
+func kernelAttr(attr string) bool {
+	switch attr {
+	case "system.posix_acl_access", "system.posix_acl_default",
+		"security.capability", "security.ima", "security.evm":
+		return true
+	}
+	return false
+}
+
+// symlink reports whether name is a symlink.  Its stored xattrs are its
+// own, in a bucket of its own path, but the underlying filesystem's
+// xattr calls follow links, so those of its target must not show through.
+func (x *xattrFs) symlink(name string) bool {
+	a, code := x.FileSystem.GetAttr(name, nil)
+	return code == fuse.OK && a.IsSymlink()
+}
+
+var (
+	errTooManyAttrs = errors.New("too many xattrs on file")
+	errDbFull       = errors.New("database is at -max-db-bytes")
+)
+
+// countAttrs returns the number of attrs stored in b
+func countAttrs(b *bolt.Bucket) int {
+	n := 0
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		if !reserved(string(k)) {
+			n++
+		}
+	}
+	return n
+}
+
+// mayModify reports whether the caller may change the xattrs of name,
+// which only its owner and root may
+func (x *xattrFs) mayModify(name string, context *fuse.Context) fuse.Status {
+	if context == nil || context.Uid == 0 {
+		return fuse.OK
+	}
+	a, code := x.FileSystem.GetAttr(name, context)
+	if code != fuse.OK {
+		return code
+	}
+	if a.Uid != context.Uid {
+		return fuse.EPERM
+	}
+	return fuse.OK
+}
+
+func (x *xattrFs) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) (code fuse.Status) {
+	ev := newEvent("setxattr", name, attr)
+	defer func() { ev.done(code) }()
+	return withOpTimeout(func() fuse.Status {
+		return x.setXAttr(name, attr, data, flags, context)
+	})
+}
+
+func (x *xattrFs) setXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) (code fuse.Status) {
+	if !holdDb() {
+		return shutdown
+	}
+	defer releaseDb()
+	if !validName(attr) {
+		return fuse.EINVAL
+	}
+	if *readOnly {
+		return fuse.EROFS
+	}
+	if code = x.mayModify(name, context); code != fuse.OK {
+		return code
+	}
+	if attr == clearAttr {
+		var bucket string
+		if bucket, code = x.bucketName(name); code != fuse.OK {
+			return code
+		}
+		defer func() { changedOK(code, context, actionClear, name, "", nil) }()
+		return x.store.Delete(bucket)
+	}
+	if attr == copyFromAttr {
+		var src, dst string
+		if src, code = x.bucketName(mountPath(string(data))); code != fuse.OK {
+			return code
+		}
+		if dst, code = x.bucketName(name); code != fuse.OK {
+			return code
+		}
+		defer func() { changedOK(code, context, actionCopy, name, "", []byte(mountPath(string(data)))) }()
+		return x.store.Copy(src, dst)
+	}
+	if _, ok := historyBase(attr); ok {
+		return fuse.EINVAL
+	}
+	if base, ok := ttlBase(attr); ok {
+		d, ok := parseTTL(data)
+		if !ok {
+			return fuse.EINVAL
+		}
+		var bucket string
+		if bucket, code = x.bucketName(name); code != fuse.OK {
+			return code
+		}
+		var expires time.Time
+		if d > 0 {
+			expires = time.Now().Add(d)
+		}
+		defer func() { changedOK(code, context, actionTTL, name, base, data) }()
+		return x.store.SetExpiry(bucket, attrKey(base), expires)
+	}
+	if !persisted(attr) {
+		if x.symlink(name) {
+			return fuse.EPERM
+		}
+		return x.FileSystem.SetXAttr(name, attr, data, flags, context)
+	}
+	attrs := map[string][]byte{attr: data}
+	if attr == batchAttr {
+		var batch map[string]string
+		if err := json.Unmarshal(data, &batch); err != nil || len(batch) == 0 {
+			return fuse.EINVAL
+		}
+		attrs = map[string][]byte{}
+		for a, v := range batch {
+			if !validName(a) || !persisted(a) || pseudo(a) {
+				return fuse.EINVAL
+			}
+			attrs[a] = []byte(v)
+		}
+	}
+	if code = x.setAttrs(name, attrs); code != fuse.OK {
+		return code
+	}
+	for attr, data := range attrs {
+		changed(context, actionSet, name, attr, data)
+		if *mirror && !x.symlink(name) {
+			if code := x.FileSystem.SetXAttr(name, attr, data, flags, context); code != fuse.OK {
+				slog.P("mirror setxattr failed on `%s' attr `%s': %v", name, attr, code)
+			}
+		}
 	}
 	return fuse.OK
 }
 
-func boltBucket(name string) (*bolt.Tx, *bolt.Bucket, *bolt.Cursor, fuse.Status) {
-	tx, err := db.Begin(true)
+// setAttrs stores attrs for name, all in one transaction, so that either
+// all are set or none
+func (x *xattrFs) setAttrs(name string, attrs map[string][]byte) fuse.Status {
+	for attr, data := range attrs {
+		if len(attr) > maxNameLen {
+			return fuse.ERANGE
+		}
+		if len(data) > *maxValue {
+			return fuse.Status(syscall.E2BIG)
+		}
+	}
+	bucket, code := x.bucketName(name)
+	if code != fuse.OK {
+		return code
+	}
+	for attr := range attrs {
+		defer cache.forget(bucket, attrKey(attr))
+	}
+	err := x.store.Set(name, bucket, attrs)
+	if err == nil {
+		return fuse.OK
+	}
+	if err == bolt.ErrIncompatibleValue {
+		// a value where a bucket is, or the other way around, so the
+		// name is taken by the database's own structure
+		slog.P("setxattr on `%s' refused: an attr name collides with the database's own structure", name)
+		return fuse.EINVAL
+	}
+	if err == bolt.ErrDatabaseNotOpen {
+		return shutdown
+	}
+	slog.P("setxattr failed on `%s': `%v'", name, err)
+	if err == bolt.ErrValueTooLarge {
+		return fuse.Status(syscall.E2BIG)
+	}
+	if err == errTooManyAttrs || err == errDbFull {
+		return fuse.Status(syscall.ENOSPC)
+	}
+	return fuse.EIO
+}
+
+// clone copies a key or value out of bolt's mmap, which is only valid
+// for the life of the transaction that returned it
+func clone(v []byte) []byte {
+	return append([]byte{}, v...)
+}
+
+// beginDeadline bounds how long beginTx keeps retrying, so a FUSE request
+// is never held up for long
+const beginDeadline = time.Second
+
+// dbBegin begins a transaction on db, which tests replace to fail it
+var dbBegin = func(writable bool) (*bolt.Tx, error) {
+	return db.Begin(writable)
+}
+
+// beginTx begins a transaction, retrying a failure up to -begin-retries
+// times with doubling backoff
+func beginTx(writable bool) (*bolt.Tx, error) {
+	deadline := time.Now().Add(beginDeadline)
+	backoff := *beginBackoff
+	for i := 0; ; i++ {
+		tx, err := dbBegin(writable)
+		if err == nil || err == bolt.ErrDatabaseNotOpen || i >= *beginRetries || time.Now().Add(backoff).After(deadline) {
+			return tx, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// boltBucket begins a transaction and looks up the bucket for name;
+// only pass writable when the caller intends to modify the bucket,
+// as writable transactions serialize on the bolt write lock
+func boltBucket(name string, writable bool) (*bolt.Tx, *bolt.Bucket, *bolt.Cursor, fuse.Status) {
+	tx, err := beginTx(writable)
 	if err != nil {
-		slog.P("database cannot begin transaction: `%v'", err)
-		return nil, nil, nil, fuse.EBUSY
+		return nil, nil, nil, txStatus(err)
 	}
 	b := tx.Bucket([]byte(name))
 	if b == nil {
@@ -54,46 +468,394 @@ func boltBucket(name string) (*bolt.Tx, *bolt.Bucket, *bolt.Cursor, fuse.Status)
 	return tx, b, b.Cursor(), fuse.OK
 }
 
-func (x *xattrFs) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
-	slog.D("getxattr bucket `%s' name `%s'", name, attr)
-	tx, _, c, err := boltBucket(name)
+// GetXAttr returns the whole value of attr on name; go-fuse answers the
+// kernel's size probes, getxattr with an empty buffer, from its length, so
+// probes for a value are as cheap as reads of it, which the cache serves
+func (x *xattrFs) GetXAttr(name string, attr string, context *fuse.Context) (data []byte, code fuse.Status) {
+	ev := newEvent("getxattr", name, attr)
+	defer func() { ev.done(code) }()
+	if !holdDb() {
+		return nil, shutdown
+	}
+	defer releaseDb()
+	if !validName(attr) {
+		return nil, fuse.EINVAL
+	}
+	if base, ok := ttlBase(attr); ok {
+		var bucket string
+		if bucket, code = x.bucketName(name); code != fuse.OK {
+			return nil, code
+		}
+		_, expires, code := x.store.Get(bucket, attrKey(base))
+		if code != fuse.OK {
+			return nil, code
+		}
+		if expires.IsZero() {
+			return nil, fuse.ENOATTR
+		}
+		return ttlLeft(expires), fuse.OK
+	}
+	if base, ok := historyBase(attr); ok {
+		var bucket string
+		if bucket, code = x.bucketName(name); code != fuse.OK {
+			return nil, code
+		}
+		values, code := x.store.History(bucket, attrKey(base))
+		if code != fuse.OK {
+			return nil, code
+		}
+		out, err := json.Marshal(values)
+		if err != nil {
+			return nil, fuse.EIO
+		}
+		return out, fuse.OK
+	}
+	if !persisted(attr) {
+		if x.symlink(name) {
+			return nil, fuse.ENOATTR
+		}
+		return x.FileSystem.GetXAttr(name, attr, context)
+	}
+	bucket, code := x.bucketName(name)
+	if code != fuse.OK {
+		return nil, code
+	}
+	key := attrKey(attr)
+	v, ok, gen := cache.get(bucket, key)
+	if !ok {
+		var expires time.Time
+		v, expires, code = x.store.Get(bucket, key)
+		if (code == fuse.OK && expires.IsZero()) || code == fuse.ENOATTR {
+			cache.put(bucket, key, v, gen)
+		}
+	} else if v == nil {
+		code = fuse.ENOATTR
+	}
+	if code == fuse.ENOATTR && *mirror && !x.symlink(name) {
+		return x.FileSystem.GetXAttr(name, attr, context)
+	}
+	return v, code
+}
+
+// boltGet returns a copy of the stored value of attr on name, and when
+// it expires, if ever
+func boltGet(name string, attr string) ([]byte, time.Time, fuse.Status) {
+	defer observeTx(time.Now())
+	tx, b, _, code := boltBucket(name, false)
+	if tx == nil {
+		return nil, time.Time{}, code
+	}
+	defer tx.Rollback()
+	if code == fuse.ENOENT {
+		return nil, time.Time{}, fuse.ENOATTR
+	}
+	if code != fuse.OK {
+		return nil, time.Time{}, code
+	}
+	return readValue(b, name, attr)
+}
+
+// readValue returns a copy of the value of attr in b, the bucket of name,
+// and when it expires, if ever
+func readValue(b *bolt.Bucket, name string, attr string) ([]byte, time.Time, fuse.Status) {
+	t := expiry(b, attr)
+	if expired(b, attr) {
+		return nil, time.Time{}, fuse.ENOATTR
+	}
+	raw := b.Get([]byte(attr))
+	v, err := getValue(b, attr)
+	if err != nil {
+		slog.P("failed to read `%s' attr `%s': `%v'", name, attr, err)
+		return nil, time.Time{}, fuse.EIO
+	}
+	if v == nil {
+		return nil, time.Time{}, fuse.ENOATTR
+	}
+	v, err = decodeValue(v)
+	if err != nil {
+		slog.P("failed to decode `%s' attr `%s': `%v'", name, attr, err)
+		return nil, time.Time{}, fuse.EIO
+	}
+	// chunked, compressed and encrypted values were already copied out of
+	// the mmap while decoding them; only a value read in place needs to be
+	if sameTail(v, raw) {
+		v = clone(v)
+	}
+	return v, t, fuse.OK
+}
+
+// sameTail reports whether a and b end in the same byte of memory, as a
+// value does the stored bytes it was decoded from in place
+func sameTail(a []byte, b []byte) bool {
+	return len(a) > 0 && len(b) > 0 && &a[len(a)-1] == &b[len(b)-1]
+}
+
+// boltHas reports whether attr is stored for name, as fuse.OK or ENOATTR
+func boltHas(name string, attr string) fuse.Status {
+	tx, b, _, code := boltBucket(name, false)
+	if tx == nil {
+		return code
+	}
 	defer tx.Rollback()
-	if err != fuse.OK {
-		return nil, err
+	if code == fuse.ENOENT || b.Get([]byte(attr)) == nil || expired(b, attr) {
+		return fuse.ENOATTR
+	}
+	return code
+}
+
+func (x *xattrFs) ListXAttr(name string, context *fuse.Context) (attrs []string, code fuse.Status) {
+	ev := newEvent("listxattr", name, "")
+	defer func() { ev.done(code) }()
+	if !holdDb() {
+		return nil, shutdown
+	}
+	defer releaseDb()
+	// the underlying names first, then the stored ones, each only once;
+	// an underlying filesystem that cannot list, say with ENOTSUP, just
+	// adds none
+	lis := []string{}
+	seen := map[string]bool{}
+	add := func(attr string) {
+		if !seen[attr] {
+			seen[attr] = true
+			lis = append(lis, attr)
+		}
+	}
+	if under, code := x.FileSystem.ListXAttr(name, context); code == fuse.OK && !x.symlink(name) {
+		for _, attr := range under {
+			if !persisted(attr) {
+				add(attr)
+			}
+		}
+	}
+	bucket, code := x.bucketName(name)
+	if code != fuse.OK {
+		return nil, code
+	}
+	// only the kept namespaces, skipping any left from other -namespaces
+	for _, ns := range namespaceList {
+		stored, code := x.store.List(bucket, ns+".")
+		if code != fuse.OK {
+			return nil, code
+		}
+		for _, attr := range stored {
+			add(attr)
+		}
+	}
+	slog.D("listxattr path `%s' returns `%v'", name, lis)
+	return lis, fuse.OK
+}
+
+func (x *xattrFs) RemoveXAttr(name string, attr string, context *fuse.Context) (code fuse.Status) {
+	ev := newEvent("removexattr", name, attr)
+	defer func() { ev.done(code) }()
+	return withOpTimeout(func() fuse.Status {
+		return x.removeXAttr(name, attr, context)
+	})
+}
+
+func (x *xattrFs) removeXAttr(name string, attr string, context *fuse.Context) (code fuse.Status) {
+	if !holdDb() {
+		return shutdown
+	}
+	defer releaseDb()
+	if !validName(attr) {
+		return fuse.EINVAL
+	}
+	if *readOnly {
+		return fuse.EROFS
+	}
+	if code = x.mayModify(name, context); code != fuse.OK {
+		return code
+	}
+	if !persisted(attr) {
+		if x.symlink(name) {
+			return fuse.ENOATTR
+		}
+		return x.FileSystem.RemoveXAttr(name, attr, context)
+	}
+	bucket, code := x.bucketName(name)
+	if code != fuse.OK {
+		return code
+	}
+	key := attrKey(attr)
+	code = x.store.Remove(bucket, key)
+	cache.forget(bucket, key)
+	if code != fuse.OK {
+		return code
+	}
+	changed(context, actionRemove, name, attr, nil)
+	if *mirror && !x.symlink(name) {
+		if code := x.FileSystem.RemoveXAttr(name, attr, context); code != fuse.OK && code != fuse.ENOATTR {
+			slog.P("mirror removexattr failed on `%s' attr `%s': %v", name, attr, code)
+		}
+	}
+	return fuse.OK
+}
+
+// bucketParent holds buckets: a transaction the top-level ones, and a
+// bucket those nested in it
+type bucketParent interface {
+	Bucket(name []byte) *bolt.Bucket
+	CreateBucket(name []byte) (*bolt.Bucket, error)
+	DeleteBucket(name []byte) error
+	Cursor() *bolt.Cursor
+}
+
+// copyBucket replaces the bucket dst with a copy of src, nested -history
+// buckets and all, reporting false if there is no src bucket
+func copyBucket(tx bucketParent, src string, dst string) (bool, error) {
+	old := tx.Bucket([]byte(src))
+	if old == nil {
+		return false, nil
+	}
+	if err := tx.DeleteBucket([]byte(dst)); err != nil && err != bolt.ErrBucketNotFound {
+		return true, err
+	}
+	b, err := tx.CreateBucket([]byte(dst))
+	if err != nil {
+		return true, err
+	}
+	return true, cloneBucket(b, old)
+}
+
+// cloneBucket copies the keys and nested buckets of src into dst
+func cloneBucket(dst *bolt.Bucket, src *bolt.Bucket) error {
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(clone(k), clone(v))
+		}
+		sub, err := dst.CreateBucket(clone(k))
+		if err != nil {
+			return err
+		}
+		return cloneBucket(sub, src.Bucket(k))
+	})
+}
+
+// moveBucket renames the bucket src to dst, reporting false if there is
+// no src bucket
+func moveBucket(tx bucketParent, src string, dst string) (bool, error) {
+	found, err := copyBucket(tx, src, dst)
+	if !found || err != nil {
+		return found, err
+	}
+	return true, tx.DeleteBucket([]byte(src))
+}
+
+// deleteTree drops the bucket for name, and those of everything beneath
+// it, reporting whether there were any
+func deleteTree(tx bucketParent, name string) (bool, error) {
+	names := []string{}
+	if tx.Bucket([]byte(name)) != nil {
+		names = append(names, name)
+	}
+	prefix := []byte(name + "/")
+	c := tx.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		names = append(names, string(k))
+	}
+	for _, n := range names {
+		if err := tx.DeleteBucket([]byte(n)); err != nil {
+			return true, err
+		}
+	}
+	return len(names) > 0, nil
+}
+
+// renameTree moves the bucket oldName in p to newName; when a directory
+// is renamed the buckets of everything beneath it are moved as well.  As
+// a rename replaces any file at newName, its buckets are dropped first,
+// so that newName has only the xattrs oldName had.  It reports whether
+// there was anything to change.
+func renameTree(p bucketParent, oldName string, newName string) (bool, error) {
+	replaced, err := deleteTree(p, newName)
+	if err != nil {
+		return false, err
+	}
+	found, err := moveBucket(p, oldName, newName)
+	if err != nil {
+		return false, err
+	}
+	prefix := []byte(oldName + "/")
+	var children []string
+	c := p.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		children = append(children, string(k))
 	}
-	for k, v := c.First(); k != nil; k, v = c.Next() {
-		if string(k) == attr {
-			return v, fuse.OK
+	for _, child := range children {
+		if _, err := moveBucket(p, child, newName+"/"+child[len(prefix):]); err != nil {
+			return false, err
 		}
 	}
-	return nil, fuse.OK
+	return replaced || found || len(children) > 0, nil
 }
 
-func (x *xattrFs) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
-	slog.D("listxattr bucket `%s'", name)
-	tx, _, c, err := boltBucket(name)
+// boltRename moves the buckets of oldName to newName, as renameTree does
+func boltRename(oldName string, newName string) fuse.Status {
+	defer cache.forgetTree(oldName)
+	defer cache.forgetTree(newName)
+	tx, err := beginTx(true)
+	if err != nil {
+		return txStatus(err)
+	}
 	defer tx.Rollback()
-	if err != fuse.OK {
-		return nil, err
+	changed, err := renameTree(tx, oldName, newName)
+	if err != nil {
+		slog.P("failed to move buckets of `%s' to `%s': `%v'", oldName, newName, err)
+		return fuse.EIO
 	}
-	lis := make([]string, 1)
-	for k, _ := c.First(); k != nil; k, _ = c.Next() {
-		lis = append(lis, string(k))
+	if !changed {
+		return fuse.OK
 	}
-	slog.D("listxattr returns `%v'", lis)
-	return lis[1:], fuse.OK
+	if err := tx.Commit(); err != nil {
+		slog.P("commit failed on rename `%s' -> `%s': `%v'", oldName, newName, err)
+		return fuse.EIO
+	}
+	return fuse.OK
 }
 
-func (x *xattrFs) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
-	slog.D("setxattr bucket `%s' name `%s'", name, attr)
-	tx, b, _, err := boltBucket(name)
+// boltCopy replaces the bucket for newName with a copy of that of
+// oldName; a missing oldName bucket is not an error
+func boltCopy(oldName string, newName string) fuse.Status {
+	defer cache.forgetTree(newName)
+	tx, err := beginTx(true)
+	if err != nil {
+		return txStatus(err)
+	}
+	defer tx.Rollback()
+	found, err := copyBucket(tx, oldName, newName)
+	if err != nil {
+		slog.P("failed to copy bucket `%s' to `%s': `%v'", oldName, newName, err)
+		return fuse.EIO
+	}
+	if !found {
+		return fuse.OK
+	}
+	if err := tx.Commit(); err != nil {
+		slog.P("commit failed on copy `%s' -> `%s': `%v'", oldName, newName, err)
+		return fuse.EIO
+	}
+	return fuse.OK
+}
+
+// boltDelete drops the bucket for name, if there is one
+func boltDelete(name string) fuse.Status {
+	defer cache.forgetTree(name)
+	tx, err := beginTx(true)
+	if err != nil {
+		return txStatus(err)
+	}
 	defer tx.Rollback()
-	if err != fuse.OK {
-		return err
+	if err := tx.DeleteBucket([]byte(name)); err != nil {
+		if err == bolt.ErrBucketNotFound {
+			return fuse.OK
+		}
+		slog.P("failed to delete bucket `%s': `%v'", name, err)
+		return fuse.EIO
 	}
-	_ = b.Delete([]byte(attr))
 	if err := tx.Commit(); err != nil {
-		slog.P("commit failed on `%s' attr `%s'", name, attr)
+		slog.P("commit failed on delete `%s': `%v'", name, err)
 		return fuse.EIO
 	}
 	return fuse.OK
@@ -109,24 +871,54 @@ func (x *xattrFs) Readlink(name string, context *fuse.Context) (string, fuse.Sta
 	return x.FileSystem.Readlink(name, context)
 }
 
-func (x *xattrFs) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+func (x *xattrFs) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) (code fuse.Status) {
 	slog.D(name)
-	return x.FileSystem.Mknod(name, mode, dev, context)
+	if code = x.FileSystem.Mknod(name, mode, dev, context); code == fuse.OK && *inheritDefaults {
+		x.inherit(name, false, context)
+	}
+	return code
 }
 
-func (x *xattrFs) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+func (x *xattrFs) Mkdir(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
 	slog.D(name)
-	return x.FileSystem.Mkdir(name, mode, context)
+	if code = x.FileSystem.Mkdir(name, mode, context); code == fuse.OK && *inheritDefaults {
+		x.inherit(name, true, context)
+	}
+	return code
 }
 
 func (x *xattrFs) Unlink(name string, context *fuse.Context) (code fuse.Status) {
 	slog.D(name)
-	return x.FileSystem.Unlink(name, context)
+	st, _ := x.lstat(name)
+	if code = x.FileSystem.Unlink(name, context); code != fuse.OK {
+		return code
+	}
+	if !holdDb() {
+		return shutdown
+	}
+	defer releaseDb()
+	defer func() { changedOK(code, context, actionDelete, name, "", nil) }()
+	if *inodeKeys {
+		return x.store.Unindex(name, lastLink(st))
+	}
+	return x.store.Delete(pathKey(name))
 }
 
 func (x *xattrFs) Rmdir(name string, context *fuse.Context) (code fuse.Status) {
 	slog.D(name)
-	return x.FileSystem.Rmdir(name, context)
+	st, _ := x.lstat(name)
+	if code = x.FileSystem.Rmdir(name, context); code != fuse.OK {
+		return code
+	}
+	if !holdDb() {
+		return shutdown
+	}
+	defer releaseDb()
+	defer func() { changedOK(code, context, actionDelete, name, "", nil) }()
+	if *inodeKeys {
+		return x.store.Unindex(name, lastLink(st))
+	}
+	return x.store.Delete(pathKey(name))
 }
 
 func (x *xattrFs) Symlink(value string, linkName string, context *fuse.Context) (code fuse.Status) {
@@ -134,14 +926,52 @@ func (x *xattrFs) Symlink(value string, linkName string, context *fuse.Context)
 	return x.FileSystem.Symlink(value, linkName, context)
 }
 
+// Rename moves the stored xattrs of oldName to newName, dropping those of
+// any file it replaces.  Those passed through, and -mirror's copies, live
+// on the underlying inode, so the underlying rename moves them, once.
 func (x *xattrFs) Rename(oldName string, newName string, context *fuse.Context) (code fuse.Status) {
 	slog.D("%s -> %s", oldName, newName)
-	return x.FileSystem.Rename(oldName, newName, context)
+	oldSt, _ := x.lstat(oldName)
+	newSt, _ := x.lstat(newName)
+	if code = x.FileSystem.Rename(oldName, newName, context); code != fuse.OK {
+		return code
+	}
+	// renaming a link onto another of the same file changes nothing
+	if oldSt != nil && newSt != nil && oldSt.Dev == newSt.Dev && oldSt.Ino == newSt.Ino {
+		return fuse.OK
+	}
+	if !holdDb() {
+		return shutdown
+	}
+	defer releaseDb()
+	defer func() { changedOK(code, context, actionRename, oldName, "", []byte(newName)) }()
+	if *inodeKeys {
+		if newSt != nil {
+			if code = x.store.Unindex(newName, lastLink(newSt)); code != fuse.OK {
+				return code
+			}
+		}
+		return x.store.Reindex(oldName, newName)
+	}
+	return x.store.Rename(pathKey(oldName), pathKey(newName))
 }
 
+// Link gives the new name a copy of the existing xattrs; unless buckets
+// are keyed by inode, later changes on one link are not seen by the other
 func (x *xattrFs) Link(oldName string, newName string, context *fuse.Context) (code fuse.Status) {
 	slog.D("%s -> %s", oldName, newName)
-	return x.FileSystem.Link(oldName, newName, context)
+	if code = x.FileSystem.Link(oldName, newName, context); code != fuse.OK {
+		return code
+	}
+	if !holdDb() {
+		return shutdown
+	}
+	defer releaseDb()
+	defer func() { changedOK(code, context, actionCopy, newName, "", []byte(oldName)) }()
+	if *inodeKeys {
+		return x.store.IndexLink(oldName, newName)
+	}
+	return x.store.Copy(pathKey(oldName), pathKey(newName))
 }
 
 func (x *xattrFs) Chmod(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
@@ -176,7 +1006,10 @@ func (x *xattrFs) Access(name string, mode uint32, context *fuse.Context) (code
 
 func (x *xattrFs) Create(name string, flags uint32, mode uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
 	slog.D(name)
-	return x.FileSystem.Create(name, flags, mode, context)
+	if file, code = x.FileSystem.Create(name, flags, mode, context); code == fuse.OK && *inheritDefaults {
+		x.inherit(name, false, context)
+	}
+	return file, code
 }
 
 func (x *xattrFs) Utimens(name string, Atime *time.Time, Mtime *time.Time, context *fuse.Context) (code fuse.Status) {
@@ -186,53 +1019,577 @@ func (x *xattrFs) Utimens(name string, Atime *time.Time, Mtime *time.Time, conte
 
 func (x *xattrFs) StatFs(name string) *fuse.StatfsOut {
 	slog.D(name)
-	return x.FileSystem.StatFs(name)
+	out := x.FileSystem.StatFs(name)
+	if out == nil {
+		s := syscall.Statfs_t{}
+		if err := syscall.Statfs(filepath.Join(x.root, name), &s); err != nil {
+			slog.P("statfs failed on `%s': `%v'", name, err)
+			return nil
+		}
+		out = &fuse.StatfsOut{}
+		out.FromStatfsT(&s)
+	}
+	if *statfsMode == "db" {
+		x.dbStatFs(out)
+	}
+	return out
+}
+
+// dbStatFs makes out report the database as the space in use: out of
+// -max-db-bytes if set, otherwise out of it and the space free under it
+func (x *xattrFs) dbStatFs(out *fuse.StatfsOut) {
+	if !holdDb() {
+		return
+	}
+	defer releaseDb()
+	size, code := x.store.Size()
+	if code != fuse.OK {
+		slog.P("statfs cannot read database size: %v", code)
+		return
+	}
+	bsize := uint64(out.Bsize)
+	if bsize == 0 {
+		bsize = 4096
+		out.Bsize, out.Frsize = uint32(bsize), uint32(bsize)
+	}
+	used := (uint64(size) + bsize - 1) / bsize
+	if *maxDbBytes > 0 {
+		out.Blocks = uint64(*maxDbBytes) / bsize
+	} else {
+		out.Blocks = used + out.Bavail
+	}
+	out.Bfree, out.Bavail = 0, 0
+	if out.Blocks > used {
+		out.Bfree = out.Blocks - used
+		out.Bavail = out.Bfree
+	}
+}
+
+// -log-level settings; errors are always logged
+const (
+	levelError = iota
+	levelInfo
+	levelDebug
+)
+
+var logLevel = levelInfo
+
+// infof logs a message that is neither an error nor per-operation debug
+func infof(format string, a ...interface{}) {
+	if logLevel >= levelInfo {
+		slog.P(format, a...)
+	}
+}
+
+// openDb opens the bolt database at filename, waiting at most -db-timeout
+// for another process to let go of it
+func openDb(filename string, readOnly bool) (*bolt.DB, error) {
+	opts := &bolt.Options{ReadOnly: readOnly, Timeout: *dbTimeout, InitialMmapSize: *initialMmap}
+	if *mmapPopulate {
+		opts.MmapFlags = syscall.MAP_POPULATE
+	}
+	d, err := bolt.Open(filename, 0600, opts)
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("database is locked by another process")
+	}
+	return d, err
+}
+
+// memoryDb, as DATABASE, mounts with a database that is gone on unmount
+const memoryDb = ":memory:"
+
+// openMemoryDb opens a database on a new temporary file, unlinked once
+// open, so that none of it outlives the process, even on a crash
+func openMemoryDb() (*bolt.DB, error) {
+	f, err := ioutil.TempFile("", "xattrfs-")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	return openDb(f.Name(), false)
+}
+
+// mountOptions collects -o options, which may be given comma-joined and
+// repeated, as with mount(8)
+type mountOptions []string
+
+func (m *mountOptions) String() string {
+	return strings.Join(*m, ",")
+}
+
+func (m *mountOptions) Set(v string) error {
+	*m = append(*m, strings.Split(v, ",")...)
+	return nil
+}
+
+var mountArgs mountOptions
+
+func init() {
+	flag.Var(&mountArgs, "o", "mount options: allow_other, allow_root, default_permissions, ro, fsname=NAME")
+}
+
+// parseMountOptions applies -o options to m, and to our own flags
+func parseMountOptions(opts []string, m *fuse.MountOptions) error {
+	for _, o := range opts {
+		switch {
+		case o == "":
+		case o == "allow_other":
+			m.AllowOther = true
+		case o == "allow_root", o == "default_permissions":
+			m.Options = append(m.Options, o)
+		case o == "ro":
+			*readOnly = true
+		case strings.HasPrefix(o, "fsname="):
+			m.FsName = strings.TrimPrefix(o, "fsname=")
+		default:
+			return fmt.Errorf("unsupported mount option `%s'", o)
+		}
+	}
+	return nil
+}
+
+// mountFlags returns the options to mount with, from the -o options
+// opts, and -allow-other, -allow-root and -fs-name
+func mountFlags(opts []string) (*fuse.MountOptions, error) {
+	opts = append([]string{}, opts...)
+	if *allowOther {
+		opts = append(opts, "allow_other")
+	}
+	if *allowRoot {
+		opts = append(opts, "allow_root")
+	}
+	m := &fuse.MountOptions{FsName: *fsName, Name: "xattrfs"}
+	if err := parseMountOptions(opts, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func usage() {
+	fmt.Printf("Usage:\n  %s [OPTIONS] DATABASE DIRECTORY MOUNTPOINT\n", os.Args[0])
+	fmt.Printf("  %s -export DATABASE > DUMP\n", os.Args[0])
+	fmt.Printf("  %s -import [-merge] DATABASE < DUMP\n", os.Args[0])
+	fmt.Printf("  %s -fsck [-prune] DATABASE DIRECTORY\n", os.Args[0])
+	fmt.Printf("  %s -diff DATABASE DATABASE2\n", os.Args[0])
+	fmt.Printf("  %s -stats [-json] DATABASE\n", os.Args[0])
+	fmt.Printf("  %s -check DATABASE\n", os.Args[0])
+	fmt.Printf("  %s -replay-audit AUDITLOG DATABASE\n", os.Args[0])
+	fmt.Printf("  %s -rename-attr [-conflict POLICY] OLD NEW DATABASE\n", os.Args[0])
+	fmt.Printf("  %s -delete-attr NAME DATABASE\n", os.Args[0])
+	fmt.Printf("  %s -merge [-conflict POLICY] DATABASE INPUT...\n", os.Args[0])
+	flag.PrintDefaults()
+	os.Exit(1)
 }
 
 func main() {
+	flag.Usage = usage
 	flag.Parse()
-	if len(flag.Args()) < 1 {
-		fmt.Printf("Usage:\n  %s DATABASE DIRECTORY MOUNTPOINT\n", os.Args[0])
-		os.Exit(1)
+	if *configFile != "" {
+		flags, positional, err := configArgs(*configFile)
+		if err != nil {
+			fmt.Printf("bad config `%s': %v\n", *configFile, err)
+			os.Exit(1)
+		}
+		args := append(flags, os.Args[1:]...)
+		if flag.NArg() == 0 {
+			args = append(args, positional...)
+		}
+		// parsed again, -o would repeat the command line's options
+		mountArgs = nil
+		flag.CommandLine.Parse(args)
+	}
+	versionLine := fmt.Sprintf("%s %s (commit %s, %s)", os.Args[0], version, commit, runtime.Version())
+	if *showVersion {
+		fmt.Println(versionLine)
+		os.Exit(0)
+	}
+	wantArgs := 3
+	switch {
+	case *export, *importDump, *stats, *check:
+		wantArgs = 1
+	case *fsck, *diff, *replay, *deleteAttrs:
+		wantArgs = 2
+	case *merge:
+		wantArgs = -1 // DATABASE and any number of INPUTs
+	}
+	if wantArgs < 0 && flag.NArg() < 2 || wantArgs >= 0 && flag.NArg() != wantArgs {
+		usage()
+	}
+	mountOpts, err := mountFlags(mountArgs)
+	if err != nil {
+		fmt.Println(err)
+		usage()
 	}
 	dbFilename := flag.Arg(0)
 	xattrlessDirectory := flag.Arg(1)
 	mountpoint := flag.Arg(2)
 
-	slog.Init(slog.Config{
-		File:   "STDERR",
-		Debug:  os.Getenv("DEBUG") != "",
+	switch *logLevelArg {
+	case "error":
+		logLevel = levelError
+	case "info":
+		logLevel = levelInfo
+	case "debug":
+		logLevel = levelDebug
+	default:
+		usage()
+	}
+	if os.Getenv("DEBUG") != "" {
+		logLevel = levelDebug
+	}
+	logConfig := slog.Config{
+		File:   *logFile,
+		Debug:  logLevel >= levelDebug,
 		Prefix: "xAttrFS",
-	})
+	}
+	slog.Init(logConfig)
+	if *logJSON {
+		if err := openEventLog(*logFile); err != nil {
+			slog.P("failed to open `%s' for -log-json: `%v'", *logFile, err)
+			os.Exit(1)
+		}
+	}
+	slog.D("%s", versionLine)
+	if *keyFile != "" {
+		if err := loadKey(*keyFile); err != nil {
+			slog.P("failed to load key from `%s': `%v'", *keyFile, err)
+			os.Exit(1)
+		}
+	}
+	if *export {
+		if err := exportDb(dbFilename, os.Stdout); err != nil {
+			slog.P("failed to export database `%s': `%v'", dbFilename, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if *importDump {
+		if err := importDb(dbFilename, os.Stdin, *merge); err != nil {
+			slog.P("failed to import into database `%s': `%v'", dbFilename, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if *fsck {
+		if err := fsckDb(dbFilename, xattrlessDirectory, os.Stdout, *prune); err != nil {
+			slog.P("failed to check database `%s': `%v'", dbFilename, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if *merge && !*importDump {
+		if err := mergeDbs(dbFilename, flag.Args()[1:], *conflict, os.Stdout); err != nil {
+			slog.P("failed to merge into database `%s': `%v'", dbFilename, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if *deleteAttrs {
+		if err := deleteAttr(flag.Arg(1), flag.Arg(0), os.Stdout); err != nil {
+			slog.P("failed to delete `%s' from database `%s': `%v'", flag.Arg(0), flag.Arg(1), err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if *renameAttrs {
+		if err := renameAttr(flag.Arg(2), flag.Arg(0), flag.Arg(1), *conflict, os.Stdout); err != nil {
+			slog.P("failed to rename `%s' to `%s' in database `%s': `%v'", flag.Arg(0), flag.Arg(1), flag.Arg(2), err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if *replay {
+		if err := replayAudit(flag.Arg(0), flag.Arg(1), os.Stdout); err != nil {
+			slog.P("failed to replay `%s' into database `%s': `%v'", flag.Arg(0), flag.Arg(1), err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if *check {
+		if err := checkDb(dbFilename, os.Stdout); err != nil {
+			slog.P("database `%s' failed check: `%v'", dbFilename, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if *stats {
+		if err := statsDb(dbFilename, os.Stdout, *statsJSON); err != nil {
+			slog.P("failed to read database `%s': `%v'", dbFilename, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if *diff {
+		differ, err := diffDb(dbFilename, flag.Arg(1), os.Stdout)
+		if err != nil {
+			slog.P("failed to compare database `%s' to `%s': `%v'", dbFilename, flag.Arg(1), err)
+			os.Exit(2)
+		}
+		if differ {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if *statfsMode != "passthrough" && *statfsMode != "db" {
+		usage()
+	}
+	if *initialMmap < 0 {
+		usage()
+	}
+	perms, err := parseDbPerms(*dbMode, *dbOwner, *dbGroup)
+	if err != nil {
+		fmt.Println(err)
+		usage()
+	}
+	if _, ok := backends[*backendName]; !ok {
+		usage()
+	}
+	if *layoutName != layoutFlat && *layoutName != layoutNamespaced {
+		usage()
+	}
+	if *layoutName == layoutNamespaced && (*inodeKeys || *ttls || *historyLen > 0 || *seedExisting || *inheritDefaults) {
+		fmt.Println("-layout namespaced cannot be used with -inode-keys, -ttl, -history, -import-existing or -inherit-defaults")
+		usage()
+	}
+	if *inodeKeys && strings.Contains(xattrlessDirectory, ",") {
+		fmt.Println("-inode-keys needs a single DIRECTORY")
+		usage()
+	}
+	cache.max = *cacheSize
+	cache.ttl = *negCacheTTL
+	for _, ns := range strings.Split(*namespaces, ",") {
+		if ns = strings.TrimSpace(ns); !persistedNamespaces[ns] {
+			persistedNamespaces[ns] = true
+			namespaceList = append(namespaceList, ns)
+		}
+	}
+
+	if fi, err := os.Stat(mountpoint); err != nil {
+		slog.P("cannot use `%s': %v", mountpoint, err)
+		os.Exit(1)
+	} else if !fi.IsDir() {
+		slog.P("cannot use `%s': not a directory", mountpoint)
+		os.Exit(1)
+	}
+	if *backendName == "loopback" {
+		for _, d := range strings.Split(xattrlessDirectory, ",") {
+			if overlaps(d, mountpoint) {
+				slog.P("cannot mount `%s' on `%s': one is the other, or within it", d, mountpoint)
+				os.Exit(1)
+			}
+		}
+	}
+	fs, dir, err := backends[*backendName](xattrlessDirectory)
+	if err != nil {
+		slog.P("cannot use `%s': %v", xattrlessDirectory, err)
+		os.Exit(1)
+	}
+	xattrlessDirectory = dir
+	if dbFilename != memoryDb {
+		if err := os.MkdirAll(filepath.Dir(dbFilename), 0700); err != nil {
+			slog.P("cannot create directory for database `%s': %v", dbFilename, err)
+			os.Exit(1)
+		}
+	}
+	if *daemon {
+		if err := daemonize(); err != nil {
+			slog.P("failed to start in the background: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	if *auditLog != "" {
+		if err := openAudit(*auditLog); err != nil {
+			slog.P("failed to open audit log `%s': %v", *auditLog, err)
+			os.Exit(1)
+		}
+	}
+
+	if *notifySocket != "" {
+		if err := openNotify(*notifySocket); err != nil {
+			slog.P("failed to listen on notify socket `%s': %v", *notifySocket, err)
+			os.Exit(1)
+		}
+	}
+
 	slog.D("using database `%s'", dbFilename)
-	var err error
-	db, err = bolt.Open(dbFilename, 0600, nil)
+	if dbFilename == memoryDb {
+		db, err = openMemoryDb()
+	} else {
+		db, err = openDb(dbFilename, *readOnly)
+	}
 	if err != nil {
-		slog.P("failed to open database at `%s': `%s'", err)
+		slog.P("failed to open database at `%s': %v", dbFilename, err)
 		os.Exit(1)
 	}
+	if dbFilename != memoryDb && !*readOnly {
+		if err := perms.apply(dbFilename); err != nil {
+			slog.P("failed to set mode and owner of database `%s': %v", dbFilename, err)
+			os.Exit(1)
+		}
+	}
+	slog.D("database page size %d, initial mmap %d bytes, populate %v", db.Info().PageSize, *initialMmap, *mmapPopulate)
+	if *noSync && !*readOnly {
+		slog.P("warning: -no-sync is set, so a crash may lose or corrupt stored xattrs")
+		db.NoSync = true
+	}
+	if !*readOnly {
+		if err := escapePaths(db); err != nil {
+			slog.P("failed to escape stored paths: `%v'", err)
+			os.Exit(1)
+		}
+	}
+
+	if !*readOnly {
+		if err := setLayout(db, *layoutName); err != nil {
+			slog.P("failed to convert database to the %s layout: `%v'", *layoutName, err)
+			os.Exit(1)
+		}
+	} else if err := db.View(func(tx *bolt.Tx) error {
+		if l := dbLayout(tx); l != *layoutName {
+			return fmt.Errorf("database has the %s layout, and converting it needs a writable mount", l)
+		}
+		if names, keys := unescapedPaths(tx); len(names)+len(keys) > 0 {
+			return errUnescaped
+		}
+		return nil
+	}); err != nil {
+		slog.P("cannot use database `%s': %v", dbFilename, err)
+		os.Exit(1)
+	}
+
+	if *inodeKeys && !*readOnly {
+		if err := migrateToInodeKeys(xattrlessDirectory); err != nil {
+			slog.P("failed to migrate database to inode keys: `%v'", err)
+			os.Exit(1)
+		}
+	}
 
 	slog.D("using underlying directory `%s'", xattrlessDirectory)
 	slog.D("mounting on `%s'", mountpoint)
-	nfs := pathfs.NewPathNodeFs(&xattrFs{FileSystem: pathfs.NewLoopbackFileSystem(xattrlessDirectory)}, nil)
+	if *readOnly {
+		fs = pathfs.NewReadonlyFileSystem(fs)
+	}
+	var store Store = boltStore{}
+	if *layoutName == layoutNamespaced {
+		store = nsStore{}
+	}
+	xfs := &xattrFs{FileSystem: fs, root: xattrlessDirectory, store: store}
+	if *seedExisting && !*readOnly {
+		if err := importExisting(xfs); err != nil {
+			slog.P("failed to import existing xattrs from `%s': `%v'", xattrlessDirectory, err)
+			os.Exit(1)
+		}
+	}
+	nfs := pathfs.NewPathNodeFs(xfs, nil)
 	con := nodefs.NewFileSystemConnector(nfs.Root(), nil)
-	srv, err := fuse.NewServer(con.RawFS(), mountpoint, &fuse.MountOptions{
-		AllowOther: true,
-	})
+	slog.D("mounting with fusermount")
+	srv, err := fuse.NewServer(con.RawFS(), mountpoint, mountOpts)
 	if err != nil {
 		slog.P("failed to mount `%s' on `%s': %v\n", xattrlessDirectory, mountpoint, err)
+		// there is no -direct-mount to fall back on: go-fuse v1 can only
+		// mount through fusermount, even as root
+		if _, lerr := exec.LookPath("fusermount"); lerr != nil {
+			slog.P("no fusermount in PATH, which mounting needs; install the fuse package")
+		}
 		os.Exit(1)
 	}
 
+	if !*readOnly && *ttlSweep > 0 {
+		go sweepEvery(*ttlSweep)
+	}
+
+	// closed on any unmount, by signal or not, before the db
+	var servers []*http.Server
+	if *metricsAddr != "" {
+		slog.D("serving metrics on `%s'", *metricsAddr)
+		servers = append(servers, serveMetrics(*metricsAddr))
+	}
+	if *httpAddr != "" {
+		slog.D("serving xattrs on `%s'", *httpAddr)
+		servers = append(servers, serveAPI(xfs, *httpAddr))
+	}
+	if *backupAddr != "" {
+		slog.D("serving backups on `%s'", *backupAddr)
+		servers = append(servers, serveBackup(*backupAddr))
+	}
+	if *healthAddr != "" {
+		slog.D("serving health on `%s'", *healthAddr)
+		servers = append(servers, serveHealth(*healthAddr))
+	}
+	closeServers := func() {
+		for _, s := range servers {
+			s.Close()
+		}
+	}
+
 	c := make(chan os.Signal, 2)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
 	go func() {
-		<-c
-		srv.Unmount()
+		for sig := range c {
+			if sig == syscall.SIGHUP {
+				// reopen the log at its path, after logrotate moved it
+				if *logFile != "STDERR" {
+					slog.Init(logConfig)
+					if *logJSON {
+						if err := openEventLog(*logFile); err != nil {
+							slog.P("failed to reopen `%s' for -log-json: `%v'", *logFile, err)
+						}
+					}
+				}
+				continue
+			}
+			if sig == syscall.SIGUSR1 {
+				if *backupPath == "" {
+					slog.P("caught SIGUSR1 without -backup-file, not backing up")
+				} else if err := backupFile(*backupPath); err != nil {
+					slog.P("failed to back up to `%s': %v", *backupPath, err)
+				} else {
+					infof("backed up database to `%s'", *backupPath)
+				}
+				continue
+			}
+			slog.D("caught %v, unmounting", sig)
+			closeServers()
+			unmount(srv, mountpoint)
+		}
 	}()
 
 	slog.D("now handling filesystem requests")
-	srv.Serve()
+	served := make(chan struct{})
+	go func() {
+		srv.Serve()
+		close(served)
+	}()
+	if err := srv.WaitMount(); err != nil {
+		slog.P("failed to mount `%s' on `%s': %v", xattrlessDirectory, mountpoint, err)
+		os.Exit(1)
+	}
+	if *pidfile != "" {
+		if err := writePidfile(*pidfile); err != nil {
+			slog.P("failed to write pidfile `%s': %v", *pidfile, err)
+			srv.Unmount()
+			os.Exit(1)
+		}
+	}
+	setMounted(true)
+	daemonReady()
+	<-served
+	setMounted(false)
 	slog.D("unmounting, and shutting down db")
-	db.Close()
+	closeServers()
+	shutdownDb()
+	if *pidfile != "" {
+		os.Remove(*pidfile)
+	}
+	if *backendName == "tmpfs" {
+		os.RemoveAll(xattrlessDirectory)
+	}
+	if *compactExit && !*readOnly && dbFilename != memoryDb {
+		if err := compactFile(dbFilename); err != nil {
+			slog.P("failed to compact database `%s': `%v'", dbFilename, err)
+			os.Exit(1)
+		}
+	}
 }
@@ -0,0 +1,1608 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"github.com/patrickhaller/slog"
+)
+
+// setFlag sets the flag name to value for the rest of the test
+func setFlag(t testing.TB, name string, value string) {
+	f := flag.Lookup(name)
+	old := f.Value.String()
+	if err := f.Value.Set(value); err != nil {
+		t.Fatalf("bad -%s `%s': %v", name, value, err)
+	}
+	t.Cleanup(func() { f.Value.Set(old) })
+}
+
+// keepNamespaces sets the namespaces kept in the database, as -namespaces
+// does, for the rest of the test
+func keepNamespaces(t testing.TB, namespaces ...string) {
+	oldMap, oldList := persistedNamespaces, namespaceList
+	persistedNamespaces, namespaceList = map[string]bool{}, namespaces
+	for _, ns := range namespaces {
+		persistedNamespaces[ns] = true
+	}
+	t.Cleanup(func() { persistedNamespaces, namespaceList = oldMap, oldList })
+}
+
+// testDb opens a new database in a temporary directory as the mounted
+// one, with an empty cache, closing it when the test is done
+func testDb(t testing.TB) string {
+	filename := filepath.Join(t.TempDir(), "xattrs.db")
+	d, err := openDb(filename, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := escapePaths(d); err != nil {
+		t.Fatal(err)
+	}
+	db = d
+	cache = &xattrCache{lru: list.New(), entries: map[string]map[string]*list.Element{}}
+	t.Cleanup(closeDb)
+	return filename
+}
+
+// testFs returns an xattrFs over a new temporary directory, keeping the
+// user namespace in a new database, and the directory
+func testFs(t testing.TB) (*xattrFs, string) {
+	testDb(t)
+	keepNamespaces(t, "user")
+	dir := t.TempDir()
+	return &xattrFs{FileSystem: pathfs.NewLoopbackFileSystem(dir), root: dir, store: boltStore{}}, dir
+}
+
+// buildMain builds the binary with go build and its args, skipping the
+// test if it cannot, and returns its filename
+func buildMain(t testing.TB, args ...string) string {
+	bin := filepath.Join(t.TempDir(), "go-xattr-fuse")
+	args = append(append([]string{"build", "-o", bin}, args...), ".")
+	if out, err := exec.Command("go", args...).CombinedOutput(); err != nil {
+		t.Skipf("cannot build: %v: %s", err, out)
+	}
+	return bin
+}
+
+// touch creates the empty file name under dir
+func touch(t testing.TB, dir string, name string) {
+	if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testAudit opens an -audit-log in a temporary directory for the rest of
+// the test, returning its filename, which is complete after stopAudit
+func testAudit(t testing.TB) string {
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	if err := openAudit(filename); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(stopAudit)
+	return filename
+}
+
+// stopAudit writes out and closes the -audit-log, if one is open
+func stopAudit() {
+	closeAudit()
+	auditCh = nil
+}
+
+// setX sets attr of name to v through x, failing the test if it cannot
+func setX(t testing.TB, x *xattrFs, name string, attr string, v string) {
+	t.Helper()
+	if code := x.SetXAttr(name, attr, []byte(v), 0, nil); code != fuse.OK {
+		t.Fatalf("set `%s' attr `%s': %v", name, attr, code)
+	}
+}
+
+// wantX fails the test unless attr of name reads back through x as want
+func wantX(t testing.TB, x *xattrFs, name string, attr string, want string) {
+	t.Helper()
+	if v, code := x.GetXAttr(name, attr, nil); code != fuse.OK || string(v) != want {
+		t.Fatalf("`%s' attr `%s' = `%s', %v, want `%s'", name, attr, v, code, want)
+	}
+}
+
+// wantNoX fails the test unless attr of name reads through x as unset
+func wantNoX(t testing.TB, x *xattrFs, name string, attr string) {
+	t.Helper()
+	if v, code := x.GetXAttr(name, attr, nil); code != fuse.ENOATTR || v != nil {
+		t.Fatalf("`%s' attr `%s' = `%s', %v, want nil and ENOATTR", name, attr, v, code)
+	}
+}
+
+func TestGetXAttrUnset(t *testing.T) {
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	wantNoX(t, x, "f", "user.a")
+	setX(t, x, "f", "user.b", "1")
+	wantNoX(t, x, "f", "user.a")
+	wantX(t, x, "f", "user.b", "1")
+	if _, code := x.GetXAttr("f", "", nil); code != fuse.EINVAL {
+		t.Fatalf("get of an empty name: %v, want EINVAL", code)
+	}
+}
+
+func TestReadsBesideWriter(t *testing.T) {
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	setX(t, x, "f", "user.a", "1")
+	cache.forgetTree("f")
+	// reads take read-only transactions, which a writer does not block
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	wantX(t, x, "f", "user.a", "1")
+	if attrs, code := x.ListXAttr("f", nil); code != fuse.OK || len(attrs) != 1 {
+		t.Fatalf("list beside a writer = %q, %v", attrs, code)
+	}
+}
+
+func TestRenameMovesXattrs(t *testing.T) {
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	touch(t, dir, "g")
+	setX(t, x, "f", "user.a", "1")
+	setX(t, x, "g", "user.b", "2")
+	if code := x.Rename("f", "h", nil); code != fuse.OK {
+		t.Fatalf("rename: %v", code)
+	}
+	wantX(t, x, "h", "user.a", "1")
+	wantNoX(t, x, "f", "user.a")
+	// over an existing file, whose own xattrs go with it
+	if code := x.Rename("h", "g", nil); code != fuse.OK {
+		t.Fatalf("rename over: %v", code)
+	}
+	wantX(t, x, "g", "user.a", "1")
+	wantNoX(t, x, "g", "user.b")
+	if code := x.Rename("none", "f", nil); code != fuse.ENOENT {
+		t.Fatalf("rename of no file: %v, want ENOENT", code)
+	}
+}
+
+// TestRenameMovesForwarded renames a file with one stored xattr and one
+// passed through to the underlying file, and checks each moves once
+func TestRenameMovesForwarded(t *testing.T) {
+	x, dir := testFs(t)
+	keepNamespaces(t, "trusted")
+	touch(t, dir, "f")
+	setX(t, x, "f", "trusted.stored", "s")
+	if code := x.SetXAttr("f", "user.forwarded", []byte("u"), 0, nil); code != fuse.OK {
+		t.Skipf("no user xattrs under `%s': %v", dir, code)
+	}
+	if code := x.Rename("f", "g", nil); code != fuse.OK {
+		t.Fatalf("rename: %v", code)
+	}
+	wantX(t, x, "g", "trusted.stored", "s")
+	wantX(t, x, "g", "user.forwarded", "u")
+	want := []string{"user.forwarded", "trusted.stored"}
+	if attrs, code := x.ListXAttr("g", nil); code != fuse.OK || !reflect.DeepEqual(attrs, want) {
+		t.Fatalf("list = %q, %v, want %q", attrs, code, want)
+	}
+	if _, err := underlyingX(filepath.Join(dir, "g"), "trusted.stored"); err == nil {
+		t.Fatalf("stored xattr reached the underlying file")
+	}
+	if _, _, code := x.store.Get(pathKey("g"), "user.forwarded"); code != fuse.ENOATTR {
+		t.Fatalf("forwarded xattr stored: %v", code)
+	}
+	if _, _, code := x.store.Get(pathKey("f"), "trusted.stored"); code != fuse.ENOATTR {
+		t.Fatalf("stored xattr left at the old name: %v", code)
+	}
+}
+
+// TestRenameOverwrite renames onto existing files, and checks that each
+// then has exactly the xattrs its source had, by path and by inode
+func TestRenameOverwrite(t *testing.T) {
+	for _, inodes := range []string{"false", "true"} {
+		setFlag(t, "inode-keys", inodes)
+		x, dir := testFs(t)
+		for _, name := range []string{"src", "dst", "bare", "old"} {
+			touch(t, dir, name)
+		}
+		setX(t, x, "src", "user.shared", "src")
+		setX(t, x, "src", "user.src", "1")
+		setX(t, x, "dst", "user.shared", "dst")
+		setX(t, x, "dst", "user.dst", "2")
+		setX(t, x, "old", "user.old", "3")
+		wantX(t, x, "dst", "user.dst", "2")
+		if code := x.Rename("src", "dst", nil); code != fuse.OK {
+			t.Fatalf("inode-keys %s: rename over: %v", inodes, code)
+		}
+		wantX(t, x, "dst", "user.shared", "src")
+		wantX(t, x, "dst", "user.src", "1")
+		wantNoX(t, x, "dst", "user.dst")
+		// one with none leaves none of those it replaces
+		if code := x.Rename("bare", "old", nil); code != fuse.OK {
+			t.Fatalf("inode-keys %s: rename of a bare file over: %v", inodes, code)
+		}
+		if attrs, code := x.ListXAttr("old", nil); code != fuse.OK || len(attrs) != 0 {
+			t.Fatalf("inode-keys %s: replaced by a bare file, list = %q, %v", inodes, attrs, code)
+		}
+		// nor does a link renamed onto another of the same file
+		if code := x.Link("dst", "link", nil); code != fuse.OK {
+			t.Fatalf("inode-keys %s: link: %v", inodes, code)
+		}
+		wantX(t, x, "link", "user.src", "1")
+		if code := x.Rename("link", "dst", nil); code != fuse.OK {
+			t.Fatalf("inode-keys %s: rename onto a link: %v", inodes, code)
+		}
+		wantX(t, x, "dst", "user.src", "1")
+	}
+}
+
+func TestUnlinkDropsXattrs(t *testing.T) {
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	if err := os.Mkdir(filepath.Join(dir, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	setX(t, x, "f", "user.a", "1")
+	setX(t, x, "d", "user.a", "1")
+	if code := x.Unlink("f", nil); code != fuse.OK {
+		t.Fatalf("unlink: %v", code)
+	}
+	if code := x.Rmdir("d", nil); code != fuse.OK {
+		t.Fatalf("rmdir: %v", code)
+	}
+	// a new file of the same name starts with none
+	touch(t, dir, "f")
+	if err := os.Mkdir(filepath.Join(dir, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	wantNoX(t, x, "f", "user.a")
+	wantNoX(t, x, "d", "user.a")
+	if code := x.Unlink("none", nil); code != fuse.ENOENT {
+		t.Fatalf("unlink of no file: %v, want ENOENT", code)
+	}
+}
+
+func TestLinkCopiesXattrs(t *testing.T) {
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	setX(t, x, "f", "user.a", "1")
+	if code := x.Link("f", "g", nil); code != fuse.OK {
+		t.Fatalf("link: %v", code)
+	}
+	wantX(t, x, "g", "user.a", "1")
+	// by path, the links go their own ways after
+	setX(t, x, "f", "user.a", "2")
+	wantX(t, x, "g", "user.a", "1")
+}
+
+func TestRenameDirectory(t *testing.T) {
+	x, dir := testFs(t)
+	for _, d := range []string{"d", "d/e", "dx"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	touch(t, dir, "d/f")
+	touch(t, dir, "d/e/g")
+	for _, name := range []string{"d", "d/f", "d/e/g", "dx"} {
+		setX(t, x, name, "user.a", name)
+	}
+	if code := x.Rename("d", "n", nil); code != fuse.OK {
+		t.Fatalf("rename: %v", code)
+	}
+	wantX(t, x, "n", "user.a", "d")
+	wantX(t, x, "n/f", "user.a", "d/f")
+	wantX(t, x, "n/e/g", "user.a", "d/e/g")
+	// a sibling whose name the old one prefixes stays put
+	wantX(t, x, "dx", "user.a", "dx")
+	if err := os.MkdirAll(filepath.Join(dir, "d/e"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, dir, "d/e/g")
+	wantNoX(t, x, "d/e/g", "user.a")
+}
+
+// TestRootXattrs sets xattrs of the mount root, whose path is empty, and
+// of directories, and checks they stay their own
+func TestRootXattrs(t *testing.T) {
+	for _, inodes := range []string{"false", "true"} {
+		setFlag(t, "inode-keys", inodes)
+		x, dir := testFs(t)
+		if err := os.Mkdir(filepath.Join(dir, "d"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		touch(t, dir, "d/f")
+		setX(t, x, "", "user.a", "root")
+		setX(t, x, "d", "user.a", "d")
+		setX(t, x, "d/f", "user.a", "d/f")
+		wantX(t, x, "", "user.a", "root")
+		if attrs, code := x.ListXAttr("", nil); code != fuse.OK || !reflect.DeepEqual(attrs, []string{"user.a"}) {
+			t.Fatalf("inode-keys %s: list of the root = %q, %v", inodes, attrs, code)
+		}
+		// renaming beneath it leaves the root's alone
+		if code := x.Rename("d", "e", nil); code != fuse.OK {
+			t.Fatalf("inode-keys %s: rename: %v", inodes, code)
+		}
+		wantX(t, x, "", "user.a", "root")
+		wantX(t, x, "e", "user.a", "d")
+		wantX(t, x, "e/f", "user.a", "d/f")
+		if code := x.RemoveXAttr("", "user.a", nil); code != fuse.OK {
+			t.Fatalf("inode-keys %s: remove from the root: %v", inodes, code)
+		}
+		wantNoX(t, x, "", "user.a")
+		wantX(t, x, "e", "user.a", "d")
+	}
+}
+
+func TestGetXAttrExactName(t *testing.T) {
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	setX(t, x, "f", "user.ab", "ab")
+	wantNoX(t, x, "f", "user.a")
+	setX(t, x, "f", "user.a", "a")
+	setX(t, x, "f", "user.abc", "abc")
+	cache.forgetTree("f")
+	for _, attr := range []string{"user.a", "user.ab", "user.abc"} {
+		wantX(t, x, "f", attr, strings.TrimPrefix(attr, "user."))
+	}
+}
+
+func TestValuesOutliveTransactions(t *testing.T) {
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	setX(t, x, "f", "user.a", "first value")
+	v, code := x.GetXAttr("f", "user.a", nil)
+	if code != fuse.OK {
+		t.Fatalf("get: %v", code)
+	}
+	// growing the database remaps it, and rewriting reuses the page
+	big := strings.Repeat("x", 60000)
+	for i := 0; i < 64; i++ {
+		setX(t, x, "f", "user.big"+strconv.Itoa(i), big)
+	}
+	setX(t, x, "f", "user.a", "other value")
+	if string(v) != "first value" {
+		t.Fatalf("value read earlier became `%s'", v)
+	}
+}
+
+func TestListXAttr(t *testing.T) {
+	x, dir := testFs(t)
+	keepNamespaces(t, "trusted")
+	touch(t, dir, "f")
+	if attrs, code := x.ListXAttr("f", nil); code != fuse.OK || len(attrs) != 0 {
+		t.Fatalf("list of none = %q, %v", attrs, code)
+	}
+	setX(t, x, "f", "trusted.b", "")
+	setX(t, x, "f", "trusted.a", "1")
+	setX(t, x, "f", "trusted.a", "2")
+	want := []string{"trusted.a", "trusted.b"}
+	// the underlying file's own, of namespaces not kept, come first
+	if err := syscall.Setxattr(filepath.Join(dir, "f"), "user.u", []byte("u"), 0); err == nil {
+		want = append([]string{"user.u"}, want...)
+	}
+	if attrs, code := x.ListXAttr("f", nil); code != fuse.OK || !reflect.DeepEqual(attrs, want) {
+		t.Fatalf("list = %q, %v, want %q", attrs, code, want)
+	}
+}
+
+// listingFs is a filesystem whose files list names, or fail with code
+type listingFs struct {
+	pathfs.FileSystem
+	names []string
+	code  fuse.Status
+}
+
+func (fs *listingFs) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	return fs.names, fs.code
+}
+
+func TestListXAttrMerges(t *testing.T) {
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	setX(t, x, "f", "user.b", "2")
+	setX(t, x, "f", "user.a", "1")
+	under := &listingFs{FileSystem: x.FileSystem, names: []string{"trusted.u", "user.a", "security.s", "trusted.u"}}
+	x.FileSystem = under
+	// each name once, the underlying ones first, less those kept here
+	want := []string{"trusted.u", "security.s", "user.a", "user.b"}
+	if attrs, code := x.ListXAttr("f", nil); code != fuse.OK || !reflect.DeepEqual(attrs, want) {
+		t.Fatalf("list = %q, %v, want %q", attrs, code, want)
+	}
+	// an underlying filesystem that cannot list leaves the stored ones
+	under.names, under.code = nil, fuse.Status(syscall.ENOTSUP)
+	want = []string{"user.a", "user.b"}
+	if attrs, code := x.ListXAttr("f", nil); code != fuse.OK || !reflect.DeepEqual(attrs, want) {
+		t.Fatalf("list over ENOTSUP = %q, %v, want %q", attrs, code, want)
+	}
+}
+
+func TestStatFs(t *testing.T) {
+	x, dir := testFs(t)
+	out := x.StatFs("")
+	if out == nil {
+		t.Fatalf("statfs returned nothing")
+	}
+	var s syscall.Statfs_t
+	if err := syscall.Statfs(dir, &s); err != nil {
+		t.Fatal(err)
+	}
+	if out.Blocks != s.Blocks || out.Bsize != uint32(s.Bsize) {
+		t.Fatalf("statfs = %d blocks of %d, want the underlying %d of %d", out.Blocks, out.Bsize, s.Blocks, s.Bsize)
+	}
+}
+
+// underlyingX returns the value of attr on the file at path itself
+func underlyingX(path string, attr string) ([]byte, error) {
+	buf := make([]byte, 4096)
+	n, err := syscall.Getxattr(path, attr, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func TestNamespaceFilter(t *testing.T) {
+	x, dir := testFs(t)
+	keepNamespaces(t, "trusted")
+	touch(t, dir, "f")
+	setX(t, x, "f", "trusted.a", "1")
+	if _, err := underlyingX(filepath.Join(dir, "f"), "trusted.a"); err == nil {
+		t.Fatalf("kept attr reached the underlying file")
+	}
+	// others pass through, as far as the underlying filesystem allows
+	code := x.SetXAttr("f", "user.u", []byte("u"), 0, nil)
+	if code == fuse.Status(syscall.ENOTSUP) {
+		t.Skip("no user xattrs on the underlying filesystem")
+	}
+	if code != fuse.OK {
+		t.Fatalf("set passed through: %v", code)
+	}
+	if v, err := underlyingX(filepath.Join(dir, "f"), "user.u"); err != nil || string(v) != "u" {
+		t.Fatalf("underlying user.u = `%s', %v, want `u'", v, err)
+	}
+	if v, _, code := x.store.Get("f", "user.u"); code != fuse.ENOATTR {
+		t.Fatalf("passed through attr stored as `%s', %v", v, code)
+	}
+	wantX(t, x, "f", "user.u", "u")
+}
+
+func TestMirror(t *testing.T) {
+	setFlag(t, "mirror", "true")
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	path := filepath.Join(dir, "f")
+	if err := syscall.Setxattr(path, "user.probe", nil, 0); err != nil {
+		t.Skipf("no user xattrs on the underlying filesystem: %v", err)
+	}
+	setX(t, x, "f", "user.a", "1")
+	if v, err := underlyingX(path, "user.a"); err != nil || string(v) != "1" {
+		t.Fatalf("mirrored user.a = `%s', %v, want `1'", v, err)
+	}
+	// one set only underneath reads through while not stored
+	wantX(t, x, "f", "user.probe", "")
+	if code := x.RemoveXAttr("f", "user.a", nil); code != fuse.OK {
+		t.Fatalf("remove: %v", code)
+	}
+	if _, err := underlyingX(path, "user.a"); err == nil {
+		t.Fatalf("mirrored user.a outlived its removal")
+	}
+}
+
+func TestMaxValueSize(t *testing.T) {
+	setFlag(t, "max-value-size", "10")
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	setX(t, x, "f", "user.a", "0123456789")
+	if code := x.SetXAttr("f", "user.b", []byte("0123456789x"), 0, nil); code != fuse.Status(syscall.E2BIG) {
+		t.Fatalf("set past -max-value-size: %v, want E2BIG", code)
+	}
+	wantNoX(t, x, "f", "user.b")
+	if code := x.SetXAttr("f", "user."+strings.Repeat("n", maxNameLen), nil, 0, nil); code != fuse.ERANGE {
+		t.Fatalf("set of a name past %d bytes: %v, want ERANGE", maxNameLen, code)
+	}
+}
+
+func TestConcurrentSets(t *testing.T) {
+	x, dir := testFs(t)
+	const n = 32
+	for i := 0; i < n; i++ {
+		touch(t, dir, "f"+strconv.Itoa(i))
+	}
+	var wg sync.WaitGroup
+	codes := make([]fuse.Status, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = x.SetXAttr("f"+strconv.Itoa(i), "user.a", []byte(strconv.Itoa(i)), 0, nil)
+		}(i)
+	}
+	wg.Wait()
+	for i, code := range codes {
+		if code != fuse.OK {
+			t.Fatalf("set %d: %v", i, code)
+		}
+		wantX(t, x, "f"+strconv.Itoa(i), "user.a", strconv.Itoa(i))
+	}
+}
+
+func TestClear(t *testing.T) {
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	touch(t, dir, "g")
+	setX(t, x, "f", "user.a", "1")
+	setX(t, x, "f", "user.b", "2")
+	setX(t, x, "g", "user.a", "3")
+	setX(t, x, "f", clearAttr, "")
+	if attrs, code := x.ListXAttr("f", nil); code != fuse.OK || len(attrs) != 0 {
+		t.Fatalf("list after clear = %q, %v", attrs, code)
+	}
+	wantNoX(t, x, "f", "user.a")
+	wantX(t, x, "g", "user.a", "3")
+	// clearing a file with none is no error
+	setX(t, x, "f", clearAttr, "")
+}
+
+func TestCopyFrom(t *testing.T) {
+	x, dir := testFs(t)
+	for _, name := range []string{"a", "b", "c"} {
+		touch(t, dir, name)
+	}
+	setX(t, x, "a", "user.one", "1")
+	setX(t, x, "a", "user.two", "2")
+	setX(t, x, "a", "user.three", "")
+	setX(t, x, "b", "user.old", "x")
+	setX(t, x, "b", copyFromAttr, "/a")
+	want, _ := x.ListXAttr("a", nil)
+	if attrs, code := x.ListXAttr("b", nil); code != fuse.OK || !reflect.DeepEqual(attrs, want) {
+		t.Fatalf("list of copy = %q, %v, want %q", attrs, code, want)
+	}
+	for attr, v := range map[string]string{"user.one": "1", "user.two": "2", "user.three": ""} {
+		wantX(t, x, "b", attr, v)
+		wantX(t, x, "a", attr, v)
+	}
+	// the copy is its own, and copying from a file with none changes nothing
+	setX(t, x, "b", "user.one", "changed")
+	wantX(t, x, "a", "user.one", "1")
+	setX(t, x, "b", copyFromAttr, "c")
+	wantX(t, x, "b", "user.one", "changed")
+}
+
+// TestCloneThenCopyFrom clones a file as cp --reflink does through the
+// mount, creating and writing the copy, and checks that the copy gets the
+// original's xattrs only from copyfrom, as the README has it
+func TestCloneThenCopyFrom(t *testing.T) {
+	x, dir := testFs(t)
+	if err := os.Mkdir(filepath.Join(dir, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "dir/original"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	setX(t, x, "dir/original", "user.a", "1")
+	setX(t, x, "dir/original", "user.b", "2")
+	f, code := x.Create("clone", uint32(os.O_WRONLY), 0644, nil)
+	if code != fuse.OK {
+		t.Fatalf("create: %v", code)
+	}
+	if f != nil {
+		f.Release()
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "clone"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if attrs, code := x.ListXAttr("clone", nil); code != fuse.OK || len(attrs) != 0 {
+		t.Fatalf("list of the clone = %q, %v, want none yet", attrs, code)
+	}
+	setX(t, x, "clone", copyFromAttr, "dir/original")
+	wantX(t, x, "clone", "user.a", "1")
+	wantX(t, x, "clone", "user.b", "2")
+	wantX(t, x, "dir/original", "user.a", "1")
+}
+
+// failingStore fails every Set with err
+type failingStore struct {
+	Store
+	err error
+}
+
+func (s failingStore) Set(name string, bucket string, attrs map[string][]byte) error {
+	return s.err
+}
+
+func TestSetErrors(t *testing.T) {
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	// a nested bucket where the value would go makes bolt's Put fail
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(pathKey("f")))
+		if err != nil {
+			return err
+		}
+		_, err = b.CreateBucket([]byte("user.a"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := x.SetXAttr("f", "user.a", []byte("1"), 0, nil); code != fuse.EINVAL {
+		t.Fatalf("set over a nested bucket: %v, want EINVAL", code)
+	}
+	for err, want := range map[error]fuse.Status{
+		bolt.ErrValueTooLarge:   fuse.Status(syscall.E2BIG),
+		bolt.ErrTxNotWritable:   fuse.EIO,
+		bolt.ErrDatabaseNotOpen: shutdown,
+		errTooManyAttrs:         fuse.Status(syscall.ENOSPC),
+	} {
+		fx := &xattrFs{FileSystem: x.FileSystem, root: x.root, store: failingStore{x.store, err}}
+		if code := fx.SetXAttr("f", "user.b", []byte("1"), 0, nil); code != want {
+			t.Errorf("set failing with %v: %v, want %v", err, code, want)
+		}
+		wantNoX(t, x, "f", "user.b")
+	}
+}
+
+// failWrites has writes to the database fail, as on a failing disk,
+// until the returned func is called
+func failWrites(t *testing.T) func() {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("cannot find the database's fd: %v", err)
+	}
+	for _, fi := range fds {
+		fd, _ := strconv.Atoi(fi.Name())
+		if target, _ := os.Readlink(filepath.Join("/proc/self/fd", fi.Name())); target != db.Path() {
+			continue
+		}
+		saved, err := syscall.Dup(fd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		null, err := os.Open(os.DevNull)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer null.Close()
+		if err := syscall.Dup3(int(null.Fd()), fd, 0); err != nil {
+			t.Fatal(err)
+		}
+		return func() {
+			syscall.Dup3(saved, fd, 0)
+			syscall.Close(saved)
+		}
+	}
+	t.Skipf("cannot find the database's fd")
+	return nil
+}
+
+// TestCommitFails checks that ops whose commit fails answer EIO, and
+// leave the stored xattrs as they were
+func TestCommitFails(t *testing.T) {
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	touch(t, dir, "g")
+	setX(t, x, "f", "user.a", "1")
+	setX(t, x, "g", "user.a", "2")
+	restore := failWrites(t)
+	if code := x.SetXAttr("f", "user.a", []byte("changed"), 0, nil); code != fuse.EIO {
+		t.Errorf("set: %v, want EIO", code)
+	}
+	if code := x.SetXAttr("f", "user.b", []byte("new"), 0, nil); code != fuse.EIO {
+		t.Errorf("set of a new attr: %v, want EIO", code)
+	}
+	if code := x.RemoveXAttr("g", "user.a", nil); code != fuse.EIO {
+		t.Errorf("remove: %v, want EIO", code)
+	}
+	if code := x.Rename("f", "h", nil); code != fuse.EIO {
+		t.Errorf("rename: %v, want EIO", code)
+	}
+	restore()
+	cache.forgetTree(pathKey("f"))
+	cache.forgetTree(pathKey("g"))
+	if v, _, code := x.store.Get(pathKey("f"), "user.a"); code != fuse.OK || string(v) != "1" {
+		t.Errorf("after failed ops, f user.a = `%s', %v, want `1'", v, code)
+	}
+	wantNoX(t, x, "f", "user.b")
+	wantX(t, x, "g", "user.a", "2")
+	setX(t, x, "g", "user.c", "3")
+	wantX(t, x, "g", "user.c", "3")
+}
+
+// TestRemoveMissingBesideWriter checks that removing an unset attr
+// answers ENOATTR without waiting on an open write transaction
+func TestRemoveMissingBesideWriter(t *testing.T) {
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	touch(t, dir, "g")
+	setX(t, x, "f", "user.a", "1")
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	done := make(chan fuse.Status, 2)
+	go func() {
+		done <- x.RemoveXAttr("f", "user.b", nil)
+		done <- x.RemoveXAttr("g", "user.a", nil)
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case code := <-done:
+			if code != fuse.ENOATTR {
+				t.Fatalf("remove of an unset attr: %v, want ENOATTR", code)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("remove of an unset attr waited on the writer")
+		}
+	}
+}
+
+// BenchmarkRemoveMissing removes unset attrs while another goroutine
+// holds the write lock, which it must not wait on
+func BenchmarkRemoveMissing(b *testing.B) {
+	x, dir := testFs(b)
+	touch(b, dir, "f")
+	setX(b, x, "f", "user.a", "1")
+	tx, err := db.Begin(true)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer tx.Rollback()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if code := x.RemoveXAttr("f", "user.b", nil); code != fuse.ENOATTR {
+				b.Errorf("remove of an unset attr: %v, want ENOATTR", code)
+			}
+		}
+	})
+}
+
+func TestVersion(t *testing.T) {
+	bin := buildMain(t, "-ldflags", "-X main.version=1.2.3 -X main.commit=abc123")
+	out, err := exec.Command(bin, "-version").Output()
+	if err != nil {
+		t.Fatalf("-version: %v", err)
+	}
+	line := strings.TrimSpace(string(out))
+	if !strings.Contains(line, "1.2.3") || !strings.Contains(line, "abc123") || !strings.Contains(line, runtime.Version()) {
+		t.Fatalf("-version printed `%s', want the version, commit, and %s", line, runtime.Version())
+	}
+}
+
+func TestArgs(t *testing.T) {
+	bin := buildMain(t)
+	dir := t.TempDir()
+	dbFile := filepath.Join(dir, "xattrs.db")
+	missing := filepath.Join(dir, "missing")
+	for _, args := range [][]string{
+		{dbFile},
+		{dbFile, dir},
+		{dbFile, dir, dir, dir},
+		{dbFile, missing, dir},
+		{dbFile, dir, missing},
+	} {
+		out, err := exec.Command(bin, args...).CombinedOutput()
+		if err == nil {
+			t.Fatalf("%q exited zero", args)
+		}
+		if len(args) != 3 && !strings.Contains(string(out), "Usage:") {
+			t.Errorf("%q printed `%s', want usage", args, out)
+		}
+		if len(args) == 3 && !strings.Contains(string(out), missing) {
+			t.Errorf("%q printed `%s', want it to name `%s'", args, out, missing)
+		}
+		if strings.Contains(string(out), "panic") {
+			t.Errorf("%q panicked: %s", args, out)
+		}
+	}
+}
+
+func TestDbLocked(t *testing.T) {
+	filename := testDb(t)
+	setFlag(t, "db-timeout", "50ms")
+	start := time.Now()
+	d, err := openDb(filename, false)
+	if err == nil {
+		d.Close()
+		t.Fatal("opened a database another holds")
+	}
+	if !strings.Contains(err.Error(), "locked by another process") {
+		t.Fatalf("open of a held database: %v, want that it is locked", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("open of a held database took %v, past -db-timeout", took)
+	}
+}
+
+// mappedBytes returns how many bytes of filename this process maps
+func mappedBytes(t *testing.T, filename string) uint64 {
+	maps, err := ioutil.ReadFile("/proc/self/maps")
+	if err != nil {
+		t.Skipf("cannot read the process's maps: %v", err)
+	}
+	var n uint64
+	for _, line := range strings.Split(string(maps), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 6 || fields[5] != filename {
+			continue
+		}
+		var start, end uint64
+		if _, err := fmt.Sscanf(fields[0], "%x-%x", &start, &end); err != nil {
+			t.Fatalf("malformed map `%s'", line)
+		}
+		n += end - start
+	}
+	return n
+}
+
+func TestOpenOptions(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "xattrs.db")
+	setFlag(t, "initial-mmap", strconv.Itoa(8<<20))
+	setFlag(t, "mmap-populate", "true")
+	d, err := openDb(filename, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if size := d.Info().PageSize; size != os.Getpagesize() {
+		t.Errorf("page size %d, want the system's %d", size, os.Getpagesize())
+	}
+	if n := mappedBytes(t, filename); n < 8<<20 {
+		t.Errorf("mapped %d bytes, want -initial-mmap's %d", n, 8<<20)
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() >= 8<<20 {
+		t.Errorf("database file of %d bytes, grown to the initial mmap", fi.Size())
+	}
+}
+
+// failBegins has the next n transactions fail to begin, for the rest of
+// the test, returning how many began or failed so far
+func failBegins(t *testing.T, n int) *int {
+	old := dbBegin
+	t.Cleanup(func() { dbBegin = old })
+	tries := 0
+	dbBegin = func(writable bool) (*bolt.Tx, error) {
+		if tries++; tries <= n {
+			return nil, errors.New("transient")
+		}
+		return old(writable)
+	}
+	return &tries
+}
+
+func TestBeginRetries(t *testing.T) {
+	x, dir := testFs(t)
+	setFlag(t, "begin-retries", "3")
+	setFlag(t, "begin-backoff", "1ms")
+	touch(t, dir, "f")
+	setX(t, x, "f", "user.a", "1")
+
+	tries := failBegins(t, 3)
+	wantX(t, x, "f", "user.a", "1")
+	if *tries != 4 {
+		t.Fatalf("began after %d tries, want 4", *tries)
+	}
+	tries = failBegins(t, 4)
+	if _, code := x.GetXAttr("f", "user.a", nil); code != fuse.EBUSY {
+		t.Fatalf("get past -begin-retries: %v, want EBUSY", code)
+	}
+	if *tries != 4 {
+		t.Fatalf("gave up after %d tries, want 4", *tries)
+	}
+
+	// however many retries, a request is not held up past beginDeadline
+	setFlag(t, "begin-retries", "100")
+	setFlag(t, "begin-backoff", "100ms")
+	failBegins(t, 100)
+	start := time.Now()
+	if _, code := x.GetXAttr("f", "user.a", nil); code != fuse.EBUSY {
+		t.Fatalf("get past the deadline: %v, want EBUSY", code)
+	}
+	if took := time.Since(start); took > beginDeadline {
+		t.Fatalf("gave up after %v, past %v", took, beginDeadline)
+	}
+}
+
+func TestOwnerOnly(t *testing.T) {
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	setX(t, x, "f", "user.a", "1")
+	owner := uint32(os.Getuid())
+	if owner == 0 {
+		// so that the owner's changes are not allowed as root's
+		owner = 1000
+		if err := os.Chown(filepath.Join(dir, "f"), int(owner), -1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := &fuse.Context{Owner: fuse.Owner{Uid: owner + 1}}
+	for attr, v := range map[string]string{"user.a": "2", "user.b": "2", clearAttr: "", "user.a" + ttlSuffix: "1h"} {
+		if code := x.SetXAttr("f", attr, []byte(v), 0, other); code != fuse.EPERM {
+			t.Errorf("set of `%s' by another user: %v, want EPERM", attr, code)
+		}
+	}
+	if code := x.RemoveXAttr("f", "user.a", other); code != fuse.EPERM {
+		t.Errorf("remove by another user: %v, want EPERM", code)
+	}
+	wantX(t, x, "f", "user.a", "1")
+	wantNoX(t, x, "f", "user.b")
+	// reading is left to the kernel's checks of the file
+	if v, code := x.GetXAttr("f", "user.a", other); code != fuse.OK || string(v) != "1" {
+		t.Fatalf("get by another user = `%s', %v", v, code)
+	}
+
+	for _, ctx := range []*fuse.Context{{Owner: fuse.Owner{Uid: owner}}, {Owner: fuse.Owner{Uid: 0}}} {
+		if code := x.SetXAttr("f", "user.a", []byte("3"), 0, ctx); code != fuse.OK {
+			t.Fatalf("set by uid %d: %v", ctx.Uid, code)
+		}
+		if code := x.RemoveXAttr("f", "user.a", ctx); code != fuse.OK {
+			t.Fatalf("remove by uid %d: %v", ctx.Uid, code)
+		}
+	}
+}
+
+func TestMountFlags(t *testing.T) {
+	m, err := mountFlags(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.AllowOther || len(m.Options) != 0 || m.FsName != *fsName {
+		t.Fatalf("default mount options %+v, want a private mount named `%s'", m, *fsName)
+	}
+	setFlag(t, "allow-other", "true")
+	setFlag(t, "allow-root", "true")
+	setFlag(t, "fs-name", "tags")
+	m, err = mountFlags(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.AllowOther || !reflect.DeepEqual(m.Options, []string{"allow_root"}) || m.FsName != "tags" {
+		t.Fatalf("mount options %+v, want allow_other, allow_root and fsname tags", m)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	setX(t, x, "f", "user.a", "1")
+	filename := db.Path()
+	closeDb()
+	d, err := openDb(filename, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = d
+	setFlag(t, "ro", "true")
+	x.FileSystem = pathfs.NewReadonlyFileSystem(x.FileSystem)
+	wantX(t, x, "f", "user.a", "1")
+	if attrs, code := x.ListXAttr("f", nil); code != fuse.OK || !reflect.DeepEqual(attrs, []string{"user.a"}) {
+		t.Fatalf("list = %q, %v, want user.a", attrs, code)
+	}
+	for _, attr := range []string{"user.a", "user.b", "trusted.b"} {
+		if code := x.SetXAttr("f", attr, []byte("2"), 0, nil); code != fuse.EROFS {
+			t.Errorf("set %s: %v, want EROFS", attr, code)
+		}
+	}
+	if code := x.RemoveXAttr("f", "user.a", nil); code != fuse.EROFS {
+		t.Errorf("remove: %v, want EROFS", code)
+	}
+	// the underlying files are read-only too
+	if code := x.Unlink("f", nil); code == fuse.OK {
+		t.Errorf("unlink succeeded")
+	}
+	wantX(t, x, "f", "user.a", "1")
+}
+
+func TestParseMountOptions(t *testing.T) {
+	setFlag(t, "ro", "false")
+	var opts mountOptions
+	for _, v := range []string{"allow_other,ro,default_permissions", "fsname=tags,"} {
+		if err := opts.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := &fuse.MountOptions{}
+	if err := parseMountOptions(opts, m); err != nil {
+		t.Fatal(err)
+	}
+	if !m.AllowOther || !*readOnly || !reflect.DeepEqual(m.Options, []string{"default_permissions"}) || m.FsName != "tags" {
+		t.Fatalf("parsed `%s' as %+v, ro %v", opts.String(), m, *readOnly)
+	}
+	if err := parseMountOptions([]string{"allow_other", "nosuid"}, &fuse.MountOptions{}); err == nil || !strings.Contains(err.Error(), "nosuid") {
+		t.Fatalf("parse of an unknown option: %v, want it named", err)
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	x, dir := testFs(t)
+	setFlag(t, "case-insensitive", "true")
+	touch(t, dir, "f")
+	setX(t, x, "f", "user.Tag", "1")
+	wantX(t, x, "f", "user.tag", "1")
+	wantX(t, x, "f", "user.TAG", "1")
+	if attrs, code := x.ListXAttr("f", nil); code != fuse.OK || !reflect.DeepEqual(attrs, []string{"user.Tag"}) {
+		t.Fatalf("list = %q, %v, want the name as set", attrs, code)
+	}
+	setX(t, x, "f", "user.TAG", "2")
+	wantX(t, x, "f", "user.Tag", "2")
+	if attrs, code := x.ListXAttr("f", nil); code != fuse.OK || !reflect.DeepEqual(attrs, []string{"user.TAG"}) {
+		t.Fatalf("list = %q, %v, want the name as last set", attrs, code)
+	}
+	setX(t, x, "f", "user.tag", "3")
+	if attrs, code := x.ListXAttr("f", nil); code != fuse.OK || !reflect.DeepEqual(attrs, []string{"user.tag"}) {
+		t.Fatalf("list = %q, %v, want the name as last set", attrs, code)
+	}
+	// the namespace is left as is, so USER is not user, nor kept
+	if _, code := x.GetXAttr("f", "USER.tag", nil); code == fuse.OK {
+		t.Fatalf("get of USER.tag found user.tag")
+	}
+	if code := x.RemoveXAttr("f", "user.TaG", nil); code != fuse.OK {
+		t.Fatalf("remove: %v", code)
+	}
+	wantNoX(t, x, "f", "user.tag")
+}
+
+func TestMaxAttrs(t *testing.T) {
+	x, dir := testFs(t)
+	setFlag(t, "max-attrs-per-file", "2")
+	touch(t, dir, "f")
+	touch(t, dir, "g")
+	setX(t, x, "f", "user.a", "1")
+	setX(t, x, "f", "user.b", "2")
+	if code := x.SetXAttr("f", "user.c", []byte("3"), 0, nil); code != fuse.Status(syscall.ENOSPC) {
+		t.Fatalf("set of a 3rd attr: %v, want ENOSPC", code)
+	}
+	wantNoX(t, x, "f", "user.c")
+	setX(t, x, "f", "user.a", "updated")
+	wantX(t, x, "f", "user.a", "updated")
+	setX(t, x, "g", "user.c", "3")
+	if code := x.RemoveXAttr("f", "user.b", nil); code != fuse.OK {
+		t.Fatalf("remove: %v", code)
+	}
+	setX(t, x, "f", "user.c", "3")
+}
+
+func TestMaxDbBytes(t *testing.T) {
+	x, dir := testFs(t)
+	setFlag(t, "max-value-size", "4096")
+	touch(t, dir, "f")
+	setX(t, x, "f", "user.first", "1")
+	size, code := x.store.Size()
+	if code != fuse.OK {
+		t.Fatalf("size: %v", code)
+	}
+	setFlag(t, "max-db-bytes", strconv.FormatInt(size+64<<10, 10))
+	v := strings.Repeat("v", 4096)
+	full := -1
+	for i := 0; i < 1000 && full < 0; i++ {
+		code := x.SetXAttr("f", "user."+strconv.Itoa(i), []byte(v), 0, nil)
+		if code == fuse.Status(syscall.ENOSPC) {
+			full = i
+		} else if code != fuse.OK {
+			t.Fatalf("set %d: %v", i, code)
+		}
+	}
+	if full <= 0 {
+		t.Fatalf("-max-db-bytes refused set %d, want it to take some first, then refuse", full)
+	}
+	if size, _ := x.store.Size(); size > *maxDbBytes+1<<20 {
+		t.Fatalf("database grew to %d bytes, far past -max-db-bytes %d", size, *maxDbBytes)
+	}
+	// when full, xattrs can still be read and removed
+	if code := x.RemoveXAttr("f", "user.0", nil); code != fuse.OK {
+		t.Fatalf("remove when full: %v", code)
+	}
+	if code := x.RemoveXAttr("f", "user.first", nil); code != fuse.OK {
+		t.Fatalf("remove when full: %v", code)
+	}
+	wantNoX(t, x, "f", "user.0")
+	wantX(t, x, "f", "user.1", v)
+}
+
+func TestStatFsDb(t *testing.T) {
+	x, dir := testFs(t)
+	setFlag(t, "statfs-mode", "db")
+	setFlag(t, "max-db-bytes", strconv.Itoa(16<<20))
+	setFlag(t, "max-value-size", "4096")
+	touch(t, dir, "f")
+	used := func() uint64 {
+		out := x.StatFs("")
+		if out == nil {
+			t.Fatalf("statfs returned nothing")
+		}
+		if want := uint64(16<<20) / uint64(out.Bsize); out.Blocks != want {
+			t.Fatalf("statfs = %d blocks of %d, want -max-db-bytes in %d", out.Blocks, out.Bsize, want)
+		}
+		size, _ := x.store.Size()
+		if u := (out.Blocks - out.Bfree) * uint64(out.Bsize); u < uint64(size) || u >= uint64(size)+uint64(out.Bsize) {
+			t.Fatalf("statfs shows %d bytes used, want the database's %d", u, size)
+		}
+		return out.Blocks - out.Bfree
+	}
+	before := used()
+	v := strings.Repeat("v", 4096)
+	for i := 0; i < 20; i++ {
+		setX(t, x, "f", "user."+strconv.Itoa(i), v)
+	}
+	if after := used(); after <= before {
+		t.Fatalf("statfs used %d blocks after growing the database, %d before", after, before)
+	}
+}
+
+func TestSymlinkOwnXattrs(t *testing.T) {
+	x, dir := testFs(t)
+	touch(t, dir, "t")
+	if err := os.Mkdir(filepath.Join(dir, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{"l": "t", "d/l": "../t"} {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setX(t, x, "l", "user.a", "link")
+	setX(t, x, "d/l", "user.a", "other link")
+	setX(t, x, "t", "user.b", "target")
+	wantX(t, x, "l", "user.a", "link")
+	wantX(t, x, "d/l", "user.a", "other link")
+	wantNoX(t, x, "t", "user.a")
+	wantNoX(t, x, "l", "user.b")
+	wantNoX(t, x, "d/l", "user.b")
+	if attrs, code := x.ListXAttr("l", nil); code != fuse.OK || !reflect.DeepEqual(attrs, []string{"user.a"}) {
+		t.Fatalf("list of link = %q, %v, want only its own", attrs, code)
+	}
+
+	// the underlying xattrs of the target are not the link's either
+	setFlag(t, "mirror", "true")
+	if err := syscall.Setxattr(filepath.Join(dir, "t"), "user.u", []byte("u"), 0); err != nil {
+		t.Skipf("no user xattrs under `%s': %v", dir, err)
+	}
+	wantX(t, x, "t", "user.u", "u")
+	wantNoX(t, x, "l", "user.u")
+	if attrs, code := x.ListXAttr("l", nil); code != fuse.OK || !reflect.DeepEqual(attrs, []string{"user.a"}) {
+		t.Fatalf("list of link = %q, %v, want only its own", attrs, code)
+	}
+}
+
+func TestInvalidNames(t *testing.T) {
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	setX(t, x, "f", "user.a", "1")
+	for _, attr := range []string{"", "user.a\x00", "\x00user.a", "user.\x00b"} {
+		if code := x.SetXAttr("f", attr, []byte("v"), 0, nil); code != fuse.EINVAL {
+			t.Errorf("set of `%q': %v, want EINVAL", attr, code)
+		}
+		if _, code := x.GetXAttr("f", attr, nil); code != fuse.EINVAL {
+			t.Errorf("get of `%q': %v, want EINVAL", attr, code)
+		}
+		if code := x.RemoveXAttr("f", attr, nil); code != fuse.EINVAL {
+			t.Errorf("remove of `%q': %v, want EINVAL", attr, code)
+		}
+	}
+	if code := x.SetXAttr("f", batchAttr, []byte(`{"user.b\u0000": "2"}`), 0, nil); code != fuse.EINVAL {
+		t.Errorf("batch set of a name with NUL: %v, want EINVAL", code)
+	}
+	wantX(t, x, "f", "user.a", "1")
+	if attrs, code := x.ListXAttr("f", nil); code != fuse.OK || !reflect.DeepEqual(attrs, []string{"user.a"}) {
+		t.Fatalf("list = %q, %v, want only user.a", attrs, code)
+	}
+}
+
+// TestAfterClose checks that ops on a closed database fail with
+// ESHUTDOWN, whether it is gone or only closed, rather than panic
+func TestAfterClose(t *testing.T) {
+	for _, gone := range []bool{true, false} {
+		x, dir := testFs(t)
+		touch(t, dir, "f")
+		setX(t, x, "f", "user.a", "1")
+		if gone {
+			closeDb()
+		} else {
+			db.Close()
+		}
+		if code := x.SetXAttr("f", "user.b", []byte("2"), 0, nil); code != shutdown {
+			t.Errorf("set after close: %v, want ESHUTDOWN", code)
+		}
+		if _, code := x.GetXAttr("f", "user.a", nil); code != shutdown {
+			t.Errorf("get after close: %v, want ESHUTDOWN", code)
+		}
+		if _, code := x.ListXAttr("f", nil); code != shutdown {
+			t.Errorf("list after close: %v, want ESHUTDOWN", code)
+		}
+		if code := x.RemoveXAttr("f", "user.a", nil); code != shutdown {
+			t.Errorf("remove after close: %v, want ESHUTDOWN", code)
+		}
+		x.Rename("f", "g", nil)
+		x.Unlink("g", nil)
+	}
+}
+
+// TestShutdownBesideOp shuts the db down while an op that timed out still
+// holds it, which must get its change into the -audit-log, not panic
+func TestShutdownBesideOp(t *testing.T) {
+	audit := testAudit(t)
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	setFlag(t, "op-timeout", "1ms")
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the op waits on tx, past its timeout, holding the db
+	if code := x.SetXAttr("f", "user.a", []byte("1"), 0, nil); code != fuse.Status(syscall.EINTR) {
+		t.Fatalf("set beside a writer: %v, want EINTR", code)
+	}
+	done := make(chan struct{})
+	go func() {
+		shutdownDb()
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	tx.Rollback()
+	<-done
+	auditCh = nil
+	entries := readAudit(t, audit)
+	if len(entries) != 1 || entries[0].Attr != "user.a" {
+		t.Fatalf("audit log = %+v, want the late set", entries)
+	}
+}
+
+// TestStoresAfterClose checks that each Store op that finds the database
+// closed under it, as one racing an unmount may, fails with ESHUTDOWN
+func TestStoresAfterClose(t *testing.T) {
+	for _, layout := range []string{layoutFlat, layoutNamespaced} {
+		testDb(t)
+		var s Store = boltStore{}
+		if layout == layoutNamespaced {
+			if err := setLayout(db, layoutNamespaced); err != nil {
+				t.Fatal(err)
+			}
+			s = nsStore{}
+		}
+		mustSet(t, s, "f", "user.a", "1")
+		db.Close()
+		if err := s.Set("f", "f", map[string][]byte{"user.b": []byte("2")}); err != bolt.ErrDatabaseNotOpen {
+			t.Errorf("%s: set: %v, want ErrDatabaseNotOpen", layout, err)
+		}
+		ops := map[string]func() fuse.Status{
+			"get":    func() fuse.Status { _, _, code := s.Get("f", "user.a"); return code },
+			"list":   func() fuse.Status { _, code := s.List("f", "user."); return code },
+			"remove": func() fuse.Status { return s.Remove("f", "user.a") },
+			"rename": func() fuse.Status { return s.Rename("f", "g") },
+			"copy":   func() fuse.Status { return s.Copy("f", "g") },
+			"delete": func() fuse.Status { return s.Delete("f") },
+			"size":   func() fuse.Status { _, code := s.Size(); return code },
+		}
+		if layout == layoutFlat {
+			ops["expiry"] = func() fuse.Status { return s.SetExpiry("f", "user.a", time.Now()) }
+			ops["history"] = func() fuse.Status { _, code := s.History("f", "user.a"); return code }
+			ops["owner"] = func() fuse.Status { _, code := s.Owner("f", "f"); return code }
+			ops["link"] = func() fuse.Status { return s.IndexLink("f", "g") }
+			ops["reindex"] = func() fuse.Status { return s.Reindex("f", "g") }
+			ops["unindex"] = func() fuse.Status { return s.Unindex("f", "f") }
+		}
+		for op, f := range ops {
+			if code := f(); code != shutdown {
+				t.Errorf("%s: %s: %v, want ESHUTDOWN", layout, op, code)
+			}
+		}
+	}
+}
+
+// TestCloseBesideOps closes the database while ops are running on it,
+// which must each finish or fail with ESHUTDOWN
+func TestCloseBesideOps(t *testing.T) {
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			attr := "user." + strconv.Itoa(i)
+			for j := 0; j < 50; j++ {
+				if code := x.SetXAttr("f", attr, []byte("v"), 0, nil); code != fuse.OK && code != shutdown {
+					t.Errorf("set beside close: %v", code)
+					return
+				}
+				if _, code := x.GetXAttr("f", attr, nil); code != fuse.OK && code != shutdown {
+					t.Errorf("get beside close: %v", code)
+					return
+				}
+			}
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	closeDb()
+	wg.Wait()
+}
+
+func TestBatch(t *testing.T) {
+	x, dir := testFs(t)
+	setFlag(t, "max-value-size", "4")
+	touch(t, dir, "f")
+	setX(t, x, "f", "user.a", "old")
+	setX(t, x, "f", batchAttr, `{"user.a": "1", "user.b": "2", "user.c": ""}`)
+	wantX(t, x, "f", "user.a", "1")
+	wantX(t, x, "f", "user.b", "2")
+	wantX(t, x, "f", "user.c", "")
+	wantNoX(t, x, "f", batchAttr)
+
+	for batch, want := range map[string]fuse.Status{
+		`{"user.a": "x", "user.d": "too long"}`:    fuse.Status(syscall.E2BIG),
+		`{"user.a": "x", "trusted.d": "y"}`:        fuse.EINVAL,
+		`{"user.a": "x", "` + clearAttr + `": ""}`: fuse.EINVAL,
+		`{"user.a": "x"`:                           fuse.EINVAL,
+		`["user.a", "x"]`:                          fuse.EINVAL,
+		`{}`:                                       fuse.EINVAL,
+	} {
+		if code := x.SetXAttr("f", batchAttr, []byte(batch), 0, nil); code != want {
+			t.Errorf("batch `%s': %v, want %v", batch, code, want)
+		}
+	}
+	// so none of a failed batch is set
+	wantX(t, x, "f", "user.a", "1")
+	wantNoX(t, x, "f", "user.d")
+
+	// nor is any when the transaction fails part way
+	setFlag(t, "max-value-size", "64")
+	setFlag(t, "max-attrs-per-file", "4")
+	if code := x.SetXAttr("f", batchAttr, []byte(`{"user.a": "x", "user.d": "y", "user.e": "z"}`), 0, nil); code != fuse.Status(syscall.ENOSPC) {
+		t.Fatalf("batch past -max-attrs-per-file: %v, want ENOSPC", code)
+	}
+	wantX(t, x, "f", "user.a", "1")
+	wantNoX(t, x, "f", "user.d")
+	wantNoX(t, x, "f", "user.e")
+}
+
+// BenchmarkGetXAttr reads a value as the kernel's size probes do, each
+// a whole GetXAttr, from values of a few sizes, with and without the
+// cache
+func BenchmarkGetXAttr(b *testing.B) {
+	for _, size := range []int{16, 4096, 60 << 10} {
+		for _, entries := range []int{0, 1024} {
+			b.Run(fmt.Sprintf("%d bytes, cache %d", size, entries), func(b *testing.B) {
+				x, dir := testFs(b)
+				setFlag(b, "max-value-size", strconv.Itoa(size))
+				touch(b, dir, "f")
+				v := strings.Repeat("v", size)
+				setX(b, x, "f", "user.a", v)
+				cache.max = entries
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if got, code := x.GetXAttr("f", "user.a", nil); code != fuse.OK || len(got) != size {
+						b.Fatalf("get = %d bytes, %v, want %d", len(got), code, size)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkSetXAttr sets xattrs from many writers, as a busy mount has,
+// with and without -no-sync, whose fsync is most of the cost of a commit
+func BenchmarkSetXAttr(b *testing.B) {
+	for _, noSync := range []bool{false, true} {
+		b.Run(fmt.Sprintf("no-sync %v", noSync), func(b *testing.B) {
+			x, dir := testFs(b)
+			touch(b, dir, "f")
+			db.NoSync = noSync
+			var n int64
+			b.SetParallelism(16)
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				attr := "user." + strconv.FormatInt(atomic.AddInt64(&n, 1), 10)
+				for pb.Next() {
+					if code := x.SetXAttr("f", attr, []byte("v"), 0, nil); code != fuse.OK {
+						b.Errorf("set: %v", code)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// posixACL returns a POSIX ACL, as the kernel encodes it in
+// system.posix_acl_access, granting uid read beside the file's mode
+func posixACL(uid uint32) []byte {
+	var acl []byte
+	put := func(tag uint16, perm uint16, id uint32) {
+		acl = append(acl, byte(tag), byte(tag>>8), byte(perm), byte(perm>>8),
+			byte(id), byte(id>>8), byte(id>>16), byte(id>>24))
+	}
+	acl = append(acl, 2, 0, 0, 0)
+	put(0x01, 6, ^uint32(0)) // owner
+	put(0x02, 4, uid)        // named user
+	put(0x04, 4, ^uint32(0)) // group
+	put(0x10, 4, ^uint32(0)) // mask
+	put(0x20, 4, ^uint32(0)) // other
+	return acl
+}
+
+func TestACLsPassThrough(t *testing.T) {
+	x, dir := testFs(t)
+	keepNamespaces(t, "user", "system", "security")
+	touch(t, dir, "f")
+	const attr = "system.posix_acl_access"
+	acl := posixACL(1000)
+	if code := x.SetXAttr("f", attr, acl, 0, nil); code != fuse.OK {
+		t.Skipf("no ACLs under `%s': %v", dir, code)
+	}
+	if v, err := underlyingX(filepath.Join(dir, "f"), attr); err != nil || len(v) != len(acl) {
+		t.Fatalf("underlying ACL = %d bytes, %v, want the %d set", len(v), err, len(acl))
+	}
+	if v, _, code := x.store.Get(pathKey("f"), attr); code != fuse.ENOATTR {
+		t.Fatalf("ACL stored as `%q', %v, want it left to the underlying file", v, code)
+	}
+	if v, code := x.GetXAttr("f", attr, nil); code != fuse.OK || len(v) != len(acl) {
+		t.Fatalf("get ACL = %d bytes, %v, want %d", len(v), code, len(acl))
+	}
+	setX(t, x, "f", "system.other", "stored")
+	attrs, code := x.ListXAttr("f", nil)
+	if code != fuse.OK {
+		t.Fatalf("list: %v", code)
+	}
+	listed := map[string]bool{}
+	for _, a := range attrs {
+		listed[a] = true
+	}
+	if !listed[attr] || !listed["system.other"] {
+		t.Fatalf("list = %q, want the ACL and system.other", attrs)
+	}
+	if code := x.RemoveXAttr("f", attr, nil); code != fuse.OK {
+		t.Fatalf("remove ACL: %v", code)
+	}
+	if _, err := underlyingX(filepath.Join(dir, "f"), attr); err == nil {
+		t.Fatalf("ACL left on the underlying file after remove")
+	}
+}
+
+// TestMemoryDb mounts as DATABASE :memory: would, and checks that its
+// attrs work while leaving no file behind, even before unmount
+func TestMemoryDb(t *testing.T) {
+	x, dir := testFs(t)
+	closeDb()
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	d, err := openMemoryDb()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = d
+	touch(t, dir, "f")
+	setX(t, x, "f", "user.a", "1")
+	wantX(t, x, "f", "user.a", "1")
+	if _, err := os.Stat(d.Path()); !os.IsNotExist(err) {
+		t.Errorf("database file `%s' left while mounted: %v", d.Path(), err)
+	}
+	closeDb()
+	if left, _ := filepath.Glob(filepath.Join(tmp, "*")); len(left) > 0 {
+		t.Errorf("left %q after unmount", left)
+	}
+}
+
+// xattrRecorder is a filesystem keeping its files' xattrs in a map
+type xattrRecorder struct {
+	pathfs.FileSystem
+	attrs map[string][]byte
+}
+
+func (fs *xattrRecorder) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	fs.attrs[name+"\x00"+attr] = data
+	return fuse.OK
+}
+
+func (fs *xattrRecorder) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	if v, ok := fs.attrs[name+"\x00"+attr]; ok {
+		return v, fuse.OK
+	}
+	return nil, fuse.ENOATTR
+}
+
+func (fs *xattrRecorder) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	if _, ok := fs.attrs[name+"\x00"+attr]; !ok {
+		return fuse.ENOATTR
+	}
+	delete(fs.attrs, name+"\x00"+attr)
+	return fuse.OK
+}
+
+// TestKernelAttrsBypassStore checks that the xattrs the kernel acts on
+// from the underlying inode go to it, even with their namespaces kept
+func TestKernelAttrsBypassStore(t *testing.T) {
+	x, dir := testFs(t)
+	keepNamespaces(t, "user", "system", "security")
+	touch(t, dir, "f")
+	under := &xattrRecorder{FileSystem: x.FileSystem, attrs: map[string][]byte{}}
+	x.FileSystem = under
+	for _, attr := range []string{"security.capability", "security.ima", "security.evm", "system.posix_acl_access", "system.posix_acl_default"} {
+		if code := x.SetXAttr("f", attr, []byte("v"), 0, nil); code != fuse.OK {
+			t.Fatalf("set %s: %v", attr, code)
+		}
+		if string(under.attrs["f\x00"+attr]) != "v" {
+			t.Errorf("%s did not reach the underlying file", attr)
+		}
+		if _, _, code := x.store.Get(pathKey("f"), attrKey(attr)); code != fuse.ENOATTR {
+			t.Errorf("%s stored: %v", attr, code)
+		}
+		wantX(t, x, "f", attr, "v")
+		if code := x.RemoveXAttr("f", attr, nil); code != fuse.OK {
+			t.Fatalf("remove %s: %v", attr, code)
+		}
+		if _, ok := under.attrs["f\x00"+attr]; ok {
+			t.Errorf("%s left on the underlying file after remove", attr)
+		}
+	}
+	// others of those namespaces are kept here
+	setX(t, x, "f", "security.label", "l")
+	if _, ok := under.attrs["f\x00security.label"]; ok {
+		t.Errorf("security.label reached the underlying file")
+	}
+	wantValue(t, x.store, pathKey("f"), "security.label", "l")
+}
+
+// TestLogLevel logs an op, an info line and an error at each -log-level,
+// and checks that only the levels that should log them do
+func TestLogLevel(t *testing.T) {
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	setX(t, x, "f", "user.a", "1")
+	defer func(l int) { logLevel = l; slog.Init(slog.Config{File: "STDERR"}) }(logLevel)
+	for _, tt := range []struct {
+		level     int
+		info, ops bool
+	}{
+		{levelError, false, false},
+		{levelInfo, true, false},
+		{levelDebug, true, true},
+	} {
+		filename := filepath.Join(t.TempDir(), "log")
+		logLevel = tt.level
+		slog.Init(slog.Config{File: filename, Debug: tt.level >= levelDebug})
+		wantX(t, x, "f", "user.a", "1")
+		infof("an info line")
+		fx := &xattrFs{FileSystem: x.FileSystem, root: x.root, store: failingStore{x.store, errors.New("disk on fire")}}
+		fx.SetXAttr("f", "user.b", []byte("1"), 0, nil)
+		slog.Init(slog.Config{File: "STDERR"})
+		out, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		log := string(out)
+		if !strings.Contains(log, "disk on fire") {
+			t.Errorf("level %d: error not logged in `%s'", tt.level, log)
+		}
+		if strings.Contains(log, "an info line") != tt.info {
+			t.Errorf("level %d: info logged is %v, want %v", tt.level, !tt.info, tt.info)
+		}
+		if strings.Contains(log, "user.a") != tt.ops {
+			t.Errorf("level %d: ops logged is %v, want %v", tt.level, !tt.ops, tt.ops)
+		}
+	}
+}
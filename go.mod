@@ -0,0 +1,10 @@
+module github.com/patrickhaller/go-xattr-fuse
+
+go 1.18
+
+require (
+	github.com/boltdb/bolt v1.3.1
+	github.com/hanwen/go-fuse v1.0.0
+)
+
+require golang.org/x/sys v0.0.0-20180830151530-49385e6e1522 // indirect
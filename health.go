@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/boltdb/bolt"
+	"github.com/patrickhaller/slog"
+)
+
+// mounted is whether the filesystem is mounted and serving requests
+var mounted = struct {
+	sync.Mutex
+	up bool
+}{}
+
+func setMounted(up bool) {
+	mounted.Lock()
+	defer mounted.Unlock()
+	mounted.up = up
+}
+
+// healthy reports why the mount is not healthy, or "" if it is: mounted,
+// and with a db a read transaction can be begun on
+func healthy() string {
+	mounted.Lock()
+	up := mounted.up
+	mounted.Unlock()
+	if !up {
+		return "not mounted"
+	}
+	if !holdDb() {
+		return "database closed"
+	}
+	defer releaseDb()
+	if err := db.View(func(tx *bolt.Tx) error { return nil }); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// writeHealth answers 200 while healthy and 503 otherwise
+func writeHealth(w http.ResponseWriter, r *http.Request) {
+	if why := healthy(); why != "" {
+		http.Error(w, why, http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// serveHealth serves writeHealth at addr's /healthz
+func serveHealth(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", writeHealth)
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.P("health server on `%s' failed: `%v'", addr, err)
+		}
+	}()
+	return srv
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// health returns the status and body /healthz answers now
+func health() (int, string) {
+	w := httptest.NewRecorder()
+	writeHealth(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	return w.Code, w.Body.String()
+}
+
+func TestHealth(t *testing.T) {
+	testFs(t)
+	defer setMounted(false)
+	if code, body := health(); code != http.StatusServiceUnavailable || !strings.Contains(body, "not mounted") {
+		t.Fatalf("before mount: %d `%s', want 503 not mounted", code, body)
+	}
+	setMounted(true)
+	if code, body := health(); code != http.StatusOK {
+		t.Fatalf("mounted: %d `%s', want 200", code, body)
+	}
+	closeDb()
+	if code, body := health(); code != http.StatusServiceUnavailable || !strings.Contains(body, "database closed") {
+		t.Fatalf("after close: %d `%s', want 503 database closed", code, body)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/patrickhaller/slog"
+)
+
+// With -history, getting attr+historySuffix returns a json array of the
+// earlier values of attr, oldest first.
+const historySuffix = ".history"
+
+// The earlier values of an attr are kept, as stored, in the nested
+// bucket historyBucket, under 8 big-endian bytes of unix nanoseconds.
+func historyBucket(key string) []byte {
+	return []byte("\x00history\x00" + key)
+}
+
+// historyBase returns the attr that attr gets the history of, if it is one
+func historyBase(attr string) (string, bool) {
+	if *historyLen <= 0 || !strings.HasSuffix(attr, historySuffix) {
+		return "", false
+	}
+	base := strings.TrimSuffix(attr, historySuffix)
+	return base, persisted(base)
+}
+
+// keepHistory saves the current value of key in b, if any, dropping the
+// oldest saved ones beyond -history
+func keepHistory(b *bolt.Bucket, key string) error {
+	old, err := getValue(b, key)
+	if err != nil || old == nil {
+		return err
+	}
+	h, err := b.CreateBucketIfNotExists(historyBucket(key))
+	if err != nil {
+		return err
+	}
+	ts := make([]byte, 8)
+	for now := time.Now().UnixNano(); ; now++ {
+		binary.BigEndian.PutUint64(ts, uint64(now))
+		if h.Get(ts) == nil {
+			break
+		}
+	}
+	if err := h.Put(ts, clone(old)); err != nil {
+		return err
+	}
+	var keys [][]byte
+	h.ForEach(func(k, v []byte) error {
+		keys = append(keys, k)
+		return nil
+	})
+	for len(keys) > *historyLen {
+		if err := h.Delete(keys[0]); err != nil {
+			return err
+		}
+		keys = keys[1:]
+	}
+	return nil
+}
+
+// boltHistory returns the earlier values of key in bucket, oldest first
+func boltHistory(bucket string, key string) ([][]byte, fuse.Status) {
+	defer observeTx(time.Now())
+	tx, b, _, code := boltBucket(bucket, false)
+	if tx == nil {
+		return nil, code
+	}
+	defer tx.Rollback()
+	if code == fuse.ENOENT {
+		return nil, fuse.ENOATTR
+	}
+	if code != fuse.OK {
+		return nil, code
+	}
+	h := b.Bucket(historyBucket(key))
+	if h == nil {
+		return nil, fuse.ENOATTR
+	}
+	var values [][]byte
+	err := h.ForEach(func(k, v []byte) error {
+		v, err := decodeValue(v)
+		values = append(values, clone(v))
+		return err
+	})
+	if err != nil {
+		slog.P("failed to decode history of `%s' attr `%s': `%v'", bucket, key, err)
+		return nil, fuse.EIO
+	}
+	return values, fuse.OK
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestHistory(t *testing.T) {
+	setFlag(t, "history", "2")
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	for _, v := range []string{"1", "2", "3"} {
+		if code := x.SetXAttr("f", "user.a", []byte(v), 0, nil); code != fuse.OK {
+			t.Fatalf("set `%s': %v", v, code)
+		}
+	}
+	if v, code := x.GetXAttr("f", "user.a", nil); code != fuse.OK || string(v) != "3" {
+		t.Fatalf("get = `%s', %v, want `3'", v, code)
+	}
+	out, code := x.GetXAttr("f", "user.a.history", nil)
+	if code != fuse.OK {
+		t.Fatalf("get history: %v", code)
+	}
+	var values [][]byte
+	if err := json.Unmarshal(out, &values); err != nil || len(values) != 2 || string(values[0]) != "1" || string(values[1]) != "2" {
+		t.Fatalf("history = %s, %v, want two earlier values, 1 and 2", out, err)
+	}
+	// removing the attr drops its history, and a later set starts afresh
+	if code := x.RemoveXAttr("f", "user.a", nil); code != fuse.OK {
+		t.Fatalf("remove: %v", code)
+	}
+	if _, code := x.GetXAttr("f", "user.a.history", nil); code != fuse.ENOATTR {
+		t.Fatalf("history after remove: %v, want ENOATTR", code)
+	}
+	if code := x.SetXAttr("f", "user.a.history", []byte("x"), 0, nil); code != fuse.EINVAL {
+		t.Fatalf("set of a history: %v, want EINVAL", code)
+	}
+}
+
+// wantHistory fails the test unless the history of attr of name is want
+func wantHistory(t *testing.T, x *xattrFs, name string, attr string, want ...string) {
+	t.Helper()
+	out, code := x.GetXAttr(name, attr+".history", nil)
+	if code != fuse.OK {
+		t.Fatalf("get history of `%s' attr `%s': %v", name, attr, code)
+	}
+	var values [][]byte
+	if err := json.Unmarshal(out, &values); err != nil {
+		t.Fatalf("history of `%s' attr `%s' = %s: %v", name, attr, out, err)
+	}
+	var got []string
+	for _, v := range values {
+		got = append(got, string(v))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("history of `%s' attr `%s' = %q, want %q", name, attr, got, want)
+	}
+}
+
+func TestRenameKeepsHistory(t *testing.T) {
+	setFlag(t, "history", "3")
+	setFlag(t, "preserve-order", "true")
+	setFlag(t, "ttl", "true")
+	setFlag(t, "max-value-size", strconv.Itoa(2*chunkSize))
+	x, dir := testFs(t)
+	for _, d := range []string{"d", "e"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	touch(t, dir, "d/f")
+	big := strings.Repeat("b", chunkSize+1)
+	setX(t, x, "d/f", "user.b", "b")
+	setX(t, x, "d/f", "user.b.ttl", "1h")
+	for _, v := range []string{"1", "2", "3"} {
+		setX(t, x, "d/f", "user.a", v)
+	}
+	setX(t, x, "d/f", "user.big", "old")
+	setX(t, x, "d/f", "user.big", big)
+
+	// the file itself, then the directory it is in
+	if code := x.Rename("d/f", "d/g", nil); code != fuse.OK {
+		t.Fatalf("rename: %v", code)
+	}
+	if code := x.Rename("d", "e/d", nil); code != fuse.OK {
+		t.Fatalf("rename of the directory: %v", code)
+	}
+	for _, gone := range []string{"d/f", "d/g"} {
+		wantNoX(t, x, gone, "user.a")
+		if _, code := x.GetXAttr(gone, "user.a.history", nil); code != fuse.ENOATTR {
+			t.Fatalf("history left at `%s': %v", gone, code)
+		}
+	}
+	name := "e/d/g"
+	wantX(t, x, name, "user.a", "3")
+	wantHistory(t, x, name, "user.a", "1", "2")
+	wantX(t, x, name, "user.big", big)
+	wantHistory(t, x, name, "user.big", "old")
+	if v, code := x.GetXAttr(name, "user.b.ttl", nil); code != fuse.OK || len(v) == 0 {
+		t.Fatalf("ttl after rename = `%s', %v", v, code)
+	}
+	if attrs, code := x.ListXAttr(name, nil); code != fuse.OK || !reflect.DeepEqual(attrs, []string{"user.b", "user.a", "user.big"}) {
+		t.Fatalf("list after rename = %q, %v, want the order set", attrs, code)
+	}
+	setX(t, x, name, "user.a", "4")
+	wantHistory(t, x, name, "user.a", "1", "2", "3")
+}
+
+// TestHistoryCollision sets an attr whose history bucket's name is taken
+// by a value, which bolt refuses as incompatible
+func TestHistoryCollision(t *testing.T) {
+	setFlag(t, "history", "2")
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	setX(t, x, "f", "user.a", "1")
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(pathKey("f")))
+		if err := b.DeleteBucket(historyBucket("user.a")); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		return b.Put(historyBucket("user.a"), []byte("not a bucket"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := x.SetXAttr("f", "user.a", []byte("2"), 0, nil); code != fuse.EINVAL {
+		t.Fatalf("set with its history bucket taken: %v, want EINVAL", code)
+	}
+	wantX(t, x, "f", "user.a", "1")
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+
+	"github.com/patrickhaller/slog"
+)
+
+// runHook runs the -on-change command for e in the background; the
+// template is split on whitespace, and in each word %p, %a, and %v
+// become the path, attr, and action, and %% a literal %
+func runHook(e *change) {
+	if *onChange == "" {
+		return
+	}
+	r := strings.NewReplacer("%%", "%", "%p", e.Path, "%a", e.Attr, "%v", e.Action)
+	words := strings.Fields(*onChange)
+	argv := make([]string, len(words))
+	for i, w := range words {
+		argv[i] = r.Replace(w)
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), *onChangeTimeout)
+		defer cancel()
+		out, err := exec.CommandContext(ctx, argv[0], argv[1:]...).CombinedOutput()
+		if ctx.Err() == context.DeadlineExceeded {
+			slog.P("on-change hook for `%s' timed out after %v", e.Path, *onChangeTimeout)
+		} else if err != nil {
+			slog.P("on-change hook for `%s' failed: %v: %s", e.Path, err, out)
+		}
+	}()
+}
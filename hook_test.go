@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// waitFile returns the contents of filename once it has n lines
+func waitFile(t *testing.T, filename string, n int) []string {
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		b, _ := ioutil.ReadFile(filename)
+		if lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n"); len(b) > 0 && len(lines) >= n {
+			return lines
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("`%s' has `%s', want %d lines", filename, b, n)
+		}
+	}
+}
+
+func TestOnChange(t *testing.T) {
+	x, dir := testFs(t)
+	hooks := t.TempDir()
+	out := filepath.Join(hooks, "out")
+	script := filepath.Join(hooks, "hook")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\nprintf '%s|' \"$@\" >> "+out+"\necho >> "+out+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, "on-change", script+" %p %a %v 100%%")
+	// no shell sees the path, so nothing in it is run
+	name := "a b;touch pwned"
+	touch(t, dir, name)
+	setX(t, x, name, "user.a", "1")
+	if got, want := waitFile(t, out, 1)[0], name+"|user.a|set|100%|"; got != want {
+		t.Fatalf("hook ran with `%s', want `%s'", got, want)
+	}
+
+	// a failing hook is logged, not passed on to the op
+	setFlag(t, "on-change", filepath.Join(hooks, "missing")+" %p")
+	if code := x.RemoveXAttr(name, "user.a", nil); code != fuse.OK {
+		t.Fatalf("remove with a failing hook: %v", code)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if lines := waitFile(t, out, 1); len(lines) != 1 {
+		t.Fatalf("hook ran again: %q", lines)
+	}
+}
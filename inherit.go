@@ -0,0 +1,77 @@
+package main
+
+import (
+	"path"
+	"strings"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/patrickhaller/slog"
+)
+
+// With -inherit-defaults, a stored NS.default.ATTR on a directory is set
+// as NS.ATTR on each file created in it; directories created in it also
+// get the NS.default.ATTR itself, so it carries on down the tree.
+const defaultInfix = "default."
+
+// defaultFor returns the attr that the default attr sets on new files,
+// if it is a default
+func defaultFor(attr string) (string, bool) {
+	i := strings.Index(attr, ".") + 1
+	if i == 0 || !strings.HasPrefix(attr[i:], defaultInfix) || len(attr) == i+len(defaultInfix) {
+		return "", false
+	}
+	return attr[:i] + attr[i+len(defaultInfix):], true
+}
+
+// inherit sets on the newly created name the defaults stored on
+// its directory
+func (x *xattrFs) inherit(name string, isDir bool, context *fuse.Context) {
+	if !holdDb() {
+		return
+	}
+	defer releaseDb()
+	dir := path.Dir(name)
+	if dir == "." {
+		dir = ""
+	}
+	parent, code := x.bucketName(dir)
+	if code != fuse.OK {
+		return
+	}
+	attrs := map[string][]byte{}
+	for _, ns := range namespaceList {
+		defs, code := x.store.List(parent, ns+"."+defaultInfix)
+		if code != fuse.OK {
+			slog.P("failed to list defaults of `%s': %v", dir, code)
+			return
+		}
+		for _, def := range defs {
+			attr, ok := defaultFor(def)
+			if !ok {
+				continue
+			}
+			v, _, code := x.store.Get(parent, attrKey(def))
+			if code == fuse.ENOATTR {
+				continue
+			}
+			if code != fuse.OK {
+				slog.P("failed to read default `%s' of `%s': %v", def, dir, code)
+				return
+			}
+			attrs[attr] = v
+			if isDir {
+				attrs[def] = v
+			}
+		}
+	}
+	if len(attrs) == 0 {
+		return
+	}
+	if code := x.setAttrs(name, attrs); code != fuse.OK {
+		slog.P("failed to inherit xattrs of `%s' on `%s': %v", dir, name, code)
+		return
+	}
+	for attr, v := range attrs {
+		changed(context, actionSet, name, attr, v)
+	}
+}
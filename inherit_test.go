@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestInheritDefaults(t *testing.T) {
+	x, dir := testFs(t)
+	setFlag(t, "inherit-defaults", "true")
+	if err := os.Mkdir(filepath.Join(dir, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	setX(t, x, "d", "user.default.color", "red")
+	setX(t, x, "d", "user.plain", "x")
+
+	f, code := x.Create("d/f", uint32(os.O_WRONLY), 0644, nil)
+	if code != fuse.OK {
+		t.Fatalf("create: %v", code)
+	}
+	if f != nil {
+		f.Release()
+	}
+	wantX(t, x, "d/f", "user.color", "red")
+	wantNoX(t, x, "d/f", "user.plain")
+	wantNoX(t, x, "d/f", "user.default.color")
+	if code := x.Mknod("d/n", syscall.S_IFIFO|0644, 0, nil); code != fuse.OK {
+		t.Fatalf("mknod: %v", code)
+	}
+	wantX(t, x, "d/n", "user.color", "red")
+
+	// subdirectories pass the defaults on
+	if code := x.Mkdir("d/sub", 0755, nil); code != fuse.OK {
+		t.Fatalf("mkdir: %v", code)
+	}
+	wantX(t, x, "d/sub", "user.color", "red")
+	wantX(t, x, "d/sub", "user.default.color", "red")
+	if code := x.Mknod("d/sub/n", syscall.S_IFIFO|0644, 0, nil); code != fuse.OK {
+		t.Fatalf("mknod: %v", code)
+	}
+	wantX(t, x, "d/sub/n", "user.color", "red")
+
+	setFlag(t, "inherit-defaults", "false")
+	if code := x.Mknod("d/off", syscall.S_IFIFO|0644, 0, nil); code != fuse.OK {
+		t.Fatalf("mknod: %v", code)
+	}
+	wantNoX(t, x, "d/off", "user.color")
+}
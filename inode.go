@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/boltdb/bolt"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/patrickhaller/slog"
+)
+
+// With -inode-keys, xattrs live in buckets named for the file's inode
+// rather than its path, so they follow renames and are shared by hard
+// links.  The pathIndex bucket maps each path to its inode bucket, for
+// fsck and for humans reading a dump.  Reserved bucket names start with
+// NUL, which no path can contain.
+const (
+	pathIndex   = "\x00paths"
+	inodePrefix = "\x00ino:"
+)
+
+// ownerKey, in an inode bucket, holds the path it was last indexed under,
+// by which to tell a file that reused the inode number of a deleted one
+const ownerKey = "\x00owner"
+
+func inodeKey(st *syscall.Stat_t) string {
+	return fmt.Sprintf("%s%d:%d", inodePrefix, st.Dev, st.Ino)
+}
+
+func (x *xattrFs) lstat(name string) (*syscall.Stat_t, fuse.Status) {
+	st := syscall.Stat_t{}
+	if err := syscall.Lstat(filepath.Join(x.root, name), &st); err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	return &st, fuse.OK
+}
+
+// bucketName returns the name of the bucket holding the xattrs of name
+func (x *xattrFs) bucketName(name string) (string, fuse.Status) {
+	if !*inodeKeys {
+		return pathKey(name), fuse.OK
+	}
+	st, code := x.lstat(name)
+	if code != fuse.OK {
+		return "", code
+	}
+	bucket := inodeKey(st)
+	if !*readOnly && x.reused(name, bucket, st) {
+		slog.P("`%s' reused the inode of a file deleted outside the mount, dropping its xattrs", name)
+		if code := x.store.Delete(bucket); code != fuse.OK {
+			return "", code
+		}
+	}
+	return bucket, fuse.OK
+}
+
+// lookupBucket returns the bucket of name as bucketName does, but for
+// readers that must not change the database: the xattrs of a reused inode
+// are not dropped, only not found
+func (x *xattrFs) lookupBucket(name string) (string, fuse.Status) {
+	if !*inodeKeys {
+		return pathKey(name), fuse.OK
+	}
+	st, code := x.lstat(name)
+	if code != fuse.OK {
+		return "", code
+	}
+	bucket := inodeKey(st)
+	if x.reused(name, bucket, st) {
+		return "", fuse.ENOENT
+	}
+	return bucket, fuse.OK
+}
+
+// reused reports whether bucket, the inode bucket of name, is that of an
+// earlier file with the same inode, deleted behind the mount's back: name
+// is not indexed to it, and the path that is no longer has its inode.
+// This cannot tell a file renamed outside the mount from a new one.
+func (x *xattrFs) reused(name string, bucket string, st *syscall.Stat_t) bool {
+	owner, code := x.store.Owner(name, bucket)
+	if code != fuse.OK || owner == "" {
+		return false
+	}
+	ost, code := x.lstat(owner)
+	return code != fuse.OK || ost.Dev != st.Dev || ost.Ino != st.Ino
+}
+
+// boltOwner returns the path bucket was last indexed under, or "" if
+// that is name, or name is indexed to bucket
+func boltOwner(name string, bucket string) (string, fuse.Status) {
+	tx, err := beginTx(false)
+	if err != nil {
+		return "", txStatus(err)
+	}
+	defer tx.Rollback()
+	key := pathKey(name)
+	if idx := tx.Bucket([]byte(pathIndex)); idx != nil && string(idx.Get([]byte(key))) == bucket {
+		return "", fuse.OK
+	}
+	b := tx.Bucket([]byte(bucket))
+	if b == nil {
+		return "", fuse.OK
+	}
+	owner := b.Get([]byte(ownerKey))
+	if owner == nil || string(owner) == key {
+		return "", fuse.OK
+	}
+	return keyPath(string(owner)), fuse.OK
+}
+
+// indexPath records that the xattrs of name are in bucket, and in bucket
+// that name is its owner
+func indexPath(tx *bolt.Tx, name string, bucket string) error {
+	key := pathKey(name)
+	if key == bucket {
+		return nil
+	}
+	idx, err := tx.CreateBucketIfNotExists([]byte(pathIndex))
+	if err != nil {
+		return err
+	}
+	if b := tx.Bucket([]byte(bucket)); b != nil {
+		if err := b.Put([]byte(ownerKey), []byte(key)); err != nil {
+			return err
+		}
+	}
+	return idx.Put([]byte(key), []byte(bucket))
+}
+
+// boltReindex points the index entries of oldName, and of everything
+// beneath it, at newName
+func boltReindex(oldName string, newName string) fuse.Status {
+	tx, err := beginTx(true)
+	if err != nil {
+		return txStatus(err)
+	}
+	defer tx.Rollback()
+	idx := tx.Bucket([]byte(pathIndex))
+	if idx == nil {
+		return fuse.OK
+	}
+	oldKey, newKey := pathKey(oldName), pathKey(newName)
+	moves := map[string][]byte{}
+	if v := idx.Get([]byte(oldKey)); v != nil {
+		moves[oldKey] = clone(v)
+	}
+	prefix := []byte(oldKey + "/")
+	c := idx.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		moves[string(k)] = clone(v)
+	}
+	if len(moves) == 0 {
+		return fuse.OK
+	}
+	for from, bucket := range moves {
+		to := newKey + from[len(oldKey):]
+		if err := idx.Delete([]byte(from)); err != nil {
+			slog.P("failed to unindex `%s': `%v'", from, err)
+			return fuse.EIO
+		}
+		if err := idx.Put([]byte(to), bucket); err != nil {
+			slog.P("failed to index `%s': `%v'", to, err)
+			return fuse.EIO
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		slog.P("commit failed on reindex `%s' -> `%s': `%v'", oldName, newName, err)
+		return fuse.EIO
+	}
+	return fuse.OK
+}
+
+// boltIndexLink gives newName the same index entry as oldName
+func boltIndexLink(oldName string, newName string) fuse.Status {
+	tx, err := beginTx(true)
+	if err != nil {
+		return txStatus(err)
+	}
+	defer tx.Rollback()
+	idx := tx.Bucket([]byte(pathIndex))
+	if idx == nil {
+		return fuse.OK
+	}
+	v := idx.Get([]byte(pathKey(oldName)))
+	if v == nil {
+		return fuse.OK
+	}
+	if err := idx.Put([]byte(pathKey(newName)), clone(v)); err != nil {
+		slog.P("failed to index `%s': `%v'", newName, err)
+		return fuse.EIO
+	}
+	if err := tx.Commit(); err != nil {
+		slog.P("commit failed on link `%s' -> `%s': `%v'", oldName, newName, err)
+		return fuse.EIO
+	}
+	return fuse.OK
+}
+
+// boltUnindex drops the index entry for a removed name, and bucket too,
+// unless "", as when the last link to it is gone
+func boltUnindex(name string, bucket string) fuse.Status {
+	tx, err := beginTx(true)
+	if err != nil {
+		return txStatus(err)
+	}
+	defer tx.Rollback()
+	if idx := tx.Bucket([]byte(pathIndex)); idx != nil {
+		if err := idx.Delete([]byte(pathKey(name))); err != nil {
+			slog.P("failed to unindex `%s': `%v'", name, err)
+			return fuse.EIO
+		}
+	}
+	if bucket != "" {
+		defer cache.forgetTree(bucket)
+		if err := tx.DeleteBucket([]byte(bucket)); err != nil && err != bolt.ErrBucketNotFound {
+			slog.P("failed to delete bucket for `%s': `%v'", name, err)
+			return fuse.EIO
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		slog.P("commit failed on unindex `%s': `%v'", name, err)
+		return fuse.EIO
+	}
+	return fuse.OK
+}
+
+// lastLink returns the inode bucket of a file with stat st, to drop with
+// its index entry once this link to it is gone, or "" while it has others
+func lastLink(st *syscall.Stat_t) string {
+	if st == nil || st.Nlink > 1 && st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return ""
+	}
+	return inodeKey(st)
+}
+
+// migrateToInodeKeys moves path-keyed buckets, as written without
+// -inode-keys, to the inode buckets of the files under root; buckets
+// whose file is gone are left for -fsck to report
+func migrateToInodeKeys(root string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		var paths []string
+		tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if !reserved(string(name)) {
+				paths = append(paths, string(name))
+			}
+			return nil
+		})
+		moved := 0
+		for _, name := range paths {
+			st := syscall.Stat_t{}
+			if err := syscall.Lstat(filepath.Join(root, keyPath(name)), &st); err != nil {
+				continue
+			}
+			bucket := inodeKey(&st)
+			if _, err := moveBucket(tx, name, bucket); err != nil {
+				return err
+			}
+			if err := indexPath(tx, keyPath(name), bucket); err != nil {
+				return err
+			}
+			moved++
+		}
+		if moved > 0 {
+			infof("migrated %d of %d path-keyed buckets to inode keys", moved, len(paths))
+		}
+		return nil
+	})
+}
+
+// reserved reports whether a bucket or key name is one of ours, rather
+// than a path or attr
+func reserved(name string) bool {
+	return strings.HasPrefix(name, "\x00")
+}
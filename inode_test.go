@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestInodeKeysRenameAndLink(t *testing.T) {
+	setFlag(t, "inode-keys", "true")
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	setX(t, x, "f", "user.a", "1")
+	if code := x.Rename("f", "g", nil); code != fuse.OK {
+		t.Fatalf("rename: %v", code)
+	}
+	wantX(t, x, "g", "user.a", "1")
+	// links share xattrs, both ways
+	if code := x.Link("g", "h", nil); code != fuse.OK {
+		t.Fatalf("link: %v", code)
+	}
+	wantX(t, x, "h", "user.a", "1")
+	setX(t, x, "h", "user.a", "2")
+	wantX(t, x, "g", "user.a", "2")
+	// a link renamed through the mount keeps them too
+	if code := x.Rename("h", "i", nil); code != fuse.OK {
+		t.Fatalf("rename of a link: %v", code)
+	}
+	wantX(t, x, "i", "user.a", "2")
+	bucket, _ := x.bucketName("i")
+	if code := x.Unlink("g", nil); code != fuse.OK {
+		t.Fatalf("unlink: %v", code)
+	}
+	wantX(t, x, "i", "user.a", "2")
+	if code := x.Unlink("i", nil); code != fuse.OK {
+		t.Fatalf("unlink of the last link: %v", code)
+	}
+	if _, _, code := x.store.Get(bucket, "user.a"); code != fuse.ENOATTR {
+		t.Fatalf("xattrs outlived the last link: %v", code)
+	}
+}
+
+func TestInodeKeysRenameDirectory(t *testing.T) {
+	setFlag(t, "inode-keys", "true")
+	x, dir := testFs(t)
+	if err := os.Mkdir(filepath.Join(dir, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, dir, "d/f")
+	setX(t, x, "d", "user.a", "d")
+	setX(t, x, "d/f", "user.a", "f")
+	if code := x.Rename("d", "e", nil); code != fuse.OK {
+		t.Fatalf("rename: %v", code)
+	}
+	// the index follows, so the files are not taken for reused inodes
+	wantX(t, x, "e/f", "user.a", "f")
+	wantX(t, x, "e", "user.a", "d")
+}
+
+func TestMigrateToInodeKeys(t *testing.T) {
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	touch(t, dir, "a\nb")
+	setX(t, x, "f", "user.a", "1")
+	setX(t, x, "a\nb", "user.a", "2")
+	setX(t, x, "gone", "user.a", "3")
+	setFlag(t, "inode-keys", "true")
+	if err := migrateToInodeKeys(dir); err != nil {
+		t.Fatal(err)
+	}
+	wantX(t, x, "f", "user.a", "1")
+	wantX(t, x, "a\nb", "user.a", "2")
+	if bucket, _ := x.bucketName("f"); bucket == pathKey("f") {
+		t.Fatalf("f still keyed by path")
+	}
+	// one whose file is gone is left, for -fsck
+	wantValue(t, x.store, pathKey("gone"), "user.a", "3")
+}
+
+func TestInodeReused(t *testing.T) {
+	setFlag(t, "inode-keys", "true")
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	setX(t, x, "f", "user.a", "1")
+	// renamed outside the mount, f looks the same as a new file that
+	// reused a deleted one's inode, and starts with none
+	if err := os.Rename(filepath.Join(dir, "f"), filepath.Join(dir, "g")); err != nil {
+		t.Fatal(err)
+	}
+	wantNoX(t, x, "g", "user.a")
+	setX(t, x, "g", "user.b", "2")
+	wantX(t, x, "g", "user.b", "2")
+}
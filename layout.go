@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/patrickhaller/slog"
+)
+
+// With -layout namespaced, xattrs are kept by namespace first: a
+// top-level bucket per namespace, from nsBucket, holding a bucket per
+// file, named as bucketName gives, holding its attrs in that namespace as
+// a flat layout bucket would.  Listing or wiping one namespace then only
+// touches that namespace's buckets.  The layout of a database is kept
+// under layoutKey in metaBucket, flat if unset.
+const (
+	layoutFlat       = "flat"
+	layoutNamespaced = "namespaced"
+	layoutKey        = "layout"
+	nsPrefix         = "\x00ns\x00"
+)
+
+func nsBucket(ns string) []byte {
+	return []byte(nsPrefix + ns)
+}
+
+// namespace returns the namespace of attr, or of its key
+func namespace(attr string) string {
+	return strings.SplitN(attr, ".", 2)[0]
+}
+
+// nsStore is the Store of the bolt db in the namespaced layout; it has
+// no ttls, history, or inode index
+type nsStore struct{}
+
+// nsFile returns the bucket of the file whose bucket name is bucket, in
+// the namespace of key, or nil if there is none
+func nsFile(tx *bolt.Tx, bucket string, key string) *bolt.Bucket {
+	nb := tx.Bucket(nsBucket(namespace(key)))
+	if nb == nil {
+		return nil
+	}
+	return nb.Bucket([]byte(bucket))
+}
+
+// nsCountAttrs returns the number of attrs of bucket across namespaces
+func nsCountAttrs(tx *bolt.Tx, bucket string) int {
+	n := 0
+	c := tx.Cursor()
+	for k, _ := c.Seek([]byte(nsPrefix)); k != nil && bytes.HasPrefix(k, []byte(nsPrefix)); k, _ = c.Next() {
+		if b := tx.Bucket(k).Bucket([]byte(bucket)); b != nil {
+			n += countAttrs(b)
+		}
+	}
+	return n
+}
+
+func (nsStore) Set(name string, bucket string, attrs map[string][]byte) error {
+	values := map[string][]byte{}
+	for attr, data := range attrs {
+		v, err := encodeValue(data)
+		if err != nil {
+			return fmt.Errorf("failed to encode `%s': %v", attr, err)
+		}
+		values[attr] = v
+	}
+	// Batch may rerun this, so it must only touch tx
+	start := time.Now()
+	err := db.Batch(func(tx *bolt.Tx) error {
+		if *maxDbBytes > 0 && tx.Size() >= *maxDbBytes {
+			return errDbFull
+		}
+		for attr, v := range values {
+			nb, err := tx.CreateBucketIfNotExists(nsBucket(namespace(attr)))
+			if err != nil {
+				return err
+			}
+			b, err := nb.CreateBucketIfNotExists([]byte(bucket))
+			if err != nil {
+				return err
+			}
+			key := attrKey(attr)
+			if *maxAttrs > 0 && b.Get([]byte(key)) == nil && nsCountAttrs(tx, bucket) >= *maxAttrs {
+				return errTooManyAttrs
+			}
+			if err := putSeq(b, key); err != nil {
+				return err
+			}
+			if err := putValue(b, key, v); err != nil {
+				return err
+			}
+			if err := putCase(b, key, attr); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	observeTx(start)
+	return err
+}
+
+func (nsStore) Get(bucket string, key string) ([]byte, time.Time, fuse.Status) {
+	defer observeTx(time.Now())
+	tx, err := beginTx(false)
+	if err != nil {
+		return nil, time.Time{}, txStatus(err)
+	}
+	defer tx.Rollback()
+	b := nsFile(tx, bucket, key)
+	if b == nil {
+		return nil, time.Time{}, fuse.ENOATTR
+	}
+	return readValue(b, bucket, key)
+}
+
+// List lists from the one namespace prefix names, or if prefix has no
+// dot, from each whose name it starts, in the order of their names
+func (nsStore) List(bucket string, prefix string) ([]string, fuse.Status) {
+	defer observeTx(time.Now())
+	tx, err := beginTx(false)
+	if err != nil {
+		return nil, txStatus(err)
+	}
+	defer tx.Rollback()
+	if strings.Contains(prefix, ".") {
+		b := nsFile(tx, bucket, prefix)
+		if b == nil {
+			return nil, fuse.OK
+		}
+		return listKeys(b, b.Cursor(), prefix), fuse.OK
+	}
+	var lis []string
+	for _, ns := range nsNames(tx) {
+		if !strings.HasPrefix(string(ns[len(nsPrefix):]), prefix) {
+			continue
+		}
+		if b := tx.Bucket(ns).Bucket([]byte(bucket)); b != nil {
+			lis = append(lis, listKeys(b, b.Cursor(), prefix)...)
+		}
+	}
+	return lis, fuse.OK
+}
+
+func (nsStore) Remove(bucket string, key string) (code fuse.Status) {
+	// Batch may rerun this, so it must only touch tx and code
+	start := time.Now()
+	err := db.Batch(func(tx *bolt.Tx) error {
+		b := nsFile(tx, bucket, key)
+		if b == nil || b.Get([]byte(key)) == nil {
+			code = fuse.ENOATTR
+			return nil
+		}
+		code = fuse.OK
+		return deleteValue(b, key)
+	})
+	observeTx(start)
+	if err == bolt.ErrDatabaseNotOpen {
+		return shutdown
+	}
+	if err != nil {
+		slog.P("removexattr failed on `%s' attr `%s': `%v'", bucket, key, err)
+		return fuse.EIO
+	}
+	return code
+}
+
+func (nsStore) Rename(bucket string, newBucket string) fuse.Status {
+	defer cache.forgetTree(bucket)
+	defer cache.forgetTree(newBucket)
+	return nsUpdate("rename", bucket, func(nb *bolt.Bucket) (bool, error) {
+		return renameTree(nb, bucket, newBucket)
+	})
+}
+
+func (nsStore) Copy(bucket string, newBucket string) fuse.Status {
+	defer cache.forgetTree(newBucket)
+	return nsUpdate("copy", bucket, func(nb *bolt.Bucket) (bool, error) {
+		return copyBucket(nb, bucket, newBucket)
+	})
+}
+
+func (nsStore) Delete(bucket string) fuse.Status {
+	defer cache.forgetTree(bucket)
+	return nsUpdate("delete", bucket, func(nb *bolt.Bucket) (bool, error) {
+		err := nb.DeleteBucket([]byte(bucket))
+		if err == bolt.ErrBucketNotFound {
+			return false, nil
+		}
+		return err == nil, err
+	})
+}
+
+// main refuses the flags that would use these with the namespaced layout
+
+func (nsStore) SetExpiry(bucket string, key string, t time.Time) fuse.Status {
+	return fuse.ENOSYS
+}
+
+func (nsStore) History(bucket string, key string) ([][]byte, fuse.Status) {
+	return nil, fuse.ENOSYS
+}
+
+func (nsStore) Size() (int64, fuse.Status) {
+	return boltStore{}.Size()
+}
+
+func (nsStore) Owner(name string, bucket string) (string, fuse.Status) {
+	return "", fuse.OK
+}
+
+func (nsStore) IndexLink(name string, newName string) fuse.Status {
+	return fuse.ENOSYS
+}
+
+func (nsStore) Reindex(name string, newName string) fuse.Status {
+	return fuse.ENOSYS
+}
+
+func (nsStore) Unindex(name string, bucket string) fuse.Status {
+	return fuse.ENOSYS
+}
+
+// nsUpdate runs f on every namespace bucket in one transaction, which it
+// commits if f reports changing any
+func nsUpdate(op string, bucket string, f func(nb *bolt.Bucket) (bool, error)) fuse.Status {
+	tx, err := beginTx(true)
+	if err != nil {
+		return txStatus(err)
+	}
+	defer tx.Rollback()
+	changed := false
+	for _, ns := range nsNames(tx) {
+		ch, err := f(tx.Bucket(ns))
+		if err != nil {
+			slog.P("failed to %s `%s' in `%s': `%v'", op, bucket, ns[len(nsPrefix):], err)
+			return fuse.EIO
+		}
+		changed = changed || ch
+	}
+	if !changed {
+		return fuse.OK
+	}
+	if err := tx.Commit(); err != nil {
+		slog.P("commit failed on %s `%s': `%v'", op, bucket, err)
+		return fuse.EIO
+	}
+	return fuse.OK
+}
+
+// nsNames returns the names of the namespace buckets in tx
+func nsNames(tx *bolt.Tx) [][]byte {
+	var names [][]byte
+	c := tx.Cursor()
+	for k, _ := c.Seek([]byte(nsPrefix)); k != nil && bytes.HasPrefix(k, []byte(nsPrefix)); k, _ = c.Next() {
+		names = append(names, clone(k))
+	}
+	return names
+}
+
+// dbLayout returns the layout of the database of tx
+func dbLayout(tx *bolt.Tx) string {
+	if meta := tx.Bucket([]byte(metaBucket)); meta != nil {
+		if l := meta.Get([]byte(layoutKey)); l != nil {
+			return string(l)
+		}
+	}
+	return layoutFlat
+}
+
+// openFlatDb opens the database at filename as openFlatInput does,
+// escaping its paths if they are from before that, or if readOnly,
+// failing as the offline tools do not read such paths
+func openFlatDb(filename string, readOnly bool) (*bolt.DB, error) {
+	d, err := openFlatInput(filename, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	if !readOnly {
+		err = escapePaths(d)
+	} else {
+		err = d.View(func(tx *bolt.Tx) error {
+			if names, keys := unescapedPaths(tx); len(names)+len(keys) > 0 {
+				return errUnescaped
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// openFlatInput opens the database at filename as openDb does, failing
+// for one of the namespaced layout, which the offline tools do not read;
+// its paths are left as stored, escaped or not
+func openFlatInput(filename string, readOnly bool) (*bolt.DB, error) {
+	d, err := openDb(filename, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	err = d.View(func(tx *bolt.Tx) error {
+		if l := dbLayout(tx); l != layoutFlat {
+			return fmt.Errorf("database has the %s layout; mount it once without -layout to convert it back", l)
+		}
+		return nil
+	})
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// setLayout converts the database d to layout, if it has another
+func setLayout(d *bolt.DB, layout string) error {
+	converted := false
+	err := d.Update(func(tx *bolt.Tx) error {
+		converted = false
+		if dbLayout(tx) == layout {
+			return nil
+		}
+		var err error
+		if layout == layoutNamespaced {
+			err = toNamespaced(tx)
+		} else {
+			err = toFlat(tx)
+		}
+		if err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+		if err != nil {
+			return err
+		}
+		converted = true
+		return meta.Put([]byte(layoutKey), []byte(layout))
+	})
+	if converted && err == nil {
+		infof("converted database to the %s layout", layout)
+	}
+	return err
+}
+
+// attrKeys returns the keys of the attrs stored in b
+func attrKeys(b *bolt.Bucket) []string {
+	var keys []string
+	b.ForEach(func(k, v []byte) error {
+		if v != nil && !reserved(string(k)) {
+			keys = append(keys, string(k))
+		}
+		return nil
+	})
+	return keys
+}
+
+// toNamespaced moves the attrs of each path-keyed file bucket to the
+// buckets of the file in their namespaces
+func toNamespaced(tx *bolt.Tx) error {
+	var names []string
+	tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if !reserved(string(name)) {
+			names = append(names, string(name))
+		}
+		return nil
+	})
+	for _, name := range names {
+		b := tx.Bucket([]byte(name))
+		for _, k := range attrKeys(b) {
+			nb, err := tx.CreateBucketIfNotExists(nsBucket(namespace(k)))
+			if err != nil {
+				return err
+			}
+			fb, err := nb.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+			if _, _, err := mergeAttr(fb, b, k, lastWins); err != nil {
+				return fmt.Errorf("`%s' attr `%s': %v", keyPath(name), k, err)
+			}
+		}
+		if err := tx.DeleteBucket([]byte(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// toFlat moves the attrs of every file in every namespace bucket back
+// to the file's own bucket
+func toFlat(tx *bolt.Tx) error {
+	for _, ns := range nsNames(tx) {
+		nb := tx.Bucket(ns)
+		var names []string
+		nb.ForEach(func(k, v []byte) error {
+			if v == nil {
+				names = append(names, string(k))
+			}
+			return nil
+		})
+		for _, name := range names {
+			sub := nb.Bucket([]byte(name))
+			fb, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+			for _, k := range attrKeys(sub) {
+				if _, _, err := mergeAttr(fb, sub, k, lastWins); err != nil {
+					return fmt.Errorf("`%s' attr `%s': %v", keyPath(name), k, err)
+				}
+			}
+		}
+		if err := tx.DeleteBucket(ns); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestLayoutKeepsOrder(t *testing.T) {
+	testDb(t)
+	setFlag(t, "preserve-order", "true")
+	for _, attr := range []string{"user.c", "user.a", "trusted.z", "user.b"} {
+		mustSet(t, boltStore{}, "f", attr, "v")
+	}
+	if err := setLayout(db, layoutNamespaced); err != nil {
+		t.Fatal(err)
+	}
+	wantList(t, nsStore{}, "f", "user.", "user.c", "user.a", "user.b")
+	wantList(t, nsStore{}, "f", "trusted.", "trusted.z")
+	mustSet(t, nsStore{}, "f", "user.d", "v")
+	wantList(t, nsStore{}, "f", "user.", "user.c", "user.a", "user.b", "user.d")
+	if err := setLayout(db, layoutFlat); err != nil {
+		t.Fatal(err)
+	}
+	wantList(t, boltStore{}, "f", "user.", "user.c", "user.a", "user.b", "user.d")
+	mustSet(t, boltStore{}, "f", "user.e", "v")
+	wantList(t, boltStore{}, "f", "user.", "user.c", "user.a", "user.b", "user.d", "user.e")
+	wantValue(t, boltStore{}, "f", "user.a", "v")
+}
+
+// TestLayoutNamespaced converts a database to the namespaced layout and
+// back, checking that xattrs set before, through it, and after survive,
+// each in its namespace's bucket while namespaced
+func TestLayoutNamespaced(t *testing.T) {
+	x, dir := testFs(t)
+	keepNamespaces(t, "user", "trusted")
+	touch(t, dir, "f")
+	touch(t, dir, "g")
+	setX(t, x, "f", "user.a", "1")
+	setX(t, x, "f", "trusted.b", "2")
+	setX(t, x, "g", "user.a", "3")
+	if err := setLayout(db, layoutNamespaced); err != nil {
+		t.Fatal(err)
+	}
+	x.store = nsStore{}
+	err := db.View(func(tx *bolt.Tx) error {
+		if l := dbLayout(tx); l != layoutNamespaced {
+			t.Errorf("layout %s after converting", l)
+		}
+		if tx.Bucket([]byte(pathKey("f"))) != nil {
+			t.Errorf("flat bucket of f left after converting")
+		}
+		if b := nsFile(tx, pathKey("f"), "trusted.b"); b == nil || b.Get([]byte("user.a")) != nil {
+			t.Errorf("trusted bucket of f missing, or holding user.a")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantX(t, x, "f", "user.a", "1")
+	wantX(t, x, "f", "trusted.b", "2")
+	wantX(t, x, "g", "user.a", "3")
+	setX(t, x, "f", "user.c", "4")
+	if code := x.RemoveXAttr("g", "user.a", nil); code != fuse.OK {
+		t.Fatalf("remove: %v", code)
+	}
+	want := []string{"user.a", "user.c", "trusted.b"}
+	if attrs, code := x.ListXAttr("f", nil); code != fuse.OK || !reflect.DeepEqual(attrs, want) {
+		t.Fatalf("list = %q, %v, want %q", attrs, code, want)
+	}
+	// converting twice changes nothing
+	if err := setLayout(db, layoutNamespaced); err != nil {
+		t.Fatal(err)
+	}
+	if err := setLayout(db, layoutFlat); err != nil {
+		t.Fatal(err)
+	}
+	x.store = boltStore{}
+	cache.forgetTree(pathKey("f"))
+	cache.forgetTree(pathKey("g"))
+	if attrs, code := x.ListXAttr("f", nil); code != fuse.OK || !reflect.DeepEqual(attrs, want) {
+		t.Fatalf("list after converting back = %q, %v", attrs, code)
+	}
+	wantX(t, x, "f", "user.c", "4")
+	wantNoX(t, x, "g", "user.a")
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// -conflict policies, for when -merge finds an xattr set differently in
+// two databases
+const (
+	lastWins       = "last-wins"
+	firstWins      = "first-wins"
+	failOnConflict = "error"
+)
+
+// mergeDbs copies the xattrs of each database in inputs, in order, into
+// the database at filename, one transaction per input, and writes to w
+// how many were merged and how many conflicted
+func mergeDbs(filename string, inputs []string, policy string, w io.Writer) error {
+	switch policy {
+	case lastWins, firstWins, failOnConflict:
+	default:
+		return fmt.Errorf("unknown conflict policy `%s'", policy)
+	}
+	dst, err := openFlatDb(filename, false)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	err = dst.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(pathIndex)) != nil {
+			return fmt.Errorf("`%s' is keyed by inode, and merging into it would need the inodes of the files", filename)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, input := range inputs {
+		src, err := openFlatInput(input, true)
+		if err != nil {
+			return err
+		}
+		var merged, conflicts int
+		err = src.View(func(stx *bolt.Tx) error {
+			// an input from before paths were escaped has its own
+			// escaped as they are merged
+			escaped := pathsEscaped(stx)
+			return dst.Update(func(dtx *bolt.Tx) error {
+				merged, conflicts = 0, 0
+				mergeBucket := func(name []byte, b *bolt.Bucket) error {
+					nb, err := dtx.CreateBucketIfNotExists(name)
+					if err != nil {
+						return err
+					}
+					return b.ForEach(func(k, v []byte) error {
+						if v == nil || reserved(string(k)) {
+							return nil
+						}
+						took, conflict, err := mergeAttr(nb, b, string(k), policy)
+						if err != nil {
+							return fmt.Errorf("`%s' attr `%s': %v", keyPath(string(name)), k, err)
+						}
+						if took {
+							merged++
+						}
+						if conflict {
+							conflicts++
+						}
+						return nil
+					})
+				}
+				err := stx.ForEach(func(name []byte, b *bolt.Bucket) error {
+					if n := string(name); n == metaBucket || n == pathIndex || strings.HasPrefix(n, inodePrefix) {
+						return nil
+					} else if !escaped && !reserved(n) {
+						name = []byte(pathKey(n))
+					}
+					return mergeBucket(name, b)
+				})
+				if err != nil {
+					return err
+				}
+				// an -inode-keys input is merged by path, through its
+				// index, as inode numbers mean nothing elsewhere
+				idx := stx.Bucket([]byte(pathIndex))
+				if idx == nil {
+					return nil
+				}
+				return idx.ForEach(func(k, v []byte) error {
+					b := stx.Bucket(v)
+					if b == nil {
+						return nil
+					}
+					if !escaped {
+						k = []byte(pathKey(string(k)))
+					}
+					return mergeBucket(k, b)
+				})
+			})
+		})
+		src.Close()
+		if err != nil {
+			return fmt.Errorf("merging `%s': %v", input, err)
+		}
+		fmt.Fprintf(w, "%s: merged %d xattrs, %d conflicts\n", input, merged, conflicts)
+	}
+	return nil
+}
+
+// sameValue reports whether the stored values a and b hold the same
+// value, however each was encoded; any that cannot be decoded, as for
+// want of a key, are compared as stored
+func sameValue(a []byte, b []byte) bool {
+	av, aerr := decodeValue(a)
+	bv, berr := decodeValue(b)
+	if aerr != nil || berr != nil {
+		return bytes.Equal(a, b)
+	}
+	return bytes.Equal(av, bv)
+}
+
+// mergeAttr copies attr from src to dst as policy says, along with the
+// reserved keys and history that go with it, reporting whether it was copied and
+// whether it conflicted with a different value already in dst
+func mergeAttr(dst *bolt.Bucket, src *bolt.Bucket, attr string, policy string) (bool, bool, error) {
+	v, err := getValue(src, attr)
+	if err != nil {
+		return false, false, err
+	}
+	old, err := getValue(dst, attr)
+	if err != nil {
+		return false, false, err
+	}
+	conflict := old != nil && !sameValue(old, v)
+	if old != nil && !conflict {
+		return false, false, nil
+	}
+	if conflict && policy == firstWins {
+		return false, true, nil
+	}
+	if conflict && policy == failOnConflict {
+		return false, true, fmt.Errorf("set differently in an earlier database")
+	}
+	if err := putValue(dst, attr, clone(v)); err != nil {
+		return false, conflict, err
+	}
+	for _, k := range [][]byte{caseKey(attr), expiryKey(attr), seqKey(attr)} {
+		if cv := src.Get(k); cv != nil {
+			err = dst.Put(k, clone(cv))
+		} else {
+			err = deleteKey(dst, k)
+		}
+		if err != nil {
+			return false, conflict, err
+		}
+	}
+	// attrs set later in dst are numbered after those it takes from src
+	if n := seqOf(src, []byte(attr)); n > dst.Sequence() {
+		if err := dst.SetSequence(n); err != nil {
+			return false, conflict, err
+		}
+	}
+	// the history goes along with the value it leads up to
+	if err := dst.DeleteBucket(historyBucket(attr)); err != nil && err != bolt.ErrBucketNotFound {
+		return false, conflict, err
+	}
+	if h := src.Bucket(historyBucket(attr)); h != nil {
+		nh, err := dst.CreateBucket(historyBucket(attr))
+		if err != nil {
+			return false, conflict, err
+		}
+		if err := cloneBucket(nh, h); err != nil {
+			return false, conflict, err
+		}
+	}
+	return true, conflict, nil
+}
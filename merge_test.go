@@ -0,0 +1,186 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// files are the attrs of paths, to write to a test database
+type files map[string]map[string]string
+
+// writeDb writes a database of fs in a temporary directory, with its
+// paths escaped unless it is to look as from before they were
+func writeDb(t *testing.T, escaped bool, fs files) string {
+	filename := filepath.Join(t.TempDir(), "xattrs.db")
+	d, err := openDb(filename, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if escaped {
+		if err := escapePaths(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = d.Update(func(tx *bolt.Tx) error {
+		for name, attrs := range fs {
+			if escaped {
+				name = pathKey(name)
+			}
+			b, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+			for attr, v := range attrs {
+				ev, err := encodeValue([]byte(v))
+				if err != nil {
+					return err
+				}
+				if err := putValue(b, attr, ev); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// readDb returns the attrs stored in the database at filename, by path
+func readDb(t *testing.T, filename string) files {
+	d, err := openDb(filename, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	fs := files{}
+	err = d.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if reserved(string(name)) {
+				return nil
+			}
+			attrs := map[string]string{}
+			for _, k := range attrKeys(b) {
+				v, err := getValue(b, k)
+				if err != nil {
+					return err
+				}
+				if v, err = decodeValue(v); err != nil {
+					return err
+				}
+				attrs[k] = string(v)
+			}
+			fs[keyPath(string(name))] = attrs
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func TestMergeConflicts(t *testing.T) {
+	for _, tt := range []struct {
+		policy string
+		want   string
+		fail   bool
+	}{
+		{lastWins, "2", false},
+		{firstWins, "1", false},
+		{failOnConflict, "1", true},
+	} {
+		t.Run(tt.policy, func(t *testing.T) {
+			a := writeDb(t, true, files{"f": {"user.x": "1", "user.a": "a"}})
+			b := writeDb(t, true, files{"f": {"user.x": "2", "user.b": "b"}, "g": {"user.y": "y"}})
+			dst := filepath.Join(t.TempDir(), "merged.db")
+			err := mergeDbs(dst, []string{a, b}, tt.policy, ioutil.Discard)
+			if (err != nil) != tt.fail {
+				t.Fatalf("merge: %v, want failure %v", err, tt.fail)
+			}
+			got := readDb(t, dst)
+			if got["f"]["user.x"] != tt.want || got["f"]["user.a"] != "a" {
+				t.Fatalf("merged f = %v, want user.x %s, and user.a", got["f"], tt.want)
+			}
+			if tt.fail {
+				if len(got) != 1 {
+					t.Fatalf("failed merge left %v, want only the first input", got)
+				}
+			} else if got["f"]["user.b"] != "b" || got["g"]["user.y"] != "y" {
+				t.Fatalf("merged %v, want all of the second input", got)
+			}
+		})
+	}
+	if err := mergeDbs(filepath.Join(t.TempDir(), "merged.db"), nil, "most-wins", ioutil.Discard); err == nil {
+		t.Fatalf("merge with an unknown policy succeeded")
+	}
+}
+
+func TestMergeEncodings(t *testing.T) {
+	a := writeDb(t, true, files{"f": {"user.x": "1"}})
+	setFlag(t, "checksum", "true")
+	b := writeDb(t, true, files{"f": {"user.x": "1"}})
+	dst := filepath.Join(t.TempDir(), "merged.db")
+	if err := mergeDbs(dst, []string{a, b}, failOnConflict, ioutil.Discard); err != nil {
+		t.Fatalf("merging one value, plain and checksummed: %v", err)
+	}
+}
+
+func TestMergeUnescaped(t *testing.T) {
+	old := writeDb(t, false, files{"a\nb": {"user.x": "1"}, "%41": {"user.y": "2"}})
+	dst := filepath.Join(t.TempDir(), "merged.db")
+	if err := mergeDbs(dst, []string{old}, lastWins, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	got := readDb(t, dst)
+	if got["a\nb"]["user.x"] != "1" || got["%41"]["user.y"] != "2" || len(got) != 2 {
+		t.Fatalf("merged %q, want the paths as they were", got)
+	}
+}
+
+func TestMergeInodeKeyed(t *testing.T) {
+	setFlag(t, "inode-keys", "true")
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	setX(t, x, "f", "user.a", "1")
+	if code := x.Link("f", "a\nb", nil); code != fuse.OK {
+		t.Fatalf("link: %v", code)
+	}
+	input := db.Path()
+	closeDb()
+
+	dst := writeDb(t, true, files{"f": {"user.b": "2"}})
+	if err := mergeDbs(dst, []string{input}, lastWins, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	got := readDb(t, dst)
+	if len(got) != 2 || got["f"]["user.a"] != "1" || got["f"]["user.b"] != "2" || got["a\nb"]["user.a"] != "1" {
+		t.Fatalf("merged %q, want the inode's xattrs under each of its paths", got)
+	}
+	d, err := openDb(dst, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	d.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if strings.HasPrefix(string(name), inodePrefix) || string(name) == pathIndex {
+				t.Errorf("merged the input's `%q' bucket as is", name)
+			}
+			return nil
+		})
+	})
+
+	// nor can anything be merged into one
+	if err := mergeDbs(input, []string{dst}, lastWins, ioutil.Discard); err == nil {
+		t.Fatal("merged into an -inode-keys database")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/patrickhaller/slog"
+)
+
+// txBounds are the upper bounds, in seconds, of the transaction
+// duration histogram buckets
+var txBounds = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1}
+
+// metrics counts xattr operations for -metrics-addr, in the prometheus
+// text format
+var metrics = struct {
+	sync.Mutex
+	calls   map[string]uint64
+	errors  map[[2]string]uint64
+	txCount []uint64
+	txSum   float64
+}{
+	calls:   map[string]uint64{},
+	errors:  map[[2]string]uint64{},
+	txCount: make([]uint64, len(txBounds)+1),
+}
+
+func countOp(op string, code fuse.Status) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.calls[op]++
+	if code != fuse.OK {
+		metrics.errors[[2]string{op, code.String()}]++
+	}
+}
+
+// observeTx records a bolt transaction begun at start; defer it
+func observeTx(start time.Time) {
+	d := time.Since(start).Seconds()
+	i := sort.SearchFloat64s(txBounds, d)
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.txCount[i]++
+	metrics.txSum += d
+}
+
+func writeMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP xattrfs_ops_total xattr operations handled.")
+	fmt.Fprintln(w, "# TYPE xattrfs_ops_total counter")
+	ops := []string{}
+	for op := range metrics.calls {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		fmt.Fprintf(w, "xattrfs_ops_total{op=%q} %d\n", op, metrics.calls[op])
+	}
+
+	fmt.Fprintln(w, "# HELP xattrfs_op_errors_total xattr operations that failed, by status.")
+	fmt.Fprintln(w, "# TYPE xattrfs_op_errors_total counter")
+	errs := [][2]string{}
+	for k := range metrics.errors {
+		errs = append(errs, k)
+	}
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i][0] < errs[j][0] || errs[i][0] == errs[j][0] && errs[i][1] < errs[j][1]
+	})
+	for _, k := range errs {
+		fmt.Fprintf(w, "xattrfs_op_errors_total{op=%q,status=%q} %d\n", k[0], k[1], metrics.errors[k])
+	}
+
+	fmt.Fprintln(w, "# HELP xattrfs_tx_duration_seconds Duration of bolt transactions.")
+	fmt.Fprintln(w, "# TYPE xattrfs_tx_duration_seconds histogram")
+	var n uint64
+	for i, bound := range txBounds {
+		n += metrics.txCount[i]
+		fmt.Fprintf(w, "xattrfs_tx_duration_seconds_bucket{le=%q} %d\n", strconv.FormatFloat(bound, 'g', -1, 64), n)
+	}
+	n += metrics.txCount[len(txBounds)]
+	fmt.Fprintf(w, "xattrfs_tx_duration_seconds_bucket{le=\"+Inf\"} %d\n", n)
+	fmt.Fprintf(w, "xattrfs_tx_duration_seconds_sum %g\n", metrics.txSum)
+	fmt.Fprintf(w, "xattrfs_tx_duration_seconds_count %d\n", n)
+}
+
+// serveMetrics starts serving /metrics on addr
+func serveMetrics(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", writeMetrics)
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.P("metrics server on `%s' failed: `%v'", addr, err)
+		}
+	}()
+	return srv
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// metricValue returns the value of the sample line starting with prefix
+// in the metrics served now, or 0 if there is none
+func metricValue(t *testing.T, prefix string) float64 {
+	w := httptest.NewRecorder()
+	writeMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if strings.HasPrefix(line, prefix+" ") {
+			v, err := strconv.ParseFloat(line[len(prefix)+1:], 64)
+			if err != nil {
+				t.Fatalf("malformed sample `%s'", line)
+			}
+			return v
+		}
+	}
+	return 0
+}
+
+func TestMetrics(t *testing.T) {
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	gets := metricValue(t, `xattrfs_ops_total{op="getxattr"}`)
+	misses := metricValue(t, `xattrfs_op_errors_total{op="getxattr",status="`+fuse.ENOATTR.String()+`"}`)
+	txs := metricValue(t, "xattrfs_tx_duration_seconds_count")
+	setX(t, x, "f", "user.a", "1")
+	wantX(t, x, "f", "user.a", "1")
+	wantNoX(t, x, "f", "user.b")
+	if got := metricValue(t, `xattrfs_ops_total{op="getxattr"}`); got != gets+2 {
+		t.Fatalf("getxattr count went from %v to %v, want 2 more", gets, got)
+	}
+	if got := metricValue(t, `xattrfs_op_errors_total{op="getxattr",status="`+fuse.ENOATTR.String()+`"}`); got != misses+1 {
+		t.Fatalf("getxattr ENOATTR count went from %v to %v, want 1 more", misses, got)
+	}
+	if got := metricValue(t, "xattrfs_tx_duration_seconds_count"); got < txs+3 {
+		t.Fatalf("transaction count went from %v to %v, want at least 3 more", txs, got)
+	}
+	w := httptest.NewRecorder()
+	writeMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !regexp.MustCompile(`(?m)^xattrfs_tx_duration_seconds_bucket\{le="\+Inf"\} \d+$`).MatchString(w.Body.String()) {
+		t.Fatalf("no +Inf histogram bucket in\n%s", w.Body)
+	}
+}
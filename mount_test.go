@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// needMount skips the test without /dev/fuse and fusermount
+func needMount(t testing.TB) {
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		t.Skip("no /dev/fuse to mount with")
+	}
+	if _, err := exec.LookPath("fusermount"); err != nil {
+		t.Skip("no fusermount to mount with")
+	}
+}
+
+// mountTest mounts x on a new temporary directory, as main does, and
+// unmounts it when the test is done; without /dev/fuse and fusermount,
+// or the right to mount, the test is skipped
+func mountTest(t testing.TB, x *xattrFs) string {
+	needMount(t)
+	mnt := t.TempDir()
+	nfs := pathfs.NewPathNodeFs(x, nil)
+	con := nodefs.NewFileSystemConnector(nfs.Root(), nil)
+	srv, err := fuse.NewServer(con.RawFS(), mnt, &fuse.MountOptions{FsName: "xattrfs", Name: "xattrfs"})
+	if err != nil {
+		t.Skipf("cannot mount: %v", err)
+	}
+	go srv.Serve()
+	if err := srv.WaitMount(); err != nil {
+		t.Fatalf("failed to mount: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := srv.Unmount(); err != nil {
+			t.Errorf("failed to unmount: %v", err)
+		}
+	})
+	return mnt
+}
+
+// getxattr returns the value of attr on path, as the kernel reads it
+func getxattr(path string, attr string) ([]byte, error) {
+	sz, err := syscall.Getxattr(path, attr, nil)
+	if err != nil {
+		return nil, err
+	}
+	v := make([]byte, sz)
+	sz, err = syscall.Getxattr(path, attr, v)
+	return v[:sz], err
+}
+
+// listxattr returns the names of the xattrs of path
+func listxattr(path string) ([]string, error) {
+	sz, err := syscall.Listxattr(path, nil)
+	if err != nil || sz == 0 {
+		return nil, err
+	}
+	buf := make([]byte, sz)
+	if sz, err = syscall.Listxattr(path, buf); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range bytes.Split(buf[:sz], []byte{0}) {
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+	}
+	return names, nil
+}
+
+func TestMountRoundTrip(t *testing.T) {
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	mnt := mountTest(t, x)
+	f := filepath.Join(mnt, "f")
+
+	if err := syscall.Setxattr(f, "user.a", []byte("1"), 0); err != nil {
+		t.Fatalf("setxattr: %v", err)
+	}
+	if v, err := getxattr(f, "user.a"); err != nil || string(v) != "1" {
+		t.Fatalf("getxattr = `%s', %v, want `1'", v, err)
+	}
+	if names, err := listxattr(f); err != nil || len(names) != 1 || names[0] != "user.a" {
+		t.Fatalf("listxattr = %v, %v, want [user.a]", names, err)
+	}
+	// kept in the database, not on the underlying file
+	if v, _, code := x.store.Get(pathKey("f"), "user.a"); code != fuse.OK || string(v) != "1" {
+		t.Fatalf("stored value = `%s', %v, want `1'", v, code)
+	}
+	if _, err := getxattr(filepath.Join(dir, "f"), "user.a"); err == nil {
+		t.Fatalf("user.a reached the underlying file")
+	}
+	if err := syscall.Removexattr(f, "user.a"); err != nil {
+		t.Fatalf("removexattr: %v", err)
+	}
+	if _, err := getxattr(f, "user.a"); err != syscall.ENODATA {
+		t.Fatalf("getxattr after remove: %v, want ENODATA", err)
+	}
+}
+
+func TestMountRoot(t *testing.T) {
+	x, _ := testFs(t)
+	mnt := mountTest(t, x)
+	if err := syscall.Setxattr(mnt, "user.root", []byte("r"), 0); err != nil {
+		t.Fatalf("setxattr on the mount root: %v", err)
+	}
+	if v, err := getxattr(mnt, "user.root"); err != nil || string(v) != "r" {
+		t.Fatalf("getxattr on the mount root = `%s', %v, want `r'", v, err)
+	}
+}
+
+func BenchmarkMountGetxattr(b *testing.B) {
+	x, dir := testFs(b)
+	touch(b, dir, "f")
+	mnt := mountTest(b, x)
+	f := filepath.Join(mnt, "f")
+	if err := syscall.Setxattr(f, "user.a", bytes.Repeat([]byte("v"), 1024), 0); err != nil {
+		b.Fatalf("setxattr: %v", err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := getxattr(f, "user.a"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// mainMount is the built binary, mounted by startMain
+type mainMount struct {
+	cmd     *exec.Cmd
+	exited  chan error
+	mnt     string
+	pidfile string
+	log     string
+}
+
+// startMain mounts with the built binary and args, logging to a file,
+// and returns it once it has written its pidfile; the test is skipped if
+// it cannot mount, and the binary killed when the test is done
+func startMain(t *testing.T, args ...string) *mainMount {
+	needMount(t)
+	bin := buildMain(t)
+	dir := t.TempDir()
+	lower := filepath.Join(dir, "lower")
+	m := &mainMount{
+		exited:  make(chan error, 1),
+		mnt:     filepath.Join(dir, "mnt"),
+		pidfile: filepath.Join(dir, "pid"),
+		log:     filepath.Join(dir, "log"),
+	}
+	for _, d := range []string{lower, m.mnt} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	args = append(args, "-pidfile", m.pidfile, "-log-file", m.log, filepath.Join(dir, "db"), lower, m.mnt)
+	m.cmd = exec.Command(bin, args...)
+	if err := m.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go func() { m.exited <- m.cmd.Wait() }()
+	t.Cleanup(func() { m.cmd.Process.Kill() })
+	for i := 0; ; i++ {
+		if _, err := os.Stat(m.pidfile); err == nil {
+			return m
+		}
+		select {
+		case err := <-m.exited:
+			t.Skipf("cannot mount: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if i == 100 {
+			t.Fatal("not mounted after 5s")
+		}
+	}
+}
+
+// stop sends SIGTERM, and fails the test unless the binary then exits
+// cleanly
+func (m *mainMount) stop(t *testing.T) {
+	m.cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case err := <-m.exited:
+		if err != nil {
+			t.Fatalf("exited on SIGTERM with %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("still running 10s after SIGTERM")
+	}
+}
+
+// TestSignals mounts with the built binary, and checks that SIGHUP leaves
+// it serving, and that SIGTERM unmounts it and has it exit cleanly
+func TestSignals(t *testing.T) {
+	m := startMain(t)
+	m.cmd.Process.Signal(syscall.SIGHUP)
+	if err := ioutil.WriteFile(filepath.Join(m.mnt, "f"), nil, 0644); err != nil {
+		t.Fatalf("not serving after SIGHUP: %v", err)
+	}
+	m.stop(t)
+	if _, err := os.Stat(m.pidfile); !os.IsNotExist(err) {
+		t.Errorf("pidfile left after SIGTERM: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(m.mnt, "f")); !os.IsNotExist(err) {
+		t.Errorf("still mounted after SIGTERM: %v", err)
+	}
+}
+
+// TestLogRotation moves the -log-file aside, as logrotate does, and
+// checks that after SIGHUP the binary logs to a new file at its path
+func TestLogRotation(t *testing.T) {
+	m := startMain(t, "-log-level", "debug")
+	f := filepath.Join(m.mnt, "f")
+	if err := ioutil.WriteFile(f, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	rotated := m.log + ".1"
+	if err := os.Rename(m.log, rotated); err != nil {
+		t.Fatal(err)
+	}
+	m.cmd.Process.Signal(syscall.SIGHUP)
+	// the signal is handled in the background, so wait on its new file
+	for i := 0; ; i++ {
+		if _, err := os.Stat(m.log); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("no new log 5s after SIGHUP")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err := syscall.Setxattr(f, "user.rotated", []byte("1"), 0); err != nil {
+		t.Fatalf("setxattr: %v", err)
+	}
+	m.stop(t)
+	if b, err := ioutil.ReadFile(m.log); err != nil || !bytes.Contains(b, []byte("user.rotated")) {
+		t.Fatalf("new log has `%s', %v, want the setxattr after SIGHUP", b, err)
+	}
+	if b, err := ioutil.ReadFile(rotated); err != nil || bytes.Contains(b, []byte("user.rotated")) {
+		t.Fatalf("rotated log has `%s', %v, want nothing after SIGHUP", b, err)
+	}
+}
+
+func TestMountTmpfs(t *testing.T) {
+	needTmpfs(t)
+	testDb(t)
+	keepNamespaces(t, "user")
+	fs, dir, err := tmpfsBackend("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	x := &xattrFs{FileSystem: fs, root: dir, store: boltStore{}}
+	mnt := mountTest(t, x)
+	f := filepath.Join(mnt, "f")
+	if err := ioutil.WriteFile(f, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Setxattr(f, "user.a", []byte("1"), 0); err != nil {
+		t.Fatalf("setxattr: %v", err)
+	}
+	if v, err := getxattr(f, "user.a"); err != nil || string(v) != "1" {
+		t.Fatalf("getxattr = `%s', %v, want `1'", v, err)
+	}
+}
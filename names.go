@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// Paths are stored, as bucket names and -inode-keys index keys, with
+// control characters, DEL, and % percent-encoded, so that they read
+// cleanly in dumps and bolt tools.  No two paths share a key, and as /
+// is kept as is, a directory's key still prefixes the keys beneath it.
+// The mount root, whose path is empty, is keyed rootKey, as bolt has no
+// empty bucket names or keys, and no other path starts with /.
+func pathKey(name string) string {
+	if name == "" {
+		return rootKey
+	}
+	var b []byte
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c < ' ' || c == 0x7f || c == '%' {
+			b = append(b, fmt.Sprintf("%%%02X", c)...)
+		} else {
+			b = append(b, c)
+		}
+	}
+	return string(b)
+}
+
+const rootKey = "/"
+
+// keyPath reverses pathKey; anything not a valid escape is kept as is
+func keyPath(key string) string {
+	if key == rootKey {
+		return ""
+	}
+	if !strings.Contains(key, "%") {
+		return key
+	}
+	var b []byte
+	for i := 0; i < len(key); i++ {
+		if key[i] == '%' && i+2 < len(key) {
+			if c, err := strconv.ParseUint(key[i+1:i+3], 16, 8); err == nil {
+				b = append(b, byte(c))
+				i += 2
+				continue
+			}
+		}
+		b = append(b, key[i])
+	}
+	return string(b)
+}
+
+// metaBucket holds settings of the database itself; escapedMark in it
+// records that paths are stored as pathKey gives them
+const (
+	metaBucket  = "\x00meta"
+	escapedMark = "escaped-paths"
+)
+
+// errUnescaped is why a database from before paths were escaped cannot
+// be read without converting it
+var errUnescaped = errors.New("database has paths stored from before they were escaped, and converting it needs it writable")
+
+// pathsEscaped reports whether the paths in the database of tx are
+// stored as pathKey gives them
+func pathsEscaped(tx *bolt.Tx) bool {
+	meta := tx.Bucket([]byte(metaBucket))
+	return meta != nil && meta.Get([]byte(escapedMark)) != nil
+}
+
+// unescapedPaths returns the bucket names and -inode-keys index keys of
+// the database of tx that escapePaths would rewrite, none once it has
+func unescapedPaths(tx *bolt.Tx) (names []string, keys []string) {
+	if pathsEscaped(tx) {
+		return nil, nil
+	}
+	tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if !reserved(string(name)) && pathKey(string(name)) != string(name) {
+			names = append(names, string(name))
+		}
+		return nil
+	})
+	if idx := tx.Bucket([]byte(pathIndex)); idx != nil {
+		idx.ForEach(func(k, _ []byte) error {
+			if pathKey(string(k)) != string(k) {
+				keys = append(keys, string(k))
+			}
+			return nil
+		})
+	}
+	return names, keys
+}
+
+// escapePaths rewrites the paths in a database written before they were
+// stored escaped, once
+func escapePaths(d *bolt.DB) error {
+	return d.Update(func(tx *bolt.Tx) error {
+		names, keys := unescapedPaths(tx)
+		meta, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+		if err != nil {
+			return err
+		}
+		if meta.Get([]byte(escapedMark)) != nil {
+			return nil
+		}
+		// an escaped key is longer than its path, and can be another
+		// path still to move, as with "a\n" and a literal "a%0A", so the
+		// longest go first, and anything left in the way is refused
+		// rather than overwritten
+		sort.Slice(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+		for _, name := range names {
+			if tx.Bucket([]byte(pathKey(name))) != nil {
+				return fmt.Errorf("cannot escape path %q, as %q is already stored", name, pathKey(name))
+			}
+			if _, err := moveBucket(tx, name, pathKey(name)); err != nil {
+				return err
+			}
+		}
+		if idx := tx.Bucket([]byte(pathIndex)); idx != nil {
+			moves := map[string][]byte{}
+			for _, k := range keys {
+				moves[k] = clone(idx.Get([]byte(k)))
+			}
+			for k, v := range moves {
+				if err := idx.Delete([]byte(k)); err != nil {
+					return err
+				}
+				if err := idx.Put([]byte(pathKey(k)), v); err != nil {
+					return err
+				}
+			}
+		}
+		if len(names) > 0 {
+			infof("escaped %d stored paths", len(names))
+		}
+		return meta.Put([]byte(escapedMark), []byte{1})
+	})
+}
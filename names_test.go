@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestUnescapedDb(t *testing.T) {
+	old := writeDb(t, false, files{"a\nb": {"user.x": "1"}, "%41": {"user.y": "2"}})
+	if _, err := openFlatDb(old, true); err != errUnescaped {
+		t.Fatalf("read-only open of an unescaped database: %v, want errUnescaped", err)
+	}
+	if err := exportDb(old, ioutil.Discard); err != errUnescaped {
+		t.Fatalf("export of an unescaped database: %v, want errUnescaped", err)
+	}
+	d, err := openFlatDb(old, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+	if got := readDb(t, old); got["a\nb"]["user.x"] != "1" || got["%41"]["user.y"] != "2" {
+		t.Fatalf("escaped %q, want the paths as they were", got)
+	}
+	d, err = openFlatDb(old, true)
+	if err != nil {
+		t.Fatalf("read-only open once escaped: %v", err)
+	}
+	d.Close()
+
+	// nothing to escape, so nothing to refuse
+	plain := writeDb(t, false, files{"f": {"user.x": "1"}})
+	d, err = openFlatDb(plain, true)
+	if err != nil {
+		t.Fatalf("read-only open of a database with no paths to escape: %v", err)
+	}
+	d.Close()
+}
+
+func TestUnescapedDbCollision(t *testing.T) {
+	// "a\n" escapes to "a%0A", which another file is already stored as
+	old := writeDb(t, false, files{"a\n": {"user.x": "1"}, "a%0A": {"user.y": "2"}, "a%0A\n": {"user.z": "3"}})
+	d, err := openFlatDb(old, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+	got := readDb(t, old)
+	if len(got) != 3 || got["a\n"]["user.x"] != "1" || got["a%0A"]["user.y"] != "2" || got["a%0A\n"]["user.z"] != "3" {
+		t.Fatalf("escaped %q, want each path's xattrs kept", got)
+	}
+}
+
+func TestPathKey(t *testing.T) {
+	for name, key := range map[string]string{
+		"":         rootKey,
+		"f":        "f",
+		"d/f":      "d/f",
+		"a\nb":     "a%0Ab",
+		"100%":     "100%25",
+		"\x7f\x01": "%7F%01",
+	} {
+		if got := pathKey(name); got != key {
+			t.Errorf("pathKey(%q) = %q, want %q", name, got, key)
+		}
+		if got := keyPath(key); got != name {
+			t.Errorf("keyPath(%q) = %q, want %q", key, got, name)
+		}
+	}
+	if got := keyPath("%zz%4"); got != "%zz%4" {
+		t.Errorf("keyPath of bad escapes = %q, want them kept", got)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/patrickhaller/slog"
+)
+
+// notification is the json line sent to -notify-socket clients
+type notification struct {
+	Action string `json:"action"`
+	Path   string `json:"path"`
+	Attr   string `json:"attr,omitempty"`
+}
+
+// notifyBacklog is how many notifications may queue for a slow client
+// before further ones are dropped for it
+const notifyBacklog = 256
+
+var notifier struct {
+	sync.Mutex
+	ln      net.Listener
+	clients map[net.Conn]chan []byte
+}
+
+// openNotify listens on the unix socket at path, replacing a stale one
+func openNotify(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	notifier.ln = ln
+	notifier.clients = make(map[net.Conn]chan []byte)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			ch := make(chan []byte, notifyBacklog)
+			notifier.Lock()
+			notifier.clients[conn] = ch
+			notifier.Unlock()
+			go notifyClient(conn, ch)
+		}
+	}()
+	return nil
+}
+
+// notifyClient writes queued notifications to conn until it goes away
+func notifyClient(conn net.Conn, ch chan []byte) {
+	defer func() {
+		notifier.Lock()
+		delete(notifier.clients, conn)
+		notifier.Unlock()
+		conn.Close()
+	}()
+	for line := range ch {
+		if _, err := conn.Write(line); err != nil {
+			slog.D("notify client went away: %v", err)
+			return
+		}
+	}
+}
+
+// notify sends e to all connected clients, never blocking the caller
+func notify(e *change) {
+	if notifier.ln == nil {
+		return
+	}
+	line, err := json.Marshal(&notification{Action: e.Action, Path: e.Path, Attr: e.Attr})
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	notifier.Lock()
+	defer notifier.Unlock()
+	for conn, ch := range notifier.clients {
+		select {
+		case ch <- line:
+		default:
+			slog.D("dropping notification for slow client %v", conn.RemoteAddr())
+		}
+	}
+}
+
+// closeNotify stops listening and disconnects all clients
+func closeNotify() {
+	if notifier.ln == nil {
+		return
+	}
+	notifier.ln.Close()
+	os.Remove(notifier.ln.Addr().String())
+	notifier.Lock()
+	for conn := range notifier.clients {
+		conn.Close()
+	}
+	notifier.Unlock()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// testNotify listens on a -notify-socket for the rest of the test, and
+// returns n clients connected to it
+func testNotify(t *testing.T, n int) []net.Conn {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	if err := openNotify(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		closeNotify()
+		notifier.ln = nil
+	})
+	var conns []net.Conn
+	for i := 0; i < n; i++ {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		notifier.Lock()
+		accepted := len(notifier.clients)
+		notifier.Unlock()
+		if accepted == n {
+			return conns
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d clients accepted", accepted, n)
+		}
+	}
+}
+
+func TestNotify(t *testing.T) {
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	conns := testNotify(t, 2)
+	// one client going away leaves the others, and the filesystem, unharmed
+	conns[1].Close()
+	setX(t, x, "f", "user.a", "1")
+	if code := x.RemoveXAttr("f", "user.a", nil); code != fuse.OK {
+		t.Fatalf("remove: %v", code)
+	}
+	setX(t, x, "f", "user.b", "2")
+
+	conns[0].SetReadDeadline(time.Now().Add(time.Second))
+	r := bufio.NewScanner(conns[0])
+	for _, want := range []notification{
+		{Action: actionSet, Path: "f", Attr: "user.a"},
+		{Action: actionRemove, Path: "f", Attr: "user.a"},
+		{Action: actionSet, Path: "f", Attr: "user.b"},
+	} {
+		if !r.Scan() {
+			t.Fatalf("no notification of %+v: %v", want, r.Err())
+		}
+		var got notification
+		if err := json.Unmarshal(r.Bytes(), &got); err != nil || got != want {
+			t.Fatalf("notified `%s', %v, want %+v", r.Text(), err, want)
+		}
+	}
+	conns[0].Close()
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestOpTimeout(t *testing.T) {
+	setFlag(t, "op-timeout", "50ms")
+	audit := testAudit(t)
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	// a writer holding the database stalls every change behind it
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := x.SetXAttr("f", "user.a", []byte("1"), 0, nil); code != fuse.Status(syscall.EINTR) {
+		t.Fatalf("stalled set: %v, want EINTR", code)
+	}
+	tx.Rollback()
+	// closing waits out the timed out set, which must still record its
+	// change, and must not deadlock against the close
+	closeDb()
+	stopAudit()
+	log, err := ioutil.ReadFile(audit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(log, []byte(`"action":"set","path":"f","attr":"user.a"`)) {
+		t.Fatalf("timed out set not audited: %s", log)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dbPerms is the mode and ownership that -db-mode, -db-owner and
+// -db-group give the database file; -1 leaves the owner or group be
+type dbPerms struct {
+	mode     os.FileMode
+	uid, gid int
+}
+
+// parseDbPerms validates -db-mode, -db-owner and -db-group, which take
+// octal modes, and user and group names or ids
+func parseDbPerms(mode string, owner string, group string) (dbPerms, error) {
+	p := dbPerms{uid: -1, gid: -1}
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m&^0777 != 0 {
+		return p, fmt.Errorf("bad -db-mode `%s', want octal permissions like 0640", mode)
+	}
+	p.mode = os.FileMode(m)
+	if owner != "" {
+		u, err := user.Lookup(owner)
+		if err != nil {
+			if u, err = user.LookupId(owner); err != nil {
+				return p, fmt.Errorf("bad -db-owner `%s': %v", owner, err)
+			}
+		}
+		p.uid, _ = strconv.Atoi(u.Uid)
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			if g, err = user.LookupGroupId(group); err != nil {
+				return p, fmt.Errorf("bad -db-group `%s': %v", group, err)
+			}
+		}
+		p.gid, _ = strconv.Atoi(g.Gid)
+	}
+	return p, nil
+}
+
+// filePerms returns the mode and ownership filename has
+func filePerms(filename string) (dbPerms, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return dbPerms{}, err
+	}
+	p := dbPerms{mode: fi.Mode().Perm(), uid: -1, gid: -1}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		p.uid, p.gid = int(st.Uid), int(st.Gid)
+	}
+	return p, nil
+}
+
+// apply gives filename p's mode and ownership
+func (p dbPerms) apply(filename string) error {
+	if err := os.Chmod(filename, p.mode); err != nil {
+		return err
+	}
+	if p.uid < 0 && p.gid < 0 {
+		return nil
+	}
+	return os.Chown(filename, p.uid, p.gid)
+}
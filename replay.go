@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/patrickhaller/slog"
+)
+
+// replayAudit applies the changes of the -audit-log auditLog, in order,
+// to the database at filename, keyed by path, and writes to w how many
+// were applied and how many lines were skipped as malformed
+func replayAudit(auditLog string, filename string, w io.Writer) error {
+	f, err := os.Open(auditLog)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	d, err := openFlatDb(filename, false)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	// one commit per change, unsynced as a rerun of the replay is as good
+	// as one that finished, and without Batch waiting for company
+	d.NoSync = true
+	d.MaxBatchSize = 1
+	db = d
+	var applied, skipped int
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			var e change
+			if jerr := json.Unmarshal(line, &e); jerr != nil || e.Path == "" {
+				slog.P("skipping malformed line %d of `%s'", n, auditLog)
+				skipped++
+			} else if code := replayChange(&e); code == fuse.EINVAL {
+				slog.P("skipping line %d of `%s', with unknown action `%s'", n, auditLog, e.Action)
+				skipped++
+			} else if code != fuse.OK {
+				return fmt.Errorf("line %d: %s of `%s' failed: %v", n, e.Action, e.Path, code)
+			} else {
+				applied++
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := d.Sync(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s: replayed %d changes, skipped %d malformed lines\n", auditLog, applied, skipped)
+	return nil
+}
+
+// replayChange applies e to db, as the op that recorded it did; EINVAL
+// means e is no change it knows
+func replayChange(e *change) fuse.Status {
+	store := boltStore{}
+	bucket := pathKey(e.Path)
+	switch e.Action {
+	case actionSet:
+		v := e.Value
+		if v == nil {
+			v = []byte{}
+		}
+		if err := store.Set(e.Path, bucket, map[string][]byte{e.Attr: v}); err != nil {
+			slog.P("failed to set `%s' attr `%s': `%v'", e.Path, e.Attr, err)
+			return fuse.EIO
+		}
+		return fuse.OK
+	case actionRemove:
+		if code := store.Remove(bucket, attrKey(e.Attr)); code != fuse.ENOATTR {
+			return code
+		}
+		return fuse.OK
+	case actionClear, actionDelete:
+		return store.Delete(bucket)
+	case actionCopy:
+		return store.Copy(pathKey(string(e.Value)), bucket)
+	case actionRename:
+		return store.Rename(bucket, pathKey(string(e.Value)))
+	case actionTTL:
+		d, ok := parseTTL(e.Value)
+		if !ok {
+			return fuse.EINVAL
+		}
+		var expires time.Time
+		if d > 0 {
+			expires = e.Time.Add(d)
+		}
+		if code := store.SetExpiry(bucket, attrKey(e.Attr), expires); code != fuse.ENOATTR {
+			return code
+		}
+		return fuse.OK
+	}
+	return fuse.EINVAL
+}
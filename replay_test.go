@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestReplayAudit rebuilds a database from the -audit-log of a mount,
+// with a malformed line added, and checks it holds what the mount's did
+func TestReplayAudit(t *testing.T) {
+	audit := testAudit(t)
+	x, dir := testFs(t)
+	touch(t, dir, "a")
+	touch(t, dir, "b")
+	setX(t, x, "a", "user.one", "1")
+	setX(t, x, "a", "user.two", "2")
+	if code := x.RemoveXAttr("a", "user.two", nil); code != fuse.OK {
+		t.Fatalf("remove: %v", code)
+	}
+	setX(t, x, "b", "user.old", "x")
+	setX(t, x, "b", copyFromAttr, "/a")
+	setX(t, x, "b", "user.extra", "y")
+	if code := x.Rename("a", "c", nil); code != fuse.OK {
+		t.Fatalf("rename: %v", code)
+	}
+	setX(t, x, "c", "user.three", "3")
+	stopAudit()
+	f, err := os.OpenFile(audit, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("{not an entry\n")
+	f.Close()
+	closeDb()
+
+	replayed := filepath.Join(t.TempDir(), "replayed.db")
+	var out bytes.Buffer
+	if err := replayAudit(audit, replayed, &out); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if !strings.Contains(out.String(), "replayed 8 changes, skipped 1 malformed lines") {
+		t.Errorf("replay reported `%s'", strings.TrimSpace(out.String()))
+	}
+	d, err := openDb(replayed, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = d
+	cache = &xattrCache{lru: list.New(), entries: map[string]map[string]*list.Element{}}
+	want := map[string]map[string]string{
+		"a": {},
+		"b": {"user.one": "1", "user.extra": "y"},
+		"c": {"user.one": "1", "user.three": "3"},
+	}
+	for name, attrs := range want {
+		got, code := x.store.List(pathKey(name), "")
+		if code != fuse.OK || len(got) != len(attrs) {
+			t.Errorf("`%s' has %q, %v, want %d attrs", name, got, code, len(attrs))
+		}
+		for attr, v := range attrs {
+			if got, _, code := x.store.Get(pathKey(name), attrKey(attr)); code != fuse.OK || string(got) != v {
+				t.Errorf("`%s' attr `%s' = `%s', %v, want `%s'", name, attr, got, code, v)
+			}
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/boltdb/bolt"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/patrickhaller/slog"
+)
+
+// seedEvery is how many files importExisting handles per transaction
+const seedEvery = 256
+
+// nativeXattrs returns the persisted xattrs set on path in the
+// underlying filesystem itself
+func nativeXattrs(path string) (map[string][]byte, error) {
+	sz, err := syscall.Listxattr(path, nil)
+	if err != nil || sz == 0 {
+		return nil, err
+	}
+	buf := make([]byte, sz)
+	if sz, err = syscall.Listxattr(path, buf); err != nil {
+		return nil, err
+	}
+	attrs := map[string][]byte{}
+	for _, name := range bytes.Split(buf[:sz], []byte{0}) {
+		attr := string(name)
+		if attr == "" || !persisted(attr) {
+			continue
+		}
+		sz, err := syscall.Getxattr(path, attr, nil)
+		if err != nil {
+			return nil, err
+		}
+		v := make([]byte, sz)
+		if sz, err = syscall.Getxattr(path, attr, v); err != nil {
+			return nil, err
+		}
+		attrs[attr] = v[:sz]
+	}
+	return attrs, nil
+}
+
+// importExisting copies into the db the xattrs the files under root
+// already carry, for those with no stored xattrs yet; each batch of files
+// is committed as it goes, so an interrupted run picks up where it left off
+func importExisting(x *xattrFs) error {
+	type seed struct {
+		name   string
+		bucket string
+		attrs  map[string][]byte
+	}
+	var pending []seed
+	files, seeded := 0, 0
+	flush := func() error {
+		err := db.Update(func(tx *bolt.Tx) error {
+			for _, s := range pending {
+				if tx.Bucket([]byte(s.bucket)) != nil {
+					continue
+				}
+				b, err := tx.CreateBucket([]byte(s.bucket))
+				if err != nil {
+					return err
+				}
+				if err := indexPath(tx, s.name, s.bucket); err != nil {
+					return err
+				}
+				for attr, data := range s.attrs {
+					v, err := encodeValue(data)
+					if err != nil {
+						return err
+					}
+					key := attrKey(attr)
+					if err := putSeq(b, key); err != nil {
+						return err
+					}
+					if err := putValue(b, key, v); err != nil {
+						return err
+					}
+					if err := putCase(b, key, attr); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		seeded += len(pending)
+		pending = pending[:0]
+		infof("import-existing: %d files seen, %d with xattrs imported", files, seeded)
+		return nil
+	}
+	err := filepath.Walk(x.root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			slog.P("import-existing cannot read `%s': %v", path, err)
+			return nil
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		files++
+		name, err := filepath.Rel(x.root, path)
+		if err != nil {
+			return err
+		}
+		name = mountPath(name)
+		attrs, err := nativeXattrs(path)
+		if err != nil {
+			slog.P("import-existing cannot read xattrs of `%s': %v", path, err)
+			return nil
+		}
+		if len(attrs) == 0 {
+			return nil
+		}
+		bucket, code := x.bucketName(name)
+		if code != fuse.OK {
+			return nil
+		}
+		pending = append(pending, seed{name, bucket, attrs})
+		if len(pending) >= seedEvery {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestImportExisting(t *testing.T) {
+	x, dir := testFs(t)
+	if err := os.Mkdir(filepath.Join(dir, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "d/b", "c", "stored"} {
+		touch(t, dir, name)
+	}
+	native := map[string]map[string]string{
+		"a":      {"user.x": "1", "user.y": ""},
+		"d/b":    {"user.z": "2"},
+		"stored": {"user.native": "3"},
+	}
+	for name, attrs := range native {
+		for attr, v := range attrs {
+			if err := syscall.Setxattr(filepath.Join(dir, name), attr, []byte(v), 0); err != nil {
+				t.Skipf("no user xattrs under `%s': %v", dir, err)
+			}
+		}
+	}
+	setX(t, x, "stored", "user.own", "4")
+	if err := importExisting(x); err != nil {
+		t.Fatal(err)
+	}
+	wantX(t, x, "a", "user.x", "1")
+	wantX(t, x, "a", "user.y", "")
+	wantX(t, x, "d/b", "user.z", "2")
+	wantNoX(t, x, "c", "user.x")
+	// files with xattrs stored already are left be
+	wantX(t, x, "stored", "user.own", "4")
+	wantNoX(t, x, "stored", "user.native")
+
+	// run again, as after an interruption, changes since are kept
+	setX(t, x, "a", "user.x", "changed")
+	if err := importExisting(x); err != nil {
+		t.Fatal(err)
+	}
+	wantX(t, x, "a", "user.x", "changed")
+}
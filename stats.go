@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// dbStats is what -stats reports
+type dbStats struct {
+	Files        int     `json:"files"`
+	Attrs        int     `json:"attrs"`
+	AttrsPerFile float64 `json:"attrs_per_file"`
+	LargestValue int     `json:"largest_value"`
+	Bytes        int64   `json:"bytes"`
+	PageSize     int     `json:"page_size"`
+	Pages        int64   `json:"pages"`
+	FreePages    int     `json:"free_pages"`
+	PendingPages int     `json:"pending_pages"`
+}
+
+// statsDb writes to w counts of what the database at filename holds, as
+// text or with asJSON as a json object
+func statsDb(filename string, w io.Writer, asJSON bool) error {
+	src, err := openFlatDb(filename, true)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	var st dbStats
+	err = src.View(func(tx *bolt.Tx) error {
+		st.Bytes = tx.Size()
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if reserved(string(name)) && !strings.HasPrefix(string(name), inodePrefix) {
+				return nil
+			}
+			st.Files++
+			return b.ForEach(func(k, v []byte) error {
+				if v == nil || reserved(string(k)) {
+					return nil
+				}
+				st.Attrs++
+				v, err := getValue(b, string(k))
+				if len(v) > st.LargestValue {
+					st.LargestValue = len(v)
+				}
+				return err
+			})
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if st.Files > 0 {
+		st.AttrsPerFile = float64(st.Attrs) / float64(st.Files)
+	}
+	st.PageSize = src.Info().PageSize
+	st.Pages = st.Bytes / int64(st.PageSize)
+	dbs := src.Stats()
+	st.FreePages, st.PendingPages = dbs.FreePageN, dbs.PendingPageN
+
+	if asJSON {
+		return json.NewEncoder(w).Encode(&st)
+	}
+	fmt.Fprintf(w, "files:          %d\n", st.Files)
+	fmt.Fprintf(w, "attrs:          %d\n", st.Attrs)
+	fmt.Fprintf(w, "attrs per file: %.1f\n", st.AttrsPerFile)
+	fmt.Fprintf(w, "largest value:  %d bytes, as stored\n", st.LargestValue)
+	fmt.Fprintf(w, "database:       %d bytes, %d pages of %d\n", st.Bytes, st.Pages, st.PageSize)
+	fmt.Fprintf(w, "free pages:     %d, %d pending\n", st.FreePages, st.PendingPages)
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	filename := writeDb(t, true, files{
+		"f":   {"user.a": "1", "user.b": "22222"},
+		"d/g": {"user.c": ""},
+		"h":   {"user.d": "333", "user.e": "4", "trusted.f": "55"},
+	})
+	var out bytes.Buffer
+	if err := statsDb(filename, &out, true); err != nil {
+		t.Fatal(err)
+	}
+	var st dbStats
+	if err := json.Unmarshal(out.Bytes(), &st); err != nil {
+		t.Fatalf("-stats -json printed `%s': %v", out.String(), err)
+	}
+	if st.Files != 3 || st.Attrs != 6 || st.AttrsPerFile != 2 || st.LargestValue != 5 {
+		t.Fatalf("stats = %+v, want 3 files, 6 attrs, 2 per file, and 5 bytes largest", st)
+	}
+	if st.PageSize <= 0 || st.Pages*int64(st.PageSize) != st.Bytes {
+		t.Fatalf("stats = %d bytes in %d pages of %d", st.Bytes, st.Pages, st.PageSize)
+	}
+
+	out.Reset()
+	if err := statsDb(filename, &out, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"files:          3\n", "attrs:          6\n", "attrs per file: 2.0\n", "largest value:  5 bytes"} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("-stats printed\n%s\nwant `%s' in it", out.String(), want)
+		}
+	}
+}
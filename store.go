@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/patrickhaller/slog"
+)
+
+// Store keeps the xattrs of files, by bucket as bucketName gives it and
+// key as attrKey gives it.  Set reports failures as errors, which
+// SetXAttr maps to errnos; the rest return the status to hand to FUSE.
+type Store interface {
+	// Set stores attrs, attr -> value, for the file name whose bucket is
+	// bucket, either all of them or, failing, none
+	Set(name string, bucket string, attrs map[string][]byte) error
+	// Get returns the value of key, and when it expires, if ever
+	Get(bucket string, key string) ([]byte, time.Time, fuse.Status)
+	// List returns the names of the attrs in bucket whose key starts
+	// with prefix
+	List(bucket string, prefix string) ([]string, fuse.Status)
+	// Remove drops key, or returns ENOATTR if there is none
+	Remove(bucket string, key string) fuse.Status
+	// Rename moves bucket, and those of paths beneath it, to newBucket,
+	// replacing any there already
+	Rename(bucket string, newBucket string) fuse.Status
+	// Copy replaces newBucket with a copy of bucket
+	Copy(bucket string, newBucket string) fuse.Status
+	// Delete drops bucket
+	Delete(bucket string) fuse.Status
+
+	// SetExpiry makes key expire at t, or never for the zero time, or
+	// returns ENOATTR if it is not set
+	SetExpiry(bucket string, key string, t time.Time) fuse.Status
+	// History returns the earlier values of key kept by -history, oldest
+	// first, or ENOATTR if there are none
+	History(bucket string, key string) ([][]byte, fuse.Status)
+	// Size returns the bytes the store takes up, for -statfs-mode db
+	Size() (int64, fuse.Status)
+
+	// With -inode-keys, Set also indexes the path of the file to its
+	// bucket, and these keep that index as paths come and go.
+	//
+	// Owner returns the path bucket was last indexed under, unless that
+	// is name, or name is indexed to bucket, when it returns ""
+	Owner(name string, bucket string) (string, fuse.Status)
+	// IndexLink indexes newName to the bucket of name
+	IndexLink(name string, newName string) fuse.Status
+	// Reindex moves the index entries of name, and of paths beneath it,
+	// to newName
+	Reindex(name string, newName string) fuse.Status
+	// Unindex drops the index entry of name, and bucket too, unless ""
+	Unindex(name string, bucket string) fuse.Status
+}
+
+// boltStore is the Store of the bolt db
+type boltStore struct{}
+
+func (boltStore) Set(name string, bucket string, attrs map[string][]byte) error {
+	values := map[string][]byte{}
+	for attr, data := range attrs {
+		v, err := encodeValue(data)
+		if err != nil {
+			return fmt.Errorf("failed to encode `%s': %v", attr, err)
+		}
+		values[attr] = v
+	}
+	// Batch may rerun this, so it must only touch tx
+	start := time.Now()
+	err := db.Batch(func(tx *bolt.Tx) error {
+		// the file only ever grows, in whole pages, so this errs towards
+		// refusing early; removes are never refused
+		if *maxDbBytes > 0 && tx.Size() >= *maxDbBytes {
+			return errDbFull
+		}
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err == bolt.ErrIncompatibleValue {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create bucket: %v", err)
+		}
+		if err := indexPath(tx, name, bucket); err != nil {
+			return fmt.Errorf("failed to index: %v", err)
+		}
+		for attr, v := range values {
+			key := attrKey(attr)
+			if *maxAttrs > 0 && b.Get([]byte(key)) == nil && countAttrs(b) >= *maxAttrs {
+				return errTooManyAttrs
+			}
+			if *historyLen > 0 {
+				if err := keepHistory(b, key); err != nil {
+					return err
+				}
+			}
+			if err := putSeq(b, key); err != nil {
+				return err
+			}
+			if err := putValue(b, key, v); err != nil {
+				return err
+			}
+			if err := deleteKey(b, expiryKey(key)); err != nil {
+				return err
+			}
+			if err := putCase(b, key, attr); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	observeTx(start)
+	return err
+}
+
+func (boltStore) Get(bucket string, key string) ([]byte, time.Time, fuse.Status) {
+	return boltGet(bucket, key)
+}
+
+func (boltStore) List(bucket string, prefix string) ([]string, fuse.Status) {
+	defer observeTx(time.Now())
+	tx, b, c, code := boltBucket(bucket, false)
+	if tx == nil {
+		return nil, code
+	}
+	defer tx.Rollback()
+	if code == fuse.ENOENT {
+		return nil, fuse.OK
+	}
+	if code != fuse.OK {
+		return nil, code
+	}
+	return listKeys(b, c, prefix), fuse.OK
+}
+
+// listKeys returns the names of the attrs in b, by its cursor c, whose
+// key starts with prefix, in key order, or with -preserve-order in the
+// order they were first set, those from before it first
+func listKeys(b *bolt.Bucket, c *bolt.Cursor, prefix string) []string {
+	var lis []string
+	var seqs []uint64
+	p := []byte(prefix)
+	for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = c.Next() {
+		if !reserved(string(k)) && !expired(b, string(k)) {
+			lis = append(lis, listName(b, k))
+			seqs = append(seqs, seqOf(b, k))
+		}
+	}
+	if *preserveOrder {
+		sort.Stable(bySeq{lis, seqs})
+	}
+	return lis
+}
+
+// bySeq sorts names by their sequence numbers
+type bySeq struct {
+	names []string
+	seqs  []uint64
+}
+
+func (s bySeq) Len() int           { return len(s.names) }
+func (s bySeq) Less(i, j int) bool { return s.seqs[i] < s.seqs[j] }
+func (s bySeq) Swap(i, j int) {
+	s.names[i], s.names[j] = s.names[j], s.names[i]
+	s.seqs[i], s.seqs[j] = s.seqs[j], s.seqs[i]
+}
+
+func (boltStore) Remove(bucket string, key string) (code fuse.Status) {
+	// a read transaction first, so as not to hold up writers over nothing
+	if code = boltHas(bucket, key); code != fuse.OK {
+		return code
+	}
+	// Batch may rerun this, so it must only touch tx and code
+	start := time.Now()
+	err := db.Batch(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil || b.Get([]byte(key)) == nil {
+			code = fuse.ENOATTR
+			return nil
+		}
+		code = fuse.OK
+		return deleteValue(b, key)
+	})
+	observeTx(start)
+	if err == bolt.ErrDatabaseNotOpen {
+		return shutdown
+	}
+	if err != nil {
+		slog.P("removexattr failed on `%s' attr `%s': `%v'", bucket, key, err)
+		return fuse.EIO
+	}
+	return code
+}
+
+func (boltStore) Rename(bucket string, newBucket string) fuse.Status {
+	return boltRename(bucket, newBucket)
+}
+
+func (boltStore) Copy(bucket string, newBucket string) fuse.Status {
+	return boltCopy(bucket, newBucket)
+}
+
+func (boltStore) Delete(bucket string) fuse.Status {
+	return boltDelete(bucket)
+}
+
+func (boltStore) SetExpiry(bucket string, key string, t time.Time) fuse.Status {
+	return boltSetExpiry(bucket, key, t)
+}
+
+func (boltStore) History(bucket string, key string) ([][]byte, fuse.Status) {
+	return boltHistory(bucket, key)
+}
+
+func (boltStore) Size() (int64, fuse.Status) {
+	var size int64
+	if err := db.View(func(tx *bolt.Tx) error {
+		size = tx.Size()
+		return nil
+	}); err != nil {
+		return 0, txStatus(err)
+	}
+	return size, fuse.OK
+}
+
+func (boltStore) Owner(name string, bucket string) (string, fuse.Status) {
+	return boltOwner(name, bucket)
+}
+
+func (boltStore) IndexLink(name string, newName string) fuse.Status {
+	return boltIndexLink(name, newName)
+}
+
+func (boltStore) Reindex(name string, newName string) fuse.Status {
+	return boltReindex(name, newName)
+}
+
+func (boltStore) Unindex(name string, bucket string) fuse.Status {
+	return boltUnindex(name, bucket)
+}
+
+// memStore is a Store kept in memory, for tests and scratch mounts
+type memStore struct {
+	sync.Mutex
+	buckets map[string]map[string]memAttr
+	// index maps the keys of paths to their buckets, and owners buckets
+	// to the key of the path last indexed to them, as with -inode-keys
+	index  map[string]string
+	owners map[string]string
+	seq    uint64
+}
+
+type memAttr struct {
+	name    string
+	value   []byte
+	seq     uint64
+	expires time.Time
+	history [][]byte
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		buckets: map[string]map[string]memAttr{},
+		index:   map[string]string{},
+		owners:  map[string]string{},
+	}
+}
+
+// live returns the attr key of bucket, unless it is unset or expired
+func (m *memStore) live(bucket string, key string) (memAttr, bool) {
+	a, ok := m.buckets[bucket][key]
+	if !ok || !a.expires.IsZero() && !time.Now().Before(a.expires) {
+		return memAttr{}, false
+	}
+	return a, true
+}
+
+func (m *memStore) size() int64 {
+	var n int64
+	for bucket, b := range m.buckets {
+		n += int64(len(bucket))
+		for k, a := range b {
+			n += int64(len(k) + len(a.value))
+		}
+	}
+	return n
+}
+
+func (m *memStore) Set(name string, bucket string, attrs map[string][]byte) error {
+	m.Lock()
+	defer m.Unlock()
+	if *maxDbBytes > 0 && m.size() >= *maxDbBytes {
+		return errDbFull
+	}
+	b := m.buckets[bucket]
+	added := 0
+	for attr := range attrs {
+		if _, ok := b[attrKey(attr)]; !ok {
+			added++
+		}
+	}
+	if *maxAttrs > 0 && added > 0 && len(b)+added > *maxAttrs {
+		return errTooManyAttrs
+	}
+	if b == nil {
+		b = map[string]memAttr{}
+		m.buckets[bucket] = b
+	}
+	for attr, value := range attrs {
+		a, ok := b[attrKey(attr)]
+		if !ok {
+			m.seq++
+			a.seq = m.seq
+		} else if *historyLen > 0 {
+			a.history = append(a.history, a.value)
+			if len(a.history) > *historyLen {
+				a.history = a.history[len(a.history)-*historyLen:]
+			}
+		}
+		a.name, a.value, a.expires = attr, clone(value), time.Time{}
+		b[attrKey(attr)] = a
+	}
+	if key := pathKey(name); key != bucket {
+		m.index[key] = bucket
+		m.owners[bucket] = key
+	}
+	return nil
+}
+
+func (m *memStore) Get(bucket string, key string) ([]byte, time.Time, fuse.Status) {
+	m.Lock()
+	defer m.Unlock()
+	a, ok := m.live(bucket, key)
+	if !ok {
+		return nil, time.Time{}, fuse.ENOATTR
+	}
+	return clone(a.value), a.expires, fuse.OK
+}
+
+func (m *memStore) List(bucket string, prefix string) ([]string, fuse.Status) {
+	m.Lock()
+	defer m.Unlock()
+	var keys []string
+	for k := range m.buckets[bucket] {
+		if _, ok := m.live(bucket, k); ok && strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	b := m.buckets[bucket]
+	sort.Slice(keys, func(i, j int) bool {
+		if *preserveOrder {
+			return b[keys[i]].seq < b[keys[j]].seq
+		}
+		return keys[i] < keys[j]
+	})
+	var lis []string
+	for _, k := range keys {
+		lis = append(lis, b[k].name)
+	}
+	return lis, fuse.OK
+}
+
+func (m *memStore) Remove(bucket string, key string) fuse.Status {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.live(bucket, key); !ok {
+		return fuse.ENOATTR
+	}
+	delete(m.buckets[bucket], key)
+	return fuse.OK
+}
+
+func (m *memStore) Rename(bucket string, newBucket string) fuse.Status {
+	m.Lock()
+	defer m.Unlock()
+	under := func(name string, parent string) bool {
+		return name == parent || strings.HasPrefix(name, parent+"/")
+	}
+	for name := range m.buckets {
+		if under(name, newBucket) {
+			delete(m.buckets, name)
+			delete(m.owners, name)
+		}
+	}
+	var names []string
+	for name := range m.buckets {
+		if under(name, bucket) {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		to := newBucket + name[len(bucket):]
+		m.buckets[to] = m.buckets[name]
+		delete(m.buckets, name)
+		if owner, ok := m.owners[name]; ok {
+			m.owners[to] = owner
+			delete(m.owners, name)
+		}
+	}
+	return fuse.OK
+}
+
+func (m *memStore) Copy(bucket string, newBucket string) fuse.Status {
+	m.Lock()
+	defer m.Unlock()
+	b, ok := m.buckets[bucket]
+	if !ok {
+		return fuse.OK
+	}
+	nb := map[string]memAttr{}
+	for k, a := range b {
+		a.value = clone(a.value)
+		a.history = append([][]byte{}, a.history...)
+		nb[k] = a
+	}
+	m.buckets[newBucket] = nb
+	if owner, ok := m.owners[bucket]; ok {
+		m.owners[newBucket] = owner
+	}
+	return fuse.OK
+}
+
+func (m *memStore) Delete(bucket string) fuse.Status {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.buckets, bucket)
+	delete(m.owners, bucket)
+	return fuse.OK
+}
+
+func (m *memStore) SetExpiry(bucket string, key string, t time.Time) fuse.Status {
+	m.Lock()
+	defer m.Unlock()
+	a, ok := m.live(bucket, key)
+	if !ok {
+		return fuse.ENOATTR
+	}
+	a.expires = t
+	m.buckets[bucket][key] = a
+	return fuse.OK
+}
+
+func (m *memStore) History(bucket string, key string) ([][]byte, fuse.Status) {
+	m.Lock()
+	defer m.Unlock()
+	a, ok := m.buckets[bucket][key]
+	if !ok || len(a.history) == 0 {
+		return nil, fuse.ENOATTR
+	}
+	var values [][]byte
+	for _, v := range a.history {
+		values = append(values, clone(v))
+	}
+	return values, fuse.OK
+}
+
+func (m *memStore) Size() (int64, fuse.Status) {
+	m.Lock()
+	defer m.Unlock()
+	return m.size(), fuse.OK
+}
+
+func (m *memStore) Owner(name string, bucket string) (string, fuse.Status) {
+	m.Lock()
+	defer m.Unlock()
+	key := pathKey(name)
+	if m.index[key] == bucket || m.owners[bucket] == key || m.owners[bucket] == "" {
+		return "", fuse.OK
+	}
+	return keyPath(m.owners[bucket]), fuse.OK
+}
+
+func (m *memStore) IndexLink(name string, newName string) fuse.Status {
+	m.Lock()
+	defer m.Unlock()
+	if bucket, ok := m.index[pathKey(name)]; ok {
+		m.index[pathKey(newName)] = bucket
+	}
+	return fuse.OK
+}
+
+func (m *memStore) Reindex(name string, newName string) fuse.Status {
+	m.Lock()
+	defer m.Unlock()
+	oldKey, newKey := pathKey(name), pathKey(newName)
+	moves := map[string]string{}
+	for k, bucket := range m.index {
+		if k == oldKey || strings.HasPrefix(k, oldKey+"/") {
+			moves[k] = bucket
+		}
+	}
+	for k := range moves {
+		delete(m.index, k)
+	}
+	for k, bucket := range moves {
+		m.index[newKey+k[len(oldKey):]] = bucket
+	}
+	return fuse.OK
+}
+
+func (m *memStore) Unindex(name string, bucket string) fuse.Status {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.index, pathKey(name))
+	if bucket != "" {
+		delete(m.buckets, bucket)
+		delete(m.owners, bucket)
+	}
+	return fuse.OK
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// stores are the Stores the suite runs against, each opened fresh
+var stores = []struct {
+	name string
+	open func(t testing.TB) Store
+}{
+	{"bolt", func(t testing.TB) Store {
+		testDb(t)
+		return boltStore{}
+	}},
+	{"mem", func(t testing.TB) Store {
+		return newMemStore()
+	}},
+	{"namespaced", func(t testing.TB) Store {
+		testDb(t)
+		if err := setLayout(db, layoutNamespaced); err != nil {
+			t.Fatal(err)
+		}
+		return nsStore{}
+	}},
+}
+
+// forStores runs test as a subtest against each of stores
+func forStores(t *testing.T, test func(t *testing.T, s Store)) {
+	for _, st := range stores {
+		st := st
+		t.Run(st.name, func(t *testing.T) {
+			test(t, st.open(t))
+		})
+	}
+}
+
+// mustSet sets attr to v in the bucket of name, failing the test if not
+func mustSet(t testing.TB, s Store, name string, attr string, v string) {
+	if err := s.Set(name, pathKey(name), map[string][]byte{attr: []byte(v)}); err != nil {
+		t.Fatalf("set `%s' attr `%s': %v", name, attr, err)
+	}
+}
+
+// wantValue fails the test unless attr of bucket reads back as want
+func wantValue(t testing.TB, s Store, bucket string, attr string, want string) {
+	t.Helper()
+	v, _, code := s.Get(bucket, attrKey(attr))
+	if code != fuse.OK || string(v) != want {
+		t.Fatalf("`%s' attr `%s' = `%s', %v, want `%s'", bucket, attr, v, code, want)
+	}
+}
+
+// wantNoValue fails the test unless attr of bucket is unset
+func wantNoValue(t testing.TB, s Store, bucket string, attr string) {
+	t.Helper()
+	if v, _, code := s.Get(bucket, attrKey(attr)); code != fuse.ENOATTR {
+		t.Fatalf("`%s' attr `%s' = `%s', %v, want ENOATTR", bucket, attr, v, code)
+	}
+}
+
+// wantList fails the test unless the attrs of bucket list as want
+func wantList(t testing.TB, s Store, bucket string, prefix string, want ...string) {
+	t.Helper()
+	names, code := s.List(bucket, prefix)
+	if code != fuse.OK || len(names) != len(want) || len(want) > 0 && !reflect.DeepEqual(names, want) {
+		t.Fatalf("list `%s' = %q, %v, want %q", bucket, names, code, want)
+	}
+}
+
+// noNsStore skips the test for the namespaced layout's Store, which has
+// no ttls, history, or inode index
+func noNsStore(t *testing.T, s Store) {
+	if _, ok := s.(nsStore); ok {
+		t.Skip("not in the namespaced layout")
+	}
+}
+
+var storeTests = []struct {
+	name string
+	test func(t *testing.T, s Store)
+}{
+	{"set and get", func(t *testing.T, s Store) {
+		mustSet(t, s, "f", "user.a", "1")
+		wantValue(t, s, "f", "user.a", "1")
+		mustSet(t, s, "f", "user.a", "2")
+		wantValue(t, s, "f", "user.a", "2")
+	}},
+	{"empty value", func(t *testing.T, s Store) {
+		mustSet(t, s, "f", "user.a", "")
+		wantValue(t, s, "f", "user.a", "")
+		wantList(t, s, "f", "user.", "user.a")
+	}},
+	{"get unset", func(t *testing.T, s Store) {
+		wantNoValue(t, s, "f", "user.a")
+		mustSet(t, s, "f", "user.a", "1")
+		wantNoValue(t, s, "f", "user.b")
+	}},
+	{"set several at once", func(t *testing.T, s Store) {
+		if err := s.Set("f", "f", map[string][]byte{"user.a": []byte("1"), "user.b": []byte("2")}); err != nil {
+			t.Fatal(err)
+		}
+		wantValue(t, s, "f", "user.a", "1")
+		wantValue(t, s, "f", "user.b", "2")
+	}},
+	{"set several, failing, sets none", func(t *testing.T, s Store) {
+		setFlag(t, "max-attrs-per-file", "2")
+		mustSet(t, s, "f", "user.a", "1")
+		err := s.Set("f", "f", map[string][]byte{"user.a": []byte("2"), "user.b": []byte("2"), "user.c": []byte("3")})
+		if err != errTooManyAttrs {
+			t.Fatalf("set past -max-attrs-per-file: %v, want errTooManyAttrs", err)
+		}
+		wantValue(t, s, "f", "user.a", "1")
+		wantNoValue(t, s, "f", "user.b")
+	}},
+	{"list in key order", func(t *testing.T, s Store) {
+		for _, attr := range []string{"user.c", "user.a", "user.b"} {
+			mustSet(t, s, "f", attr, "v")
+		}
+		wantList(t, s, "f", "user.", "user.a", "user.b", "user.c")
+	}},
+	{"list by prefix", func(t *testing.T, s Store) {
+		for _, attr := range []string{"user.a", "trusted.b", "user.c"} {
+			mustSet(t, s, "f", attr, "v")
+		}
+		wantList(t, s, "f", "user.", "user.a", "user.c")
+		wantList(t, s, "f", "trusted.", "trusted.b")
+		wantList(t, s, "g", "user.")
+	}},
+	{"list by prefix at its bounds", func(t *testing.T, s Store) {
+		for _, attr := range []string{"user", "user.", "user.a", "user.\xff", "userx", "usez.a", "trusted.user.a"} {
+			mustSet(t, s, "f", attr, "v")
+		}
+		wantList(t, s, "f", "user.", "user.", "user.a", "user.\xff")
+		wantList(t, s, "f", "user.a", "user.a")
+		wantList(t, s, "f", "user.b")
+		wantList(t, s, "f", "", "trusted.user.a", "user", "user.", "user.a", "user.\xff", "userx", "usez.a")
+	}},
+	{"list in order set", func(t *testing.T, s Store) {
+		setFlag(t, "preserve-order", "true")
+		for _, attr := range []string{"user.c", "user.a", "user.b"} {
+			mustSet(t, s, "f", attr, "v")
+		}
+		mustSet(t, s, "f", "user.c", "w")
+		wantList(t, s, "f", "user.", "user.c", "user.a", "user.b")
+	}},
+	{"remove", func(t *testing.T, s Store) {
+		mustSet(t, s, "f", "user.a", "1")
+		mustSet(t, s, "f", "user.b", "2")
+		if code := s.Remove("f", "user.a"); code != fuse.OK {
+			t.Fatalf("remove: %v", code)
+		}
+		wantNoValue(t, s, "f", "user.a")
+		wantList(t, s, "f", "user.", "user.b")
+		if code := s.Remove("f", "user.a"); code != fuse.ENOATTR {
+			t.Fatalf("remove again: %v, want ENOATTR", code)
+		}
+		if code := s.Remove("g", "user.a"); code != fuse.ENOATTR {
+			t.Fatalf("remove from no bucket: %v, want ENOATTR", code)
+		}
+	}},
+	{"rename a tree", func(t *testing.T, s Store) {
+		mustSet(t, s, "d", "user.a", "d")
+		mustSet(t, s, "d/f", "user.a", "f")
+		mustSet(t, s, "d/e/g", "user.a", "g")
+		mustSet(t, s, "dx", "user.a", "x")
+		if code := s.Rename("d", "n"); code != fuse.OK {
+			t.Fatalf("rename: %v", code)
+		}
+		wantValue(t, s, "n", "user.a", "d")
+		wantValue(t, s, "n/f", "user.a", "f")
+		wantValue(t, s, "n/e/g", "user.a", "g")
+		wantValue(t, s, "dx", "user.a", "x")
+		for _, old := range []string{"d", "d/f", "d/e/g"} {
+			wantNoValue(t, s, old, "user.a")
+		}
+	}},
+	{"rename over", func(t *testing.T, s Store) {
+		mustSet(t, s, "a", "user.a", "a")
+		mustSet(t, s, "b", "user.b", "b")
+		if code := s.Rename("a", "b"); code != fuse.OK {
+			t.Fatalf("rename: %v", code)
+		}
+		wantValue(t, s, "b", "user.a", "a")
+		wantNoValue(t, s, "b", "user.b")
+	}},
+	{"copy", func(t *testing.T, s Store) {
+		mustSet(t, s, "a", "user.a", "1")
+		mustSet(t, s, "a", "user.b", "2")
+		mustSet(t, s, "b", "user.c", "3")
+		if code := s.Copy("a", "b"); code != fuse.OK {
+			t.Fatalf("copy: %v", code)
+		}
+		wantList(t, s, "b", "user.", "user.a", "user.b")
+		mustSet(t, s, "a", "user.a", "changed")
+		wantValue(t, s, "b", "user.a", "1")
+		if code := s.Copy("none", "c"); code != fuse.OK {
+			t.Fatalf("copy of no bucket: %v", code)
+		}
+		wantList(t, s, "c", "user.")
+	}},
+	{"delete", func(t *testing.T, s Store) {
+		mustSet(t, s, "f", "user.a", "1")
+		if code := s.Delete("f"); code != fuse.OK {
+			t.Fatalf("delete: %v", code)
+		}
+		wantList(t, s, "f", "user.")
+		if code := s.Delete("f"); code != fuse.OK {
+			t.Fatalf("delete again: %v", code)
+		}
+	}},
+	{"expiry", func(t *testing.T, s Store) {
+		noNsStore(t, s)
+		mustSet(t, s, "f", "user.a", "1")
+		mustSet(t, s, "f", "user.b", "2")
+		if code := s.SetExpiry("f", "user.a", time.Now().Add(time.Hour)); code != fuse.OK {
+			t.Fatalf("set expiry: %v", code)
+		}
+		if _, expires, _ := s.Get("f", "user.a"); expires.IsZero() {
+			t.Fatalf("no expiry read back")
+		}
+		if code := s.SetExpiry("f", "user.b", time.Now().Add(-time.Second)); code != fuse.OK {
+			t.Fatalf("set expiry: %v", code)
+		}
+		wantNoValue(t, s, "f", "user.b")
+		wantList(t, s, "f", "user.", "user.a")
+		if code := s.SetExpiry("f", "user.a", time.Time{}); code != fuse.OK {
+			t.Fatalf("clear expiry: %v", code)
+		}
+		if _, expires, _ := s.Get("f", "user.a"); !expires.IsZero() {
+			t.Fatalf("expiry not cleared")
+		}
+		if code := s.SetExpiry("f", "user.c", time.Now()); code != fuse.ENOATTR {
+			t.Fatalf("expiry of unset attr: %v, want ENOATTR", code)
+		}
+	}},
+	{"set clears expiry", func(t *testing.T, s Store) {
+		noNsStore(t, s)
+		mustSet(t, s, "f", "user.a", "1")
+		s.SetExpiry("f", "user.a", time.Now().Add(time.Hour))
+		mustSet(t, s, "f", "user.a", "2")
+		if _, expires, _ := s.Get("f", "user.a"); !expires.IsZero() {
+			t.Fatalf("set kept the expiry")
+		}
+	}},
+	{"history", func(t *testing.T, s Store) {
+		noNsStore(t, s)
+		setFlag(t, "history", "2")
+		if _, code := s.History("f", "user.a"); code != fuse.ENOATTR {
+			t.Fatalf("history of unset attr: %v, want ENOATTR", code)
+		}
+		for _, v := range []string{"1", "2", "3"} {
+			mustSet(t, s, "f", "user.a", v)
+		}
+		values, code := s.History("f", "user.a")
+		if code != fuse.OK || len(values) != 2 || string(values[0]) != "1" || string(values[1]) != "2" {
+			t.Fatalf("history = %q, %v, want [1 2]", values, code)
+		}
+		wantValue(t, s, "f", "user.a", "3")
+	}},
+	{"size", func(t *testing.T, s Store) {
+		before, code := s.Size()
+		if code != fuse.OK {
+			t.Fatalf("size: %v", code)
+		}
+		mustSet(t, s, "f", "user.a", string(make([]byte, 64<<10)))
+		if after, _ := s.Size(); after <= before {
+			t.Fatalf("size went from %d to %d on storing 64k", before, after)
+		}
+	}},
+	{"inode index", func(t *testing.T, s Store) {
+		noNsStore(t, s)
+		if err := s.Set("f", "\x00ino:1:2", map[string][]byte{"user.a": []byte("1")}); err != nil {
+			t.Fatal(err)
+		}
+		if owner, _ := s.Owner("f", "\x00ino:1:2"); owner != "" {
+			t.Fatalf("owner for the indexed name = `%s', want none", owner)
+		}
+		if owner, _ := s.Owner("g", "\x00ino:1:2"); owner != "f" {
+			t.Fatalf("owner for another name = `%s', want f", owner)
+		}
+		if code := s.IndexLink("f", "g"); code != fuse.OK {
+			t.Fatalf("index link: %v", code)
+		}
+		if owner, _ := s.Owner("g", "\x00ino:1:2"); owner != "" {
+			t.Fatalf("owner for a link = `%s', want none", owner)
+		}
+		if code := s.Reindex("g", "h"); code != fuse.OK {
+			t.Fatalf("reindex: %v", code)
+		}
+		if owner, _ := s.Owner("h", "\x00ino:1:2"); owner != "" {
+			t.Fatalf("owner for a renamed link = `%s', want none", owner)
+		}
+		if code := s.Unindex("h", ""); code != fuse.OK {
+			t.Fatalf("unindex: %v", code)
+		}
+		wantValue(t, s, "\x00ino:1:2", "user.a", "1")
+		if code := s.Unindex("f", "\x00ino:1:2"); code != fuse.OK {
+			t.Fatalf("unindex the last link: %v", code)
+		}
+		wantNoValue(t, s, "\x00ino:1:2", "user.a")
+	}},
+}
+
+func TestStores(t *testing.T) {
+	for _, tt := range storeTests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			forStores(t, tt.test)
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/patrickhaller/slog"
+)
+
+// With -ttl, setting attr+ttlSuffix to a number of seconds, or a duration
+// such as 90m, makes attr expire that long from now; 0 makes it permanent
+// again, as does setting attr itself.  Getting it returns the seconds
+// left.  Without -ttl, attr+ttlSuffix is an attr like any other.
+const ttlSuffix = ".ttl"
+
+// An expiring attr has the unix time, in seconds, after which it is gone
+// stored as 8 big-endian bytes under the reserved key expiryKey.
+func expiryKey(key string) []byte {
+	return []byte("\x00expires\x00" + key)
+}
+
+// ttlBase returns the attr that attr sets the ttl of, if it is one
+func ttlBase(attr string) (string, bool) {
+	if !*ttls || !strings.HasSuffix(attr, ttlSuffix) {
+		return "", false
+	}
+	base := strings.TrimSuffix(attr, ttlSuffix)
+	return base, persisted(base)
+}
+
+// expiry returns when the stored key of b expires, the zero time if never
+func expiry(b *bolt.Bucket, key string) time.Time {
+	v := b.Get(expiryKey(key))
+	if len(v) != 8 {
+		return time.Time{}
+	}
+	return time.Unix(int64(binary.BigEndian.Uint64(v)), 0)
+}
+
+// expired reports whether the stored key of b has expired
+func expired(b *bolt.Bucket, key string) bool {
+	t := expiry(b, key)
+	return !t.IsZero() && !time.Now().Before(t)
+}
+
+func parseTTL(data []byte) (time.Duration, bool) {
+	s := strings.TrimSpace(string(data))
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second, true
+	}
+	d, err := time.ParseDuration(s)
+	return d, err == nil && d >= 0
+}
+
+// boltSetExpiry makes key of bucket expire at t, or never for the zero time
+func boltSetExpiry(bucket string, key string, t time.Time) (code fuse.Status) {
+	defer cache.forget(bucket, key)
+	// Batch may rerun this, so it must only touch tx and code
+	start := time.Now()
+	err := db.Batch(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil || b.Get([]byte(key)) == nil || expired(b, key) {
+			code = fuse.ENOATTR
+			return nil
+		}
+		code = fuse.OK
+		if t.IsZero() {
+			return deleteKey(b, expiryKey(key))
+		}
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, uint64(t.Unix()))
+		return b.Put(expiryKey(key), v)
+	})
+	observeTx(start)
+	if err == bolt.ErrDatabaseNotOpen {
+		return shutdown
+	}
+	if err != nil {
+		slog.P("failed to set ttl of `%s' attr `%s': `%v'", bucket, key, err)
+		return fuse.EIO
+	}
+	return code
+}
+
+// ttlLeft returns the whole seconds left before expires, as getting
+// attr+ttlSuffix does
+func ttlLeft(expires time.Time) []byte {
+	return []byte(strconv.FormatInt(int64(time.Until(expires)/time.Second), 10))
+}
+
+// sweepExpired deletes every expired attr in the db, of path and inode
+// buckets alike; expiring values are never cached, so there is nothing
+// to forget
+func sweepExpired() {
+	if !holdDb() {
+		return
+	}
+	defer releaseDb()
+	start := time.Now()
+	n := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if n := string(name); n == metaBucket || n == pathIndex || strings.HasPrefix(n, nsPrefix) {
+				return nil
+			}
+			prefix := expiryKey("")
+			var keys []string
+			c := b.Cursor()
+			for k, _ := c.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, _ = c.Next() {
+				if key := string(k[len(prefix):]); expired(b, key) {
+					keys = append(keys, key)
+				}
+			}
+			for _, key := range keys {
+				if err := deleteValue(b, key); err != nil {
+					return err
+				}
+				n++
+			}
+			return nil
+		})
+	})
+	observeTx(start)
+	if err != nil {
+		slog.P("failed to sweep expired xattrs: `%v'", err)
+		return
+	}
+	if n > 0 {
+		slog.D("swept %d expired xattrs", n)
+	}
+}
+
+// sweepEvery runs sweepExpired every interval, for as long as mounted
+func sweepEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		sweepExpired()
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestTTL(t *testing.T) {
+	setFlag(t, "ttl", "true")
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	x.SetXAttr("f", "user.a", []byte("1"), 0, nil)
+	if _, code := x.GetXAttr("f", "user.a.ttl", nil); code != fuse.ENOATTR {
+		t.Fatalf("ttl of a permanent attr: %v, want ENOATTR", code)
+	}
+	for _, bad := range []string{"-1", "soon", ""} {
+		if code := x.SetXAttr("f", "user.a.ttl", []byte(bad), 0, nil); code != fuse.EINVAL {
+			t.Fatalf("ttl `%s': %v, want EINVAL", bad, code)
+		}
+	}
+	if code := x.SetXAttr("f", "user.none.ttl", []byte("60"), 0, nil); code != fuse.ENOATTR {
+		t.Fatalf("ttl of an unset attr: %v, want ENOATTR", code)
+	}
+	if code := x.SetXAttr("f", "user.a.ttl", []byte("1h"), 0, nil); code != fuse.OK {
+		t.Fatalf("set ttl: %v", code)
+	}
+	v, code := x.GetXAttr("f", "user.a.ttl", nil)
+	if left, err := strconv.Atoi(string(v)); code != fuse.OK || err != nil || left < 3590 || left > 3600 {
+		t.Fatalf("ttl = `%s', %v, want about 3600", v, code)
+	}
+	if v, code := x.GetXAttr("f", "user.a", nil); code != fuse.OK || string(v) != "1" {
+		t.Fatalf("expiring attr = `%s', %v, want `1'", v, code)
+	}
+	if code := x.SetXAttr("f", "user.a.ttl", []byte("0"), 0, nil); code != fuse.OK {
+		t.Fatalf("clear ttl: %v", code)
+	}
+	if _, code := x.GetXAttr("f", "user.a.ttl", nil); code != fuse.ENOATTR {
+		t.Fatalf("ttl after clearing: %v, want ENOATTR", code)
+	}
+}
+
+func TestTTLExpiry(t *testing.T) {
+	setFlag(t, "ttl", "true")
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	x.SetXAttr("f", "user.a", []byte("1"), 0, nil)
+	x.SetXAttr("f", "user.b", []byte("2"), 0, nil)
+	if code := x.store.SetExpiry("f", "user.a", time.Now().Add(-time.Second)); code != fuse.OK {
+		t.Fatalf("set expiry: %v", code)
+	}
+	if _, code := x.GetXAttr("f", "user.a", nil); code != fuse.ENOATTR {
+		t.Fatalf("expired attr: %v, want ENOATTR", code)
+	}
+	if attrs, code := x.ListXAttr("f", nil); code != fuse.OK || len(attrs) != 1 || attrs[0] != "user.b" {
+		t.Fatalf("list = %q, %v, want only user.b", attrs, code)
+	}
+	if code := x.SetXAttr("f", "user.a.ttl", []byte("60"), 0, nil); code != fuse.ENOATTR {
+		t.Fatalf("ttl of an expired attr: %v, want ENOATTR", code)
+	}
+}
+
+// stored reports whether key is still in bucket, expired or not
+func stored(t *testing.T, bucket string, key string) bool {
+	found := false
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		found = b != nil && b.Get([]byte(key)) != nil
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func TestSweepExpired(t *testing.T) {
+	testDb(t)
+	s := boltStore{}
+	ino := inodePrefix + "1:2"
+	for _, bucket := range []string{"f", ino} {
+		err := s.Set("f", bucket, map[string][]byte{"user.gone": []byte("1"), "user.later": []byte("2"), "user.kept": []byte("3")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.SetExpiry(bucket, "user.gone", time.Now().Add(-time.Second))
+		s.SetExpiry(bucket, "user.later", time.Now().Add(time.Hour))
+	}
+	sweepExpired()
+	for _, bucket := range []string{"f", ino} {
+		if stored(t, bucket, "user.gone") || stored(t, bucket, string(expiryKey("user.gone"))) {
+			t.Fatalf("`%s' attr user.gone not swept", bucket)
+		}
+		if !stored(t, bucket, "user.later") || !stored(t, bucket, "user.kept") {
+			t.Fatalf("`%s' attr swept before expiring", bucket)
+		}
+	}
+}
+
+func TestTTLReplay(t *testing.T) {
+	setFlag(t, "ttl", "true")
+	audit := testAudit(t)
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	x.SetXAttr("f", "user.a", []byte("1"), 0, nil)
+	x.SetXAttr("f", "user.a.ttl", []byte("1h"), 0, nil)
+	x.SetXAttr("f", "user.b", []byte("2"), 0, nil)
+	x.SetXAttr("f", "user.b.ttl", []byte("1h"), 0, nil)
+	x.SetXAttr("f", "user.b.ttl", []byte("0"), 0, nil)
+	stopAudit()
+	closeDb()
+
+	filename := filepath.Join(t.TempDir(), "replayed.db")
+	if err := replayAudit(audit, filename, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	d, err := openDb(filename, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = d
+	_, expires, code := boltStore{}.Get("f", "user.a")
+	if left := time.Until(expires); code != fuse.OK || left < 59*time.Minute || left > time.Hour {
+		t.Fatalf("replayed user.a expires in %v, %v, want about an hour", left, code)
+	}
+	if _, expires, code := (boltStore{}).Get("f", "user.b"); code != fuse.OK || !expires.IsZero() {
+		t.Fatalf("replayed user.b expires at %v, %v, want never", expires, code)
+	}
+}
+
+// TestTTLOff checks that without -ttl an attr named like a ttl is one
+func TestTTLOff(t *testing.T) {
+	x, dir := testFs(t)
+	touch(t, dir, "f")
+	setX(t, x, "f", "user.cache", "c")
+	for _, v := range []string{"hello", "60"} {
+		setX(t, x, "f", "user.cache.ttl", v)
+		wantX(t, x, "f", "user.cache.ttl", v)
+	}
+	setX(t, x, "f", batchAttr, `{"user.batch.ttl": "5m"}`)
+	wantX(t, x, "f", "user.batch.ttl", "5m")
+	wantX(t, x, "f", "user.cache", "c")
+	if _, expires, _ := x.store.Get(pathKey("f"), "user.cache"); !expires.IsZero() {
+		t.Fatalf("user.cache expires at %v", expires)
+	}
+	if code := x.RemoveXAttr("f", "user.cache.ttl", nil); code != fuse.OK {
+		t.Fatalf("remove: %v", code)
+	}
+	wantNoX(t, x, "f", "user.cache.ttl")
+}
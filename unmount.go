@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os/exec"
+	"time"
+
+	"github.com/patrickhaller/slog"
+)
+
+// unmountTries is how many times unmount tries before giving up, or with
+// -lazy-unmount detaching the mount instead, doubling the wait each time
+const unmountTries = 5
+
+var unmountBackoff = 100 * time.Millisecond
+
+// lazyUnmounts are the commands, given the mountpoint, tried in turn to
+// detach a busy mount
+var lazyUnmounts = [][]string{{"fusermount", "-uz"}, {"umount", "-l"}}
+
+// unmounter is a mounted server, as *fuse.Server
+type unmounter interface {
+	Unmount() error
+}
+
+// unmount unmounts srv from mountpoint, retrying while it is busy, as it
+// is while any process has a file open or its cwd in it
+func unmount(srv unmounter, mountpoint string) {
+	backoff := unmountBackoff
+	var err error
+	for i := 0; i < unmountTries; i++ {
+		if err = srv.Unmount(); err == nil {
+			return
+		}
+		slog.D("failed to unmount `%s', try %d of %d: %v", mountpoint, i+1, unmountTries, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	if !*lazyUnmount {
+		slog.P("failed to unmount `%s': %v", mountpoint, err)
+		return
+	}
+	// detached, the mount is gone from the namespace now, and the server
+	// stops once the last process using it lets go
+	for _, cmd := range lazyUnmounts {
+		out, err := exec.Command(cmd[0], append(cmd[1:], mountpoint)...).CombinedOutput()
+		if err == nil {
+			infof("`%s' was busy, lazily unmounted it with %s", mountpoint, cmd[0])
+			return
+		}
+		slog.D("%s failed on `%s': %v: %s", cmd[0], mountpoint, err, out)
+	}
+	slog.P("failed to lazily unmount `%s'", mountpoint)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// busyServer fails to unmount, as with its mountpoint busy, the first
+// busy times it is asked to
+type busyServer struct {
+	busy  int
+	tries int
+}
+
+func (s *busyServer) Unmount() error {
+	s.tries++
+	if s.tries <= s.busy {
+		return errors.New("device or resource busy")
+	}
+	return nil
+}
+
+func TestUnmountBusy(t *testing.T) {
+	defer func(b time.Duration, cmds [][]string) { unmountBackoff, lazyUnmounts = b, cmds }(unmountBackoff, lazyUnmounts)
+	unmountBackoff = time.Millisecond
+	// the first lazy unmount fails, and the second marks the mountpoint
+	lazyUnmounts = [][]string{{"false"}, {"touch"}}
+	for _, tt := range []struct {
+		busy      int
+		lazy      bool
+		wantTries int
+		wantLazy  bool
+	}{
+		{0, true, 1, false},
+		{unmountTries - 1, true, unmountTries, false},
+		{unmountTries, false, unmountTries, false},
+		{unmountTries, true, unmountTries, true},
+	} {
+		setFlag(t, "lazy-unmount", strconv.FormatBool(tt.lazy))
+		mnt := filepath.Join(t.TempDir(), "mnt")
+		srv := &busyServer{busy: tt.busy}
+		unmount(srv, mnt)
+		if srv.tries != tt.wantTries {
+			t.Errorf("busy %d, lazy %v: tried %d times, want %d", tt.busy, tt.lazy, srv.tries, tt.wantTries)
+		}
+		if _, err := os.Stat(mnt); (err == nil) != tt.wantLazy {
+			t.Errorf("busy %d, lazy %v: lazily unmounted is %v, want %v", tt.busy, tt.lazy, err == nil, tt.wantLazy)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// Stored values are either raw, as written by earlier versions, or an
+// envelope of valueMagic, a flags byte, and the payload transformed as
+// the flags say.  Raw values that start with valueMagic are enveloped
+// with no flags, so that they read back unchanged.
+const valueMagic = "\x00xf"
+
+const (
+	valueGzip byte = 1 << iota
+	valueSealed
+	valueChunked
+	valueChecksum
+)
+
+// Values flagged valueChecksum start with the big-endian CRC32C of the
+// rest of the payload, as gzipped and sealed.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Values longer than chunkSize are stored as a manifest, an envelope
+// flagged valueChunked holding the uvarint chunk count, under the attr's
+// own key, and the chunks under reserved keys from chunkKey.
+const chunkSize = 32 << 10
+
+func chunkPrefix(attr string) []byte {
+	return []byte("\x00chunk\x00" + attr + "\x00")
+}
+
+func chunkKey(attr string, i int) []byte {
+	k := chunkPrefix(attr)
+	return append(k, byte(i>>24), byte(i>>16), byte(i>>8), byte(i))
+}
+
+// putValue stores the encoded value v of attr in b
+func putValue(b *bolt.Bucket, attr string, v []byte) error {
+	if err := deleteChunks(b, attr); err != nil {
+		return err
+	}
+	if len(v) <= chunkSize {
+		return b.Put([]byte(attr), v)
+	}
+	n := 0
+	for ; len(v) > 0; n++ {
+		m := chunkSize
+		if len(v) < m {
+			m = len(v)
+		}
+		if err := b.Put(chunkKey(attr, n), v[:m]); err != nil {
+			return err
+		}
+		v = v[m:]
+	}
+	manifest := append([]byte(valueMagic), valueChunked)
+	manifest = append(manifest, make([]byte, binary.MaxVarintLen64)...)
+	manifest = manifest[:len(valueMagic)+1+binary.PutUvarint(manifest[len(valueMagic)+1:], uint64(n))]
+	return b.Put([]byte(attr), manifest)
+}
+
+// getValue returns the encoded value of attr in b, or nil if there is none
+func getValue(b *bolt.Bucket, attr string) ([]byte, error) {
+	v := b.Get([]byte(attr))
+	if !bytes.HasPrefix(v, []byte(valueMagic+string(valueChunked))) {
+		return v, nil
+	}
+	n, k := binary.Uvarint(v[len(valueMagic)+1:])
+	if k <= 0 {
+		return nil, fmt.Errorf("malformed chunk manifest")
+	}
+	// sized first, so the value is copied out of the mmap only once
+	chunks := make([][]byte, n)
+	size := 0
+	for i := range chunks {
+		chunks[i] = b.Get(chunkKey(attr, i))
+		if chunks[i] == nil {
+			return nil, fmt.Errorf("missing chunk %d of %d", i, n)
+		}
+		size += len(chunks[i])
+	}
+	out := make([]byte, 0, size)
+	for _, c := range chunks {
+		out = append(out, c...)
+	}
+	return out, nil
+}
+
+// deleteValue removes attr, and any chunks or case record of it, from b
+func deleteValue(b *bolt.Bucket, attr string) error {
+	if err := deleteChunks(b, attr); err != nil {
+		return err
+	}
+	if err := deleteKey(b, caseKey(attr)); err != nil {
+		return err
+	}
+	if err := deleteKey(b, seqKey(attr)); err != nil {
+		return err
+	}
+	if err := deleteKey(b, expiryKey(attr)); err != nil {
+		return err
+	}
+	if err := b.DeleteBucket(historyBucket(attr)); err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+	return deleteKey(b, []byte(attr))
+}
+
+// deleteKey deletes key from b, if it is set.  bolt's own Delete of an
+// unset key fails with ErrIncompatibleValue where the next key is a
+// nested bucket, as a -history bucket may be.
+func deleteKey(b *bolt.Bucket, key []byte) error {
+	if b.Get(key) == nil {
+		return nil
+	}
+	return b.Delete(key)
+}
+
+// attrKey returns the key attr is stored under, which with
+// -case-insensitive is lowercased after the namespace
+func attrKey(attr string) string {
+	if !*caseless {
+		return attr
+	}
+	i := strings.Index(attr, ".")
+	return attr[:i+1] + strings.ToLower(attr[i+1:])
+}
+
+// Under -case-insensitive, an attr set with other than its lowercase
+// name has that name recorded under the reserved key caseKey, for listing.
+func caseKey(key string) []byte {
+	return []byte("\x00case\x00" + key)
+}
+
+func putCase(b *bolt.Bucket, key string, attr string) error {
+	if key == attr {
+		return deleteKey(b, caseKey(key))
+	}
+	return b.Put(caseKey(key), []byte(attr))
+}
+
+// With -preserve-order, seqKey holds the bucket sequence number, as 8
+// big-endian bytes, at which key was first set, to list attrs in order.
+func seqKey(key string) []byte {
+	return []byte("\x00seq\x00" + key)
+}
+
+// putSeq numbers key in b, unless it is set already; call it before
+// storing the value
+func putSeq(b *bolt.Bucket, key string) error {
+	if !*preserveOrder || b.Get([]byte(key)) != nil {
+		return nil
+	}
+	n, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	seq := make([]byte, 8)
+	binary.BigEndian.PutUint64(seq, n)
+	return b.Put(seqKey(key), seq)
+}
+
+// seqOf returns the sequence number of key in b, 0 if it has none
+func seqOf(b *bolt.Bucket, key []byte) uint64 {
+	if v := b.Get(seqKey(string(key))); len(v) == 8 {
+		return binary.BigEndian.Uint64(v)
+	}
+	return 0
+}
+
+// listName returns the name to list for the stored key k of b
+func listName(b *bolt.Bucket, k []byte) string {
+	if *caseless {
+		if v := b.Get(caseKey(string(k))); v != nil {
+			return string(v)
+		}
+	}
+	return string(k)
+}
+
+func deleteChunks(b *bolt.Bucket, attr string) error {
+	prefix := chunkPrefix(attr)
+	var keys [][]byte
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, clone(k))
+	}
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sealer encrypts values when -encrypt-key-file is given
+var sealer cipher.AEAD
+
+// loadKey sets up sealer from a file holding a 32 byte AES-256 key
+func loadKey(filename string) error {
+	key, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if len(key) != 32 {
+		return fmt.Errorf("key is %d bytes, want 32", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	sealer, err = cipher.NewGCM(block)
+	return err
+}
+
+// compressMin is the smallest value -compress bothers to gzip
+const compressMin = 256
+
+func encodeValue(v []byte) ([]byte, error) {
+	var flags byte
+	if *compress && len(v) >= compressMin {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(v); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		if buf.Len() < len(v) {
+			v = buf.Bytes()
+			flags |= valueGzip
+		}
+	}
+	if sealer != nil {
+		nonce := make([]byte, sealer.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		v = sealer.Seal(nonce, nonce, v, nil)
+		flags |= valueSealed
+	}
+	if *checksum {
+		sum := make([]byte, 4, 4+len(v))
+		binary.BigEndian.PutUint32(sum, crc32.Checksum(v, crcTable))
+		v = append(sum, v...)
+		flags |= valueChecksum
+	}
+	if flags == 0 && !bytes.HasPrefix(v, []byte(valueMagic)) {
+		return v, nil
+	}
+	return append(append([]byte(valueMagic), flags), v...), nil
+}
+
+// decodeValue returns the raw value of a stored one, which it may alias
+func decodeValue(v []byte) ([]byte, error) {
+	if !bytes.HasPrefix(v, []byte(valueMagic)) {
+		return v, nil
+	}
+	if len(v) < len(valueMagic)+1 {
+		return nil, fmt.Errorf("truncated value header")
+	}
+	flags := v[len(valueMagic)]
+	v = v[len(valueMagic)+1:]
+	if flags&^(valueGzip|valueSealed|valueChecksum) != 0 {
+		return nil, fmt.Errorf("unknown value flags %#x", flags)
+	}
+	if flags&valueChecksum != 0 {
+		if len(v) < 4 {
+			return nil, fmt.Errorf("truncated checksummed value")
+		}
+		if binary.BigEndian.Uint32(v) != crc32.Checksum(v[4:], crcTable) {
+			return nil, fmt.Errorf("checksum mismatch")
+		}
+		v = v[4:]
+	}
+	if flags&valueSealed != 0 {
+		if sealer == nil {
+			return nil, fmt.Errorf("value is encrypted, and no key was given")
+		}
+		n := sealer.NonceSize()
+		if len(v) < n {
+			return nil, fmt.Errorf("truncated encrypted value")
+		}
+		var err error
+		if v, err = sealer.Open(nil, v[:n], v[n:], nil); err != nil {
+			return nil, err
+		}
+	}
+	if flags&valueGzip != 0 {
+		r, err := gzip.NewReader(bytes.NewReader(v))
+		if err != nil {
+			return nil, err
+		}
+		if v, err = ioutil.ReadAll(r); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
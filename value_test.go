@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// storedRaw returns the bytes stored under attr in bucket, as they are
+func storedRaw(t *testing.T, bucket string, attr string) []byte {
+	var v []byte
+	err := db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(bucket)); b != nil {
+			v = clone(b.Get([]byte(attr)))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestCompress(t *testing.T) {
+	testDb(t)
+	s := boltStore{}
+	long := string(bytes.Repeat([]byte("compressible "), 100))
+	mustSet(t, s, "f", "user.plain", long)
+	setFlag(t, "compress", "true")
+	mustSet(t, s, "f", "user.long", long)
+	mustSet(t, s, "f", "user.short", "short")
+	if raw := storedRaw(t, "f", "user.long"); len(raw) >= len(long) || !bytes.HasPrefix(raw, []byte(valueMagic)) {
+		t.Fatalf("long value stored as %d bytes, want fewer than %d, in an envelope", len(raw), len(long))
+	}
+	if raw := storedRaw(t, "f", "user.short"); string(raw) != "short" {
+		t.Fatalf("short value stored as `%q', want it as is", raw)
+	}
+	wantValue(t, s, "f", "user.long", long)
+	wantValue(t, s, "f", "user.short", "short")
+	wantValue(t, s, "f", "user.plain", long)
+}
+
+// useKey loads key as -encrypt-key-file does, for the rest of the test
+func useKey(t *testing.T, key []byte) error {
+	old := sealer
+	t.Cleanup(func() { sealer = old })
+	filename := filepath.Join(t.TempDir(), "key")
+	if err := ioutil.WriteFile(filename, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return loadKey(filename)
+}
+
+func TestEncrypt(t *testing.T) {
+	if err := useKey(t, []byte("too short")); err == nil {
+		t.Fatalf("short key accepted")
+	}
+	testDb(t)
+	s := boltStore{}
+	mustSet(t, s, "f", "user.plain", "before the key")
+	if err := useKey(t, bytes.Repeat([]byte{7}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	mustSet(t, s, "f", "user.a", "secret value")
+	mustSet(t, s, "f", "user.b", "secret value")
+	a, b := storedRaw(t, "f", "user.a"), storedRaw(t, "f", "user.b")
+	if bytes.Contains(a, []byte("secret")) || bytes.Equal(a, b) {
+		t.Fatalf("stored `%q' and `%q', want them sealed, with their own nonces", a, b)
+	}
+	wantValue(t, s, "f", "user.a", "secret value")
+	wantValue(t, s, "f", "user.plain", "before the key")
+	// with another key, or none, sealed values fail to read
+	if err := useKey(t, bytes.Repeat([]byte{8}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, code := s.Get("f", "user.a"); code != fuse.EIO {
+		t.Fatalf("get with the wrong key: %v, want EIO", code)
+	}
+	sealer = nil
+	if _, _, code := s.Get("f", "user.a"); code != fuse.EIO {
+		t.Fatalf("get with no key: %v, want EIO", code)
+	}
+}
+
+// chunks returns the number of chunks stored for attr in bucket
+func chunks(t *testing.T, bucket string, attr string) int {
+	n := 0
+	err := db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(bucket)); b != nil {
+			c := b.Cursor()
+			for k, _ := c.Seek(chunkPrefix(attr)); k != nil && bytes.HasPrefix(k, chunkPrefix(attr)); k, _ = c.Next() {
+				n++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestChecksum(t *testing.T) {
+	testDb(t)
+	s := boltStore{}
+	mustSet(t, s, "f", "user.plain", "plain")
+	setFlag(t, "checksum", "true")
+	mustSet(t, s, "f", "user.a", "value")
+	if raw := storedRaw(t, "f", "user.a"); len(raw) != len(valueMagic)+1+4+len("value") {
+		t.Fatalf("value stored as `%q', want it with a header and crc", raw)
+	}
+	wantValue(t, s, "f", "user.a", "value")
+	// those stored before -checksum still read
+	wantValue(t, s, "f", "user.plain", "plain")
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("f"))
+		raw := clone(b.Get([]byte("user.a")))
+		raw[len(raw)-1] ^= 1
+		return b.Put([]byte("user.a"), raw)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _, code := s.Get("f", "user.a"); code != fuse.EIO {
+		t.Fatalf("get of a corrupted value = `%s', %v, want EIO", v, code)
+	}
+	wantValue(t, s, "f", "user.plain", "plain")
+}
+
+func TestChunks(t *testing.T) {
+	x, dir := testFs(t)
+	setFlag(t, "max-value-size", strconv.Itoa(4*chunkSize))
+	touch(t, dir, "f")
+	long := make([]byte, 3*chunkSize+chunkSize/2)
+	for i := range long {
+		long[i] = byte(i % 251)
+	}
+	setX(t, x, "f", "user.long", string(long))
+	setX(t, x, "f", "user.short", "s")
+	if n := chunks(t, pathKey("f"), "user.long"); n != 4 {
+		t.Fatalf("%d byte value stored in %d chunks, want 4", len(long), n)
+	}
+	wantX(t, x, "f", "user.long", string(long))
+	if attrs, code := x.ListXAttr("f", nil); code != fuse.OK || len(attrs) != 2 || attrs[0] != "user.long" || attrs[1] != "user.short" {
+		t.Fatalf("list = %q, %v, want only user.long and user.short", attrs, code)
+	}
+	setX(t, x, "f", "user.long", "now short")
+	if n := chunks(t, pathKey("f"), "user.long"); n != 0 {
+		t.Fatalf("%d chunks left after a short set", n)
+	}
+	wantX(t, x, "f", "user.long", "now short")
+	setX(t, x, "f", "user.long", string(long))
+	if code := x.RemoveXAttr("f", "user.long", nil); code != fuse.OK {
+		t.Fatalf("remove: %v", code)
+	}
+	if n := chunks(t, pathKey("f"), "user.long"); n != 0 {
+		t.Fatalf("%d chunks left after remove", n)
+	}
+	wantNoX(t, x, "f", "user.long")
+}